@@ -1,11 +1,10 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
 	"github.com/adamjedlicka/go-blu/src/compiler"
 	"github.com/adamjedlicka/go-blu/src/parser"
+	"github.com/adamjedlicka/go-blu/src/repl"
 	"github.com/adamjedlicka/go-blu/src/vm"
 	"io/ioutil"
 	"os"
@@ -13,49 +12,54 @@ import (
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		runRepl()
+	args := os.Args[1:]
+	options := compiler.CompilerOptions{}
+
+	if len(args) > 0 && args[0] == "--strict" {
+		options.Strict = true
+		args = args[1:]
+	}
+
+	if len(args) < 1 {
+		runRepl(options)
 	} else {
-		runFile(os.Args[1])
+		runFile(args[0], options)
 	}
 }
 
-func runFile(name string) {
+func runFile(name string, options compiler.CompilerOptions) {
 	data, err := ioutil.ReadFile(name)
 	if err != nil {
 		panic(err)
 	}
 
-	runes := bytes.Runes(data)
+	p := parser.NewParser(parser.Runes(string(data)))
+	c := compiler.NewCompilerWithOptions(name, p, options)
 
-	p := parser.NewParser(runes)
-	c := compiler.NewCompiler(name, p)
+	chunk := c.Compile()
+	if chunk == nil {
+		os.Exit(65)
+	}
 
 	vm := vm.NewVM()
 
 	start := time.Now()
 
-	result := vm.Interpret(c.Compile())
+	result, err := vm.Interpret(chunk)
 
 	elapsed := time.Since(start)
 
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(70)
+	}
+
 	fmt.Println(result)
 	fmt.Printf("took %s\n", elapsed)
 }
 
-func runRepl() {
-	reader := bufio.NewReader(os.Stdin)
-
-	vm := vm.NewVM()
-
-	for true {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			panic(err)
-		}
-
-		result := vm.Exec(line)
-
-		fmt.Println(result)
+func runRepl(options compiler.CompilerOptions) {
+	if err := repl.NewRepl(options).Run(os.Stdin, os.Stdout, os.Stderr); err != nil {
+		panic(err)
 	}
 }
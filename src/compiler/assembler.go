@@ -0,0 +1,335 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"strconv"
+	"strings"
+)
+
+type assembler struct {
+	chunk *Chunk
+	line  int
+	// Line of the listing being assembled.
+	listingLine int
+
+	labels map[string]int
+	// Offsets of jump operands waiting for their label to be resolved.
+	fixups map[int]string
+	// Source line of the listing every fixup comes from, used for error messages.
+	fixupLines map[int]int
+
+	// Assembler of the chunk the function being assembled is a constant of, nil for the outermost chunk.
+	parent *assembler
+	// Function whose chunk is being assembled, nil for the outermost chunk.
+	function *Function
+	// Whether the function uses the constants of the enclosing chunk.
+	shared bool
+	// Functions waiting for the constants of this chunk, which they share.
+	sharing []*Function
+}
+
+func newAssembler(chunk *Chunk, parent *assembler) *assembler {
+	return &assembler{
+		chunk: chunk,
+		line:  1,
+
+		labels:     make(map[string]int),
+		fixups:     make(map[int]string),
+		fixupLines: make(map[int]int),
+
+		parent: parent,
+	}
+}
+
+// Parses a textual listing in the format produced by Chunk.Disassemble into a chunk.
+//
+// Anything after ';' is a comment, except on '.constant' lines where it may be part of a string.
+// Jump operands are label names which are declared by a line of the form 'name:'. Labels are local to the chunk of
+// the function they are declared in.
+func AssembleText(asm string) (*Chunk, error) {
+	root := newAssembler(NewChunk("asm"), nil)
+	a := root
+
+	for i, text := range strings.Split(asm, "\n") {
+		a.listingLine = i + 1
+
+		next, err := a.assembleLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", a.listingLine, err)
+		}
+
+		a = next
+	}
+
+	if a != root {
+		return nil, fmt.Errorf("line %d: missing .end of function '%s'", a.listingLine, a.function.name)
+	}
+
+	if err := root.finish(); err != nil {
+		return nil, err
+	}
+
+	if err := root.chunk.Validate(); err != nil {
+		return nil, err
+	}
+
+	return root.chunk, nil
+}
+
+// Resolves the labels of the chunk and gives its constants to the functions sharing them.
+func (a *assembler) finish() error {
+	for offset, name := range a.fixups {
+		if err := a.resolve(offset, name); err != nil {
+			return fmt.Errorf("line %d: %s", a.fixupLines[offset], err)
+		}
+	}
+
+	for _, function := range a.sharing {
+		function.chunk.constants = a.chunk.constants
+	}
+
+	return nil
+}
+
+// Assembles the line and returns the assembler of the following one, which differs at the start and the end of a
+// function.
+func (a *assembler) assembleLine(text string) (*assembler, error) {
+	if comment := strings.Index(text, ";"); comment != -1 && !strings.HasPrefix(strings.TrimSpace(text), ".constant") {
+		text = text[:comment]
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return a, nil
+	}
+
+	if strings.HasSuffix(text, ":") {
+		name := strings.TrimSuffix(text, ":")
+		if _, ok := a.labels[name]; ok {
+			return nil, fmt.Errorf("label '%s' already defined", name)
+		}
+
+		a.labels[name] = len(a.chunk.code)
+
+		return a, nil
+	}
+
+	if strings.HasPrefix(text, ".") {
+		return a.directive(text)
+	}
+
+	fields := strings.Fields(text)
+
+	op, ok := opCodesByName[fields[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown opcode '%s'", fields[0])
+	}
+
+	operands := op.OperandCount()
+
+	if len(fields)-1 != operands {
+		return nil, fmt.Errorf("opcode '%s' expects %d operand(s), got %d", op, operands, len(fields)-1)
+	}
+
+	a.chunk.pushCode(uint8(op), a.line)
+
+	if op.IsJump() {
+		a.fixups[len(a.chunk.code)] = fields[1]
+		a.fixupLines[len(a.chunk.code)] = a.listingLine
+
+		a.chunk.pushCode(0, a.line)
+		a.chunk.pushCode(0, a.line)
+	} else if op.OperandWidth() == 1 {
+		operand, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operand '%s'", fields[1])
+		}
+
+		a.chunk.pushCode(uint8(operand), a.line)
+	} else {
+		for _, field := range fields[1:] {
+			operand, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid operand '%s'", field)
+			}
+
+			a.chunk.pushCode(uint8((operand>>8)&0xff), a.line)
+			a.chunk.pushCode(uint8(operand&0xff), a.line)
+		}
+	}
+
+	return a, nil
+}
+
+func (a *assembler) directive(text string) (*assembler, error) {
+	if text == ".end" {
+		return a.end()
+	}
+
+	fields := strings.SplitN(text, " ", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("directive '%s' expects an argument", fields[0])
+	}
+
+	argument := strings.TrimSpace(fields[1])
+
+	switch fields[0] {
+	case ".chunk":
+		a.chunk.name = argument
+
+	case ".line":
+		line, err := strconv.Atoi(argument)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line number '%s'", argument)
+		}
+
+		a.line = line
+
+	case ".constant":
+		if a.shared {
+			return nil, fmt.Errorf("function '%s' shares the constants of the enclosing chunk", a.function.name)
+		}
+
+		constant, err := parseConstant(argument)
+		if err != nil {
+			return nil, err
+		}
+
+		a.chunk.pushConstant(constant)
+
+	case ".function":
+		return a.beginFunction(strings.Fields(argument))
+
+	case ".entry":
+		if a.function == nil {
+			return nil, fmt.Errorf("directive '.entry' outside of a function")
+		}
+
+		entry, err := strconv.Atoi(argument)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry '%s'", argument)
+		}
+
+		a.function.entries = append(a.function.entries, entry)
+
+	case ".upvalue":
+		if a.function == nil {
+			return nil, fmt.Errorf("directive '.upvalue' outside of a function")
+		}
+
+		upvalue := strings.Fields(argument)
+		if len(upvalue) != 2 || upvalue[0] != "local" && upvalue[0] != "upvalue" {
+			return nil, fmt.Errorf("expected 'local' or 'upvalue' and an index, got '%s'", argument)
+		}
+
+		index, err := strconv.ParseUint(upvalue[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upvalue index '%s'", upvalue[1])
+		}
+
+		a.function.upvalues = append(a.function.upvalues, NewUpvalue(uint16(index), upvalue[0] == "local"))
+
+	default:
+		return nil, fmt.Errorf("unknown directive '%s'", fields[0])
+	}
+
+	return a, nil
+}
+
+// Starts a function given by its name, arity, minimal arity and optionally 'shared', whose chunk is assembled until
+// the matching '.end'.
+func (a *assembler) beginFunction(fields []string) (*assembler, error) {
+	if len(fields) != 3 && (len(fields) != 4 || fields[3] != "shared") {
+		return nil, fmt.Errorf("expected function name, arity, minimal arity and optionally 'shared', got '%s'", strings.Join(fields, " "))
+	}
+
+	arity, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid arity '%s'", fields[1])
+	}
+
+	minArity, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid arity '%s'", fields[2])
+	}
+
+	function := NewFunction(fields[0])
+	function.arity = arity
+	function.minArity = minArity
+
+	child := newAssembler(function.chunk, a)
+	child.function = function
+	child.shared = len(fields) == 4
+
+	return child, nil
+}
+
+// Finishes the function and adds it to the constants of the enclosing chunk.
+func (a *assembler) end() (*assembler, error) {
+	if a.parent == nil {
+		return nil, fmt.Errorf("directive '.end' outside of a function")
+	}
+
+	if err := a.finish(); err != nil {
+		return nil, err
+	}
+
+	a.parent.chunk.pushConstant(FunctionVal(a.function))
+
+	if a.shared {
+		a.parent.sharing = append(a.parent.sharing, a.function)
+	}
+
+	return a.parent, nil
+}
+
+func (a *assembler) resolve(offset int, name string) error {
+	target, ok := a.labels[name]
+	if !ok {
+		return fmt.Errorf("undefined label '%s'", name)
+	}
+
+	from := offset + 2
+
+	jump := target - from
+	if OpCode(a.chunk.code[offset-1]) == Loop {
+		jump = from - target
+	}
+
+	if jump < 0 || jump > MaxLoop {
+		return fmt.Errorf("label '%s' is out of reach", name)
+	}
+
+	a.chunk.code[offset] = uint8((jump >> 8) & 0xff)
+	a.chunk.code[offset+1] = uint8(jump & 0xff)
+
+	return nil
+}
+
+func parseConstant(text string) (value.Value, error) {
+	if strings.HasPrefix(text, "\"") {
+		str, err := strconv.Unquote(text)
+		if err != nil {
+			return value.NilVal(), fmt.Errorf("invalid string constant %s", text)
+		}
+
+		return value.StringVal(str), nil
+	}
+
+	switch text {
+	case "nil":
+		return value.NilVal(), nil
+	case "true":
+		return value.TrueVal(), nil
+	case "false":
+		return value.FalseVal(), nil
+	}
+
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return value.NilVal(), fmt.Errorf("invalid constant '%s'", text)
+	}
+
+	return value.NumberVal(number), nil
+}
@@ -0,0 +1,105 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisassembledChunkAssemblesBack(t *testing.T) {
+	chunk := compile("var a = 1\nvar s = \"x;y\"\nwhile a < 10 { a = a * 2 }\nif a == 16: s = s + \"!\"\nreturn s")
+
+	assembled, err := AssembleText(chunk.Disassemble())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assembled.Name() != chunk.Name() {
+		t.Errorf("Expected name '%s', got '%s'", chunk.Name(), assembled.Name())
+	}
+
+	assertCode(t, assembled, chunk.code)
+
+	for i := range chunk.lines {
+		if assembled.lines[i] != chunk.lines[i] {
+			t.Fatalf("Expected lines %v, got %v", chunk.lines, assembled.lines)
+		}
+	}
+
+	if len(assembled.constants) != len(chunk.constants) {
+		t.Fatalf("Expected constants %v, got %v", chunk.constants, assembled.constants)
+	}
+
+	for i := range chunk.constants {
+		if assembled.constants[i] != chunk.constants[i] {
+			t.Errorf("Expected constants %v, got %v", chunk.constants, assembled.constants)
+		}
+	}
+}
+
+func TestDisassembledFunctionsAssembleBack(t *testing.T) {
+	chunk := compile("var a = 1\nfn f(x, y = 2) {\nvar g = fn() { return x + a }\nreturn g() + y\n}\nreturn f(a)")
+
+	assembled, err := AssembleText(chunk.Disassemble())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assembled.Disassemble() != chunk.Disassemble() {
+		t.Errorf("Expected\n%s\ngot\n%s", chunk.Disassemble(), assembled.Disassemble())
+	}
+
+	f, ok := asFunction(assembled.constants[5])
+	if !ok || f.Arity() != 2 || f.MinArity() != 1 || len(f.entries) != 2 || !sharesConstants(f.chunk, assembled) {
+		t.Errorf("Expected function f sharing the constants, got %v", assembled.constants[5])
+	}
+}
+
+func TestAssembleLabels(t *testing.T) {
+	chunk, err := AssembleText(`
+.constant 1
+start:
+    True
+    JumpIfFalsy end ; skip the body
+    Pop
+    Loop start
+end:
+    Return
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertCode(t, chunk, []uint8{
+		uint8(True),
+		uint8(JumpIfFalsy), 0, 4,
+		uint8(Pop),
+		uint8(Loop), 0, 8,
+		uint8(Return),
+	})
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		asm     string
+		message string
+	}{
+		{"    Frobnicate", "line 1: unknown opcode 'Frobnicate'"},
+		{"    Constant", "line 1: opcode 'Constant' expects 1 operand(s), got 0"},
+		{"    Jump nowhere\n    Return", "line 1: undefined label 'nowhere'"},
+		{"a:\na:", "line 2: label 'a' already defined"},
+		{".constant \"broken", "line 1: invalid string constant \"broken"},
+		{".function f 0 0\n    ReturnNil", "line 2: missing .end of function 'f'"},
+		{".end", "line 1: directive '.end' outside of a function"},
+		{".entry 0", "line 1: directive '.entry' outside of a function"},
+		{".function f 0\n.end", "line 1: expected function name, arity, minimal arity and optionally 'shared', got 'f 0'"},
+		{".function f 0 0 shared\n.constant 1\n.end", "line 2: function 'f' shares the constants of the enclosing chunk"},
+		{".function f 0 0\n.upvalue global 0\n.end", "line 2: expected 'local' or 'upvalue' and an index, got 'global 0'"},
+	}
+
+	for _, test := range tests {
+		_, err := AssembleText(test.asm)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("Expected error '%s', got '%v'", test.message, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package compiler
+
+import "github.com/adamjedlicka/go-blu/src/value"
+
+// ChunkBuilder constructs chunks instruction by instruction without going through the parser, which lets the
+// virtual machine be tested on exactly the bytecode it is given.
+type ChunkBuilder struct {
+	chunk *Chunk
+	line  int
+}
+
+func NewChunkBuilder(name string) *ChunkBuilder {
+	return &ChunkBuilder{
+		chunk: NewChunk(name),
+		line:  1,
+	}
+}
+
+// Sets the source line recorded for the instructions emitted from now on.
+func (b *ChunkBuilder) Line(line int) *ChunkBuilder {
+	b.line = line
+
+	return b
+}
+
+// Returns the offset the next instruction will be emitted at.
+func (b *ChunkBuilder) Offset() int {
+	return len(b.chunk.code)
+}
+
+// Adds the value to the constant pool and returns its index.
+func (b *ChunkBuilder) Constant(constant value.Value) int {
+	return int(b.chunk.pushConstant(constant))
+}
+
+// Emits the opcode followed by its operands. Opcodes without an operand must be given none.
+func (b *ChunkBuilder) Emit(op OpCode, operands ...int) *ChunkBuilder {
+	if len(operands) != op.OperandCount() {
+		panic("Wrong number of operands for " + op.String() + ".")
+	}
+
+	b.chunk.pushCode(uint8(op), b.line)
+
+	for _, operand := range operands {
+		if op.OperandWidth() == 1 {
+			b.chunk.pushCode(uint8(operand), b.line)
+		} else {
+			b.chunk.pushCode(uint8((operand>>8)&0xff), b.line)
+			b.chunk.pushCode(uint8(operand&0xff), b.line)
+		}
+	}
+
+	return b
+}
+
+// Emits the opcode with the value added to the constant pool as its operand.
+func (b *ChunkBuilder) EmitConstant(op OpCode, constant value.Value) *ChunkBuilder {
+	return b.Emit(op, b.Constant(constant))
+}
+
+// Emits a forward jump with a placeholder offset and returns the offset of the jump to be given to PatchJump.
+func (b *ChunkBuilder) EmitJump(op OpCode) int {
+	b.Emit(op, 0xffff)
+
+	return b.Offset() - 3
+}
+
+// Makes the jump emitted at the given offset land on the next instruction.
+func (b *ChunkBuilder) PatchJump(offset int) *ChunkBuilder {
+	jump := b.Offset() - offset - 3
+
+	b.chunk.code[offset+1] = uint8((jump >> 8) & 0xff)
+	b.chunk.code[offset+2] = uint8(jump & 0xff)
+
+	return b
+}
+
+// Emits a Loop back to the instruction at the given offset.
+func (b *ChunkBuilder) EmitLoop(start int) *ChunkBuilder {
+	return b.Emit(Loop, b.Offset()+3-start)
+}
+
+// Returns the built chunk.
+func (b *ChunkBuilder) Chunk() *Chunk {
+	return b.chunk
+}
+
+// Returns a function with the given arity whose body is the built chunk. The function captures the given variables
+// of the function it is created in.
+func (b *ChunkBuilder) Function(arity int, upvalues ...Upvalue) *Function {
+	function := NewFunction(b.chunk.name)
+	function.arity = arity
+	function.minArity = arity
+	function.entries = append(function.entries, 0)
+	function.upvalues = append(function.upvalues, upvalues...)
+	function.chunk = b.chunk
+
+	return function
+}
+
+// Returns a description of a captured variable, either a local of the enclosing function or one of its upvalues.
+func NewUpvalue(index uint16, isLocal bool) Upvalue {
+	return Upvalue{index: index, isLocal: isLocal}
+}
@@ -0,0 +1,52 @@
+package compiler
+
+import (
+	"github.com/adamjedlicka/go-blu/src/value"
+	"testing"
+)
+
+func TestChunkBuilder(t *testing.T) {
+	b := NewChunkBuilder("test")
+
+	b.Emit(True)
+	jump := b.EmitJump(JumpIfFalsy)
+	b.Line(2).EmitConstant(GetGlobal, value.StringVal("a")).Emit(Call, 0)
+	b.PatchJump(jump)
+	b.EmitLoop(0)
+
+	chunk := b.Chunk()
+
+	expected := []uint8{
+		uint8(True),
+		uint8(JumpIfFalsy), 0, 5,
+		uint8(GetGlobal), 0, 0,
+		uint8(Call), 0,
+		uint8(Loop), 0, 12,
+	}
+
+	assertCode(t, chunk, expected)
+
+	if chunk.lines[4] != 2 || chunk.lines[3] != 1 {
+		t.Errorf("Expected lines to change at offset 4, got %v", chunk.lines)
+	}
+
+	if err := chunk.Validate(); err != nil {
+		t.Errorf("Expected built chunk to be valid, got %s", err)
+	}
+}
+
+func TestChunkBuilderFunction(t *testing.T) {
+	b := NewChunkBuilder("f")
+	b.Emit(GetUpvalue, 0).Emit(Return)
+
+	function := b.Function(2, NewUpvalue(1, true))
+
+	if function.Arity() != 2 || function.MinArity() != 2 || function.Entry(2) != 0 {
+		t.Errorf("Expected function of arity 2 entered at 0, got %d, %d, %d",
+			function.Arity(), function.MinArity(), function.Entry(2))
+	}
+
+	if len(function.Upvalues()) != 1 || function.Upvalues()[0] != NewUpvalue(1, true) {
+		t.Errorf("Expected one captured local, got %v", function.Upvalues())
+	}
+}
@@ -0,0 +1,68 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/adamjedlicka/go-blu/src/parser"
+)
+
+// Problems collected by Check which the compiler itself does not treat as errors.
+type analysis struct {
+	// Names of globals the code refers to, in the order they are referred to.
+	references []parser.Token
+}
+
+// Tracks whether the rest of a block can run, for reporting code following return, break or continue.
+type reachability struct {
+	left     bool
+	reported bool
+}
+
+// Compiles the source only to report its problems, without running it. Besides compile errors and warnings it
+// reports code which can never run and variables which are not defined anywhere, like locals used outside of their
+// scope. Globals the script can use without defining them have to be given by name, the compiler does not know the
+// natives of the VM. The Check of the VM package passes them.
+func Check(source string, globals ...string) []Diagnostic {
+	c := NewCompiler("check", parser.NewParser(parser.Runes(source)))
+	c.analysis = &analysis{
+		references: make([]parser.Token, 0),
+	}
+
+	c.Compile()
+	c.reportUndefined(globals)
+
+	return c.Diagnostics()
+}
+
+// Reports every referenced global which is neither declared by the code nor one of the given globals.
+func (c *Compiler) reportUndefined(globals []string) {
+	defined := make(map[string]bool)
+	for _, name := range globals {
+		defined[name] = true
+	}
+
+	for _, name := range c.analysis.references {
+		if !c.globals[name.Lexeme()] && !defined[name.Lexeme()] {
+			// Every undefined variable is reported, not only the first one
+			c.panicMode = false
+			c.errorAt(name, fmt.Sprintf("Undefined variable '%s'.", name.Lexeme()))
+		}
+	}
+}
+
+// Called before every statement of a block. Warns about the first statement following a return, break or continue
+// in the same block, unless the compiler is not checking the code.
+func (c *Compiler) checkReachable(r *reachability) {
+	if c.analysis == nil {
+		return
+	}
+
+	if r.left && !r.reported {
+		c.warningAt(c.p.Current(), "Unreachable code.")
+		r.reported = true
+	}
+
+	switch c.p.Current().Type() {
+	case parser.Return, parser.Break, parser.Continue:
+		r.left = true
+	}
+}
@@ -43,6 +43,29 @@ func (c *Chunk) pushCode(code uint8, line int) {
 	c.lines = append(c.lines, line)
 }
 
+// Returns the offset of the last instruction in the chunk or -1 if the chunk is empty.
+func (c *Chunk) lastInstruction() int {
+	last := -1
+
+	for offset := 0; offset < len(c.code); offset += 1 + OpCode(c.code[offset]).OperandWidth() {
+		last = offset
+	}
+
+	return last
+}
+
+// Removes all code starting at the given offset.
+func (c *Chunk) truncate(offset int) {
+	c.code = c.code[:offset]
+	c.lines = c.lines[:offset]
+}
+
+// Inserts the code before all existing code. The code must not contain jumps reaching outside of it.
+func (c *Chunk) prepend(code []uint8, lines []int) {
+	c.code = append(append(make([]uint8, 0, len(code)+len(c.code)), code...), c.code...)
+	c.lines = append(append(make([]int, 0, len(lines)+len(c.lines)), lines...), c.lines...)
+}
+
 func (c *Chunk) pushConstant(constant value.Value) uint16 {
 	if len(c.constants) == MaxConstants {
 		panic("Too many constants in one chunk.")
@@ -52,3 +75,35 @@ func (c *Chunk) pushConstant(constant value.Value) uint16 {
 
 	return uint16(len(c.constants) - 1)
 }
+
+type ChunkStats struct {
+	// Total length of the bytecode in bytes, operands included.
+	Length int
+	// Number of occurrences of each opcode.
+	OpCodes map[OpCode]int
+	// Number of entries in the constant pool.
+	Constants int
+	// Number of entries in the constant pool which are not equal to any other entry.
+	DistinctConstants int
+}
+
+func (c *Chunk) Stats() ChunkStats {
+	stats := ChunkStats{
+		Length:    len(c.code),
+		OpCodes:   make(map[OpCode]int),
+		Constants: len(c.constants),
+	}
+
+	for offset := 0; offset < len(c.code); offset += 1 + OpCode(c.code[offset]).OperandWidth() {
+		stats.OpCodes[OpCode(c.code[offset])]++
+	}
+
+	distinct := make(map[value.Value]bool)
+	for _, constant := range c.constants {
+		distinct[constant] = true
+	}
+
+	stats.DistinctConstants = len(distinct)
+
+	return stats
+}
@@ -0,0 +1,59 @@
+package compiler
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	// False
+	// DefineGlobal "a"
+	// GetGlobal "a"
+	// JumpIfFalsy
+	// Pop
+	// Constant 1
+	// GetGlobal "a"
+	// Add
+	// SetGlobal "a"
+	// Pop
+	// Jump
+	// Pop
+	// GetGlobal "a"
+	// Return
+	chunk := compile("var a = false\nif a: a = 1 + a\nreturn a")
+
+	stats := chunk.Stats()
+
+	if stats.Length != 30 {
+		t.Errorf("Expected length 30, got %d", stats.Length)
+	}
+
+	expected := map[OpCode]int{
+		False:        1,
+		DefineGlobal: 1,
+		GetGlobal:    3,
+		SetGlobal:    1,
+		JumpIfFalsy:  1,
+		Jump:         1,
+		Constant:     1,
+		Add:          1,
+		Pop:          3,
+		Return:       1,
+	}
+
+	if len(stats.OpCodes) != len(expected) {
+		t.Errorf("Expected opcodes %v, got %v", expected, stats.OpCodes)
+	}
+
+	for op, count := range expected {
+		if stats.OpCodes[op] != count {
+			t.Errorf("Expected %d of %s, got %d", count, op, stats.OpCodes[op])
+		}
+	}
+
+	// "a", 1
+	if stats.Constants != 2 {
+		t.Errorf("Expected 2 constants, got %d", stats.Constants)
+	}
+
+	if stats.DistinctConstants != 2 {
+		t.Errorf("Expected 2 distinct constants, got %d", stats.DistinctConstants)
+	}
+}
@@ -1,45 +1,136 @@
 package compiler
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/adamjedlicka/go-blu/src/parser"
 	"github.com/adamjedlicka/go-blu/src/value"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const MaxLocals = 65000
 const MaxLoop = 65000
 
 type Compiler struct {
+	// Compiler of the function this function is declared in, nil for the top level script.
+	enclosing *Compiler
+	function  *Function
+
 	p     *parser.Parser
 	chunk *Chunk
 
+	options CompilerOptions
+
 	locals   []Local
 	upvalues []Upvalue
 
 	scopeDepth int8
 
+	// Offset of the Pop emitted by the most recent expression statement.
+	lastExpressionPop int
+	// Offset of the last emitted Constant instruction, or -1 if its value can not be reused.
+	lastConstant int
+	// Offset of the code of the left operand of the infix operator being compiled.
+	leftOperand int
+	// Number of expressions being compiled which contain the current one, functions included.
+	nestingDepth int
+
+	// Loops enclosing the code being compiled, the innermost one is last.
+	loops []LoopContext
+
+	// Names of members of every declared enum.
+	enums map[string]map[string]bool
+
+	// Code defining the top-level functions, which runs before the rest of the script.
+	hoistedCode  []uint8
+	hoistedLines []int
+
+	// Constants of the whole program, shared with the compilers of its functions.
+	pool *constantPool
+	// Interner of string constants, nil if every chunk keeps its own strings.
+	interner *value.Interner
+	// Problems collected for Check, nil when the code is only compiled.
+	analysis *analysis
+
+	// Names of the global variables declared so far.
+	globals map[string]bool
+	// Types from annotations of global variables.
+	globalTypes map[string]string
+	// Type from the return type annotation of the function, empty if it has none.
+	returnType string
+
+	// Formatted messages of all reported compile errors.
+	errors []string
+	// Formatted messages of all reported warnings, which do not stop the compilation.
+	warnings []string
+	// Reported errors and warnings in the order they were reported.
+	diagnostics []Diagnostic
+
 	hadError  bool
 	panicMode bool
 }
 
 func NewCompiler(name string, parser *parser.Parser) Compiler {
+	return NewCompilerWithOptions(name, parser, CompilerOptions{})
+}
+
+// Returns a compiler reading the source from the reader while compiling, instead of from memory.
+func NewCompilerReader(name string, reader io.Reader) Compiler {
+	return NewCompiler(name, parser.NewParserReader(bufio.NewReader(reader), parser.ParserOptions{}))
+}
+
+func NewCompilerWithOptions(name string, parser *parser.Parser, options CompilerOptions) Compiler {
+	function := NewFunction(name)
+
 	return Compiler{
+		enclosing: nil,
+		function:  function,
+
 		p:     parser,
-		chunk: NewChunk(name),
+		chunk: function.chunk,
+
+		options: options,
 
 		locals:   make([]Local, 0),
 		upvalues: make([]Upvalue, 0),
 
 		scopeDepth: 0,
 
+		lastExpressionPop: -1,
+		lastConstant:      -1,
+		leftOperand:       0,
+		nestingDepth:      0,
+
+		loops: make([]LoopContext, 0),
+
+		enums: make(map[string]map[string]bool),
+
+		hoistedCode:  make([]uint8, 0),
+		hoistedLines: make([]int, 0),
+
+		pool:     newConstantPool(),
+		interner: nil,
+		analysis: nil,
+
+		globals:     make(map[string]bool),
+		globalTypes: make(map[string]string),
+		returnType:  "",
+
+		errors:      make([]string, 0),
+		warnings:    make([]string, 0),
+		diagnostics: make([]Diagnostic, 0),
+
 		hadError:  false,
 		panicMode: false,
 	}
 }
 
 func (c *Compiler) Compile() *Chunk {
+	c.applyDirectives()
+
 	for true {
 		c.advance()
 
@@ -48,13 +139,18 @@ func (c *Compiler) Compile() *Chunk {
 		}
 	}
 
+	var reachable reachability
+
 	for !c.match(parser.Eof) {
+		c.checkReachable(&reachable)
 		c.declaration()
 	}
 
-	// Patch last Pop for REPL
-	if len(c.chunk.code) > 0 && c.chunk.code[len(c.chunk.code)-1] == uint8(Pop) {
-		c.chunk.code[len(c.chunk.code)-1] = uint8(Return)
+	// Patch the Pop of the last expression statement for REPL, unless a jump reaches it or skips past it
+	last := c.chunk.lastInstruction()
+	targets := jumpTargets(c.chunk.code)
+	if last >= 0 && last == c.lastExpressionPop && c.chunk.code[last] == uint8(Pop) && !targets[last] && !targets[len(c.chunk.code)] {
+		c.chunk.code[last] = uint8(Return)
 	} else {
 		c.emitReturn()
 	}
@@ -63,12 +159,92 @@ func (c *Compiler) Compile() *Chunk {
 		return nil
 	}
 
+	c.chunk.prepend(c.hoistedCode, c.hoistedLines)
+
+	optimize(c.chunk, nil)
+
+	c.pool.share(c.chunk)
+
+	return c.chunk
+}
+
+// Compiles the source as a single expression whose value the chunk returns. Unlike scripts, the expression cannot
+// define globals, so referring to any global other than the given ones is an error.
+func (c *Compiler) CompileExpression(globals ...string) *Chunk {
+	c.analysis = &analysis{
+		references: make([]parser.Token, 0),
+	}
+
+	c.applyDirectives()
+
+	for true {
+		c.advance()
+
+		if !c.check(parser.Newline) {
+			break
+		}
+	}
+
+	c.expression()
+
+	for c.match(parser.Newline) {
+	}
+
+	c.consume(parser.Eof, "Expect end of expression.")
+	c.emitOpCode(Return)
+
+	c.reportUndefined(globals)
+
+	if c.hadError {
+		return nil
+	}
+
+	optimize(c.chunk, nil)
+
+	c.pool.share(c.chunk)
+
 	return c.chunk
 }
 
+// Returns messages of all errors reported while compiling.
+func (c *Compiler) Errors() []string {
+	return c.errors
+}
+
+// Returns messages of all warnings reported while compiling.
+func (c *Compiler) Warnings() []string {
+	return c.warnings
+}
+
+// Makes string constants shared with other chunks compiled with the same interner, such as the lines of the REPL.
+func (c *Compiler) SetInterner(interner *value.Interner) {
+	c.interner = interner
+}
+
+// Returns all errors and warnings reported while compiling, with the ranges of the source they refer to.
+func (c *Compiler) Diagnostics() []Diagnostic {
+	return c.diagnostics
+}
+
+// Enables the options named by the directive comments at the start of the source.
+func (c *Compiler) applyDirectives() {
+	for _, directive := range c.p.Directives() {
+		switch directive.Name() {
+		case "strict":
+			c.options.Strict = true
+		default:
+			c.warning(directive.Line(), fmt.Sprintf("Unknown directive '%s'.", directive.Name()))
+		}
+	}
+}
+
 func (c *Compiler) declaration() {
 	if c.match(parser.Var) {
 		c.varDeclaration()
+	} else if c.match(parser.Fn) {
+		c.fnDeclaration()
+	} else if c.match(parser.Enum) {
+		c.enumDeclaration()
 	} else {
 		c.statement()
 	}
@@ -80,6 +256,7 @@ func (c *Compiler) declaration() {
 
 func (c *Compiler) varDeclaration() {
 	name := c.parseVariable("Expect variable name.")
+	typeName := c.declareType()
 
 	if c.match(parser.Equal) {
 		c.expression()
@@ -87,11 +264,288 @@ func (c *Compiler) varDeclaration() {
 		c.emitOpCode(Nil)
 	}
 
+	c.emitTypeCheck(typeName)
+
 	c.defineVariable(name)
 
 	c.expectNewlineOrSemicolon()
 }
 
+func (c *Compiler) fnDeclaration() {
+	start := len(c.chunk.code)
+
+	index := c.parseVariable("Expect function name.")
+	name := c.p.Previous().Lexeme()
+
+	// Function can refer to itself in its body
+	c.markInitialized()
+
+	c.compileFunction(name)
+
+	c.defineVariable(index)
+
+	// Top-level functions are defined before the script runs, so they can be called before their declaration
+	if c.enclosing == nil && c.scopeDepth == 0 {
+		c.hoistedCode = append(c.hoistedCode, c.chunk.code[start:]...)
+		c.hoistedLines = append(c.hoistedLines, c.chunk.lines[start:]...)
+
+		c.chunk.truncate(start)
+		c.lastConstant = -1
+
+		// The script does not end with the expression before the declaration any more
+		c.lastExpressionPop = -1
+	}
+}
+
+// Compiles an anonymous function, which is named after the position it is declared at.
+func (c *Compiler) fnExpression(canAssign bool) {
+	token := c.p.Previous()
+
+	c.compileFunction(fmt.Sprintf("<fn@%d:%d>", token.Line(), token.Column()))
+}
+
+// Compiles parameters and body of a function and emits it as a constant.
+func (c *Compiler) compileFunction(name string) {
+	fc := c.newFunctionCompiler(name)
+
+	fc.beginScope()
+
+	fc.consume(parser.LeftParen, "Expect '(' after function name.")
+	fc.parameters()
+	fc.consume(parser.RightParen, "Expect ')' after parameters.")
+
+	fc.returnType = fc.typeAnnotation()
+
+	fc.consume(parser.LeftBrace, "Expect '{' before function body.")
+
+	// Calls with all arguments start right at the body
+	fc.function.entries = append(fc.function.entries, len(fc.chunk.code))
+
+	for i := 1; i <= fc.function.arity; i++ {
+		if fc.needsTypeCheck(fc.locals[i].typeName) {
+			fc.emitOpCode(GetLocal)
+			fc.emitShort(fc.localSlot(i))
+			fc.emitTypeCheck(fc.locals[i].typeName)
+			fc.emitOpCode(Pop)
+		}
+	}
+
+	fc.block()
+	fc.emitReturn()
+
+	c.errors = fc.errors
+	c.warnings = fc.warnings
+	c.diagnostics = fc.diagnostics
+	c.hadError = fc.hadError
+	c.panicMode = fc.panicMode
+
+	if !c.hadError {
+		optimize(fc.chunk, fc.function.entries)
+	}
+
+	fc.function.upvalues = fc.upvalues
+
+	c.emitOpCode(Closure)
+	c.emitShort(c.makeConstant(FunctionVal(fc.function)))
+}
+
+func (c *Compiler) newFunctionCompiler(name string) *Compiler {
+	fc := NewCompiler(name, c.p)
+
+	fc.enclosing = c
+	fc.options = c.options
+	fc.pool = c.pool
+	fc.interner = c.interner
+	fc.analysis = c.analysis
+	fc.enums = c.enums
+	fc.globalTypes = c.globalTypes
+	fc.nestingDepth = c.nestingDepth
+
+	fc.errors = c.errors
+	fc.warnings = c.warnings
+	fc.diagnostics = c.diagnostics
+	fc.hadError = c.hadError
+	fc.panicMode = c.panicMode
+
+	// The first slot holds the called function itself
+	fc.locals = append(fc.locals, Local{
+		depth:     0,
+		isUpvalue: false,
+	})
+
+	return &fc
+}
+
+func (c *Compiler) parameters() {
+	// Parameters can be split across lines and followed by a trailing comma
+	c.consumeNewlines()
+
+	for !c.check(parser.RightParen) {
+		c.function.arity++
+		if c.function.arity > 255 {
+			c.errorAtCurrent("Cannot have more than 255 parameters.")
+		}
+
+		index := c.parseVariable("Expect parameter name.")
+		c.declareType()
+		c.defineVariable(index)
+
+		if c.match(parser.Equal) {
+			// Calls omitting this argument start here and evaluate the default value
+			c.function.entries = append(c.function.entries, len(c.chunk.code))
+
+			c.expression()
+			c.emitOpCode(SetLocal)
+			c.emitShort(c.localSlot(len(c.locals) - 1))
+			c.emitOpCode(Pop)
+		} else {
+			if len(c.function.entries) > 0 {
+				c.error("Parameter without a default value cannot follow one with a default value.")
+			}
+
+			c.function.minArity++
+		}
+
+		c.consumeNewlines()
+		if !c.match(parser.Comma) {
+			break
+		}
+		c.consumeNewlines()
+	}
+}
+
+// Parses an optional type annotation following a variable name and records it for the variable.
+func (c *Compiler) declareType() string {
+	name := c.p.Previous().Lexeme()
+	typeName := c.typeAnnotation()
+
+	if c.scopeDepth > 0 {
+		c.locals[len(c.locals)-1].typeName = typeName
+	} else if typeName != "" {
+		c.globalTypes[name] = typeName
+	} else {
+		delete(c.globalTypes, name)
+	}
+
+	return typeName
+}
+
+// Parses an optional type annotation and returns the name of the type, or empty string if there is none.
+func (c *Compiler) typeAnnotation() string {
+	if !c.match(parser.Colon) {
+		return ""
+	}
+
+	// Nil is a keyword so it needs to be accepted explicitly
+	if !c.match(parser.Nil) {
+		c.consume(parser.Identifier, "Expect type name after ':'.")
+	}
+
+	typeName := c.p.Previous().Lexeme()
+	if !typeNames[typeName] {
+		c.error("Unknown type.")
+	}
+
+	return typeName
+}
+
+// Returns the annotated type of the variable, or empty string if it has none.
+func (c *Compiler) variableType(name parser.Token) string {
+	for compiler := c; compiler != nil; compiler = compiler.enclosing {
+		for i := len(compiler.locals) - 1; i >= 0; i-- {
+			if compiler.locals[i].name.Lexeme() == name.Lexeme() {
+				return compiler.locals[i].typeName
+			}
+		}
+	}
+
+	return c.globalTypes[name.Lexeme()]
+}
+
+func (c *Compiler) needsTypeCheck(typeName string) bool {
+	return c.options.Strict && typeName != "" && typeName != "any"
+}
+
+// Emits a check that the value on top of the stack is of the given type, if running in strict mode.
+func (c *Compiler) emitTypeCheck(typeName string) {
+	if !c.needsTypeCheck(typeName) {
+		return
+	}
+
+	c.emitOpCode(CheckType)
+	c.emitShort(c.makeConstant(value.StringVal(typeName)))
+}
+
+// Compiles an enum into read-only globals, one per member, named after the enum and the member.
+// Members are numbered sequentially from zero or from the last explicitly assigned value.
+func (c *Compiler) enumDeclaration() {
+	if c.scopeDepth > 0 {
+		// Keep parsing so the rest of the declaration does not produce further errors
+		c.error("Enums can only be declared at the top level.")
+	}
+
+	c.consume(parser.Identifier, "Expect enum name.")
+	name := c.p.Previous().Lexeme()
+
+	if _, ok := c.enums[name]; ok {
+		c.error("Already an enum with this name.")
+	}
+
+	members := make(map[string]bool)
+	c.enums[name] = members
+
+	c.consume(parser.LeftBrace, "Expect '{' after enum name.")
+
+	next := 0.0
+
+	for !c.check(parser.RightBrace) && !c.check(parser.Eof) {
+		c.consume(parser.Identifier, "Expect enum member name.")
+		member := c.p.Previous().Lexeme()
+
+		if members[member] {
+			c.error("Already a member with this name in this enum.")
+		}
+
+		members[member] = true
+
+		if c.match(parser.Equal) {
+			next = c.enumValue()
+		}
+
+		c.emitConstant(value.NumberVal(next))
+		c.emitOpCode(DefineGlobal)
+		c.emitShort(c.makeConstant(value.StringVal(name + "." + member)))
+
+		next++
+
+		c.consumeNewlines()
+		if !c.match(parser.Comma) {
+			break
+		}
+		c.consumeNewlines()
+	}
+
+	c.consume(parser.RightBrace, "Expect '}' after enum members.")
+}
+
+func (c *Compiler) enumValue() float64 {
+	negative := c.match(parser.Minus)
+
+	c.consume(parser.Number, "Expect number as enum member value.")
+
+	number, ok := parseNumber(c.p.Previous().Lexeme())
+	if !ok {
+		c.error("Invalid number literal.")
+		return 0
+	}
+
+	if negative {
+		return -number
+	}
+
+	return number
+}
+
 func (c *Compiler) addLocal(name parser.Token) {
 	if len(c.locals) == MaxLocals {
 		c.error("Too many local variables in function.")
@@ -110,6 +564,16 @@ func (c *Compiler) addLocal(name parser.Token) {
 func (c *Compiler) declareVariable() {
 	// Global variables are implicitly declared.
 	if c.scopeDepth == 0 {
+		name := c.p.Previous().Lexeme()
+
+		if _, ok := builtinConstants[name]; ok {
+			c.error("Cannot redefine built-in constant.")
+		} else if c.globals[name] && !c.options.AllowGlobalRedeclaration {
+			c.error("Already a global variable with this name.")
+		}
+
+		c.globals[name] = true
+
 		return
 	}
 
@@ -123,7 +587,7 @@ func (c *Compiler) declareVariable() {
 		}
 
 		if name.Lexeme() == local.name.Lexeme() {
-			c.error("Variable with this name already declared in this scope.")
+			c.error("Already a variable with this name in this scope.")
 		}
 	}
 
@@ -171,16 +635,33 @@ func (c *Compiler) statement() {
 	} else if c.match(parser.If) {
 		c.ifStatement()
 	} else if c.match(parser.While) {
-		c.whileStatement()
+		c.whileStatement("")
+	} else if c.match(parser.For) {
+		c.forStatement("")
+	} else if c.match(parser.Do) {
+		c.doWhileStatement("")
+	} else if c.check(parser.Identifier) && c.p.PeekToken().Type() == parser.Colon {
+		c.labeledStatement()
+	} else if c.check(parser.Identifier) && c.p.Current().Lexeme() == "_" && c.p.PeekToken().Type() == parser.Equal {
+		c.discardStatement()
+	} else if c.match(parser.Break) {
+		c.breakStatement()
+	} else if c.match(parser.Continue) {
+		c.continueStatement()
 	} else if c.match(parser.Return) {
 		c.returnStatement()
+	} else if c.match(parser.Pass) {
+		c.expectNewlineOrSemicolon()
 	} else {
 		c.expressionStatement()
 	}
 }
 
 func (c *Compiler) block() {
+	var reachable reachability
+
 	for !c.check(parser.RightBrace) && !c.check(parser.Eof) {
+		c.checkReachable(&reachable)
 		c.declaration()
 	}
 
@@ -194,20 +675,93 @@ func (c *Compiler) beginScope() {
 func (c *Compiler) endScope() {
 	c.scopeDepth--
 
-	for len(c.locals) > 0 && c.locals[len(c.locals)-1].depth > c.scopeDepth {
-		if c.locals[len(c.locals)-1].isUpvalue {
-			// TODO : Implement closing of upvalues
-			panic("unimplemented")
-		} else {
-			c.emitOpCode(Pop)
-		}
+	first := c.firstLocalInScope()
+	c.closeUpvalues(first)
+
+	for len(c.locals) > first {
+		c.emitOpCode(Pop)
+
+		c.locals = c.locals[:len(c.locals)-1]
+	}
+}
+
+// Ends the scope like endScope, but keeps the value on top of the stack.
+func (c *Compiler) endScopeKeepingResult() {
+	c.scopeDepth--
+
+	first := c.firstLocalInScope()
+	if first == len(c.locals) {
+		return
+	}
+
+	// Captured locals have to be closed before the result overwrites their slots
+	c.closeUpvalues(first)
+
+	// Move the result into the slot of the first local and pop everything above it.
+	c.emitOpCode(SetLocal)
+	c.emitShort(c.localSlot(first))
+
+	for len(c.locals) > first {
+		c.emitOpCode(Pop)
 
 		c.locals = c.locals[:len(c.locals)-1]
 	}
 }
 
+// Returns index of the first local which is deeper than the current scope.
+func (c *Compiler) firstLocalInScope() int {
+	first := len(c.locals)
+	for first > 0 && c.locals[first-1].depth > c.scopeDepth {
+		first--
+	}
+
+	return first
+}
+
+// Emits closing of upvalues of all captured locals starting at the given index, if there are any.
+func (c *Compiler) closeUpvalues(first int) {
+	for i := first; i < len(c.locals); i++ {
+		if c.locals[i].isUpvalue {
+			c.emitOpCode(CloseUpvalues)
+			c.emitShort(c.localSlot(i))
+
+			return
+		}
+	}
+}
+
+// Reserves a local slot for a value which stays on the stack while the rest of the expression is compiled.
+func (c *Compiler) pushTemporary() {
+	c.locals = append(c.locals, Local{
+		depth:     c.scopeDepth,
+		isUpvalue: false,
+	})
+}
+
+func (c *Compiler) popTemporary() {
+	c.locals = c.locals[:len(c.locals)-1]
+}
+
+// Returns the stack slot of the local at the given index.
+// Locals whose initializer is still being compiled are not on the stack yet, so they do not occupy a slot.
+func (c *Compiler) localSlot(index int) uint16 {
+	slot := index
+
+	for i := 0; i < index; i++ {
+		if c.locals[i].depth == -1 {
+			slot--
+		}
+	}
+
+	return uint16(slot)
+}
+
 func (c *Compiler) ifStatement() {
-	c.expression()
+	if literal, taken := c.condition(); literal {
+		c.literalIfStatement(taken)
+		return
+	}
+
 	ifJump := c.emitJump(JumpIfFalsy)
 	c.emitOpCode(Pop) // Condition
 
@@ -228,9 +782,50 @@ func (c *Compiler) ifStatement() {
 	c.block()
 	c.endScope()
 
+	elseJump := c.emitJump(Jump)
 	c.patchJump(ifJump)
 	c.emitOpCode(Pop) // Condition
 
+	c.elseBranch()
+
+	c.patchJump(elseJump)
+}
+
+// Compiles an if statement whose condition is a literal. Both branches are compiled to report their errors, but only
+// the code of the branch that is taken is kept.
+func (c *Compiler) literalIfStatement(taken bool) {
+	start := len(c.chunk.code)
+
+	// One-line notation
+	oneLine := c.match(parser.Colon)
+	if oneLine {
+		c.statement()
+	} else {
+		c.consume(parser.LeftBrace, "Expect '{' after if condition.")
+		c.beginScope()
+		c.block()
+		c.endScope()
+	}
+
+	if !taken {
+		c.discardCode(start)
+	}
+
+	if !oneLine {
+		start = len(c.chunk.code)
+
+		c.elseBranch()
+
+		if taken {
+			c.discardCode(start)
+		}
+	}
+
+	// Like the value of any other if statement, the value of the taken branch is not the result of the script
+	c.lastExpressionPop = -1
+}
+
+func (c *Compiler) elseBranch() {
 	if c.match(parser.Else) {
 		if c.match(parser.LeftBrace) {
 			c.beginScope()
@@ -244,169 +839,914 @@ func (c *Compiler) ifStatement() {
 	}
 }
 
-func (c *Compiler) whileStatement() {
-	loopStart := c.startLoop()
-
+// Compiles the condition of a statement. A condition which is just a true or false literal is not emitted, the
+// statement can decide which way it goes at compile time instead. Conditions with a constant value are warned about.
+func (c *Compiler) condition() (literal bool, truthy bool) {
+	start := len(c.chunk.code)
+	token := c.p.Current()
+
+	c.expression()
+
+	if constant, ok := c.constantAt(start); ok {
+		if value.IsTruthy(constant) {
+			c.warningAt(token, "Condition is always true.")
+		} else {
+			c.warningAt(token, "Condition is always false.")
+		}
+	}
+
+	if len(c.chunk.code) != start+1 {
+		return false, false
+	}
+
+	switch OpCode(c.chunk.code[start]) {
+	case True:
+		c.chunk.truncate(start)
+		return true, true
+	case False:
+		c.chunk.truncate(start)
+		return true, false
+	}
+
+	return false, false
+}
+
+// Returns the value of the code starting at the given offset if it only pushes a constant, possibly a folded one.
+func (c *Compiler) constantAt(start int) (value.Value, bool) {
+	code := c.chunk.code[start:]
+
+	if len(code) == 1 {
+		switch OpCode(code[0]) {
+		case True:
+			return value.TrueVal(), true
+		case False:
+			return value.FalseVal(), true
+		case Nil:
+			return value.NilVal(), true
+		}
+	}
+
+	if len(code) == 3 && OpCode(code[0]) == Constant {
+		return c.chunk.constants[c.chunk.operand(start)], true
+	}
+
+	return value.NilVal(), false
+}
+
+// Removes code starting at the given offset, which would never be executed. Jumps of break and continue statements
+// in the removed code are not patched later.
+func (c *Compiler) discardCode(start int) {
+	c.chunk.truncate(start)
+
+	for i := range c.loops {
+		c.loops[i].breaks = jumpsBefore(c.loops[i].breaks, start)
+		c.loops[i].continues = jumpsBefore(c.loops[i].continues, start)
+	}
+
+	c.lastConstant = -1
+	c.lastExpressionPop = -1
+}
+
+// Returns the jumps whose operands are before the given offset.
+func jumpsBefore(jumps []int, offset int) []int {
+	kept := jumps[:0]
+
+	for _, jump := range jumps {
+		if jump < offset {
+			kept = append(kept, jump)
+		}
+	}
+
+	return kept
+}
+
+func (c *Compiler) whileStatement(label string) {
+	loopStart := c.startLoop()
+
+	c.loops = append(c.loops, LoopContext{
+		label:      label,
+		start:      loopStart,
+		scopeDepth: c.scopeDepth,
+		breaks:     make([]int, 0),
+	})
+
+	// A literal true condition loops without checking it and a literal false one never runs the body
+	literal, truthy := c.condition()
+
+	exitJump := -1
+	if !literal {
+		exitJump = c.emitJump(JumpIfFalsy)
+		c.emitOpCode(Pop) // Condition
+	}
+
+	// One-line notation
+	if c.match(parser.Colon) {
+		c.statement()
+	} else {
+		c.consume(parser.LeftBrace, "Expect '{' after while condition.")
+
+		c.beginScope()
+		c.block()
+		c.endScope()
+	}
+
+	c.emitLoop(loopStart)
+
+	if exitJump != -1 {
+		c.patchJump(exitJump)
+		c.emitOpCode(Pop) // Condition
+	}
+
+	// Breaks jump out of the body, where the condition is already popped
+	loop := c.loops[len(c.loops)-1]
+	for _, jump := range loop.breaks {
+		c.patchJump(jump)
+	}
+
+	c.loops = c.loops[:len(c.loops)-1]
+
+	if literal && !truthy {
+		c.discardCode(loopStart)
+	}
+}
+
+// Compiles 'for initializer; condition; increment { body }' where every clause is optional. The variable declared
+// by the initializer is scoped to the loop.
+func (c *Compiler) forStatement(label string) {
+	c.beginScope()
+
+	if c.match(parser.Semicolon) {
+		// No initializer
+	} else if c.match(parser.Var) {
+		c.varDeclaration()
+	} else {
+		c.expression()
+		c.emitOpCode(Pop)
+		c.consume(parser.Semicolon, "Expect ';' after loop initializer.")
+	}
+
+	loopStart := c.startLoop()
+
+	exitJump := -1
+	if !c.match(parser.Semicolon) {
+		c.expression()
+		c.consume(parser.Semicolon, "Expect ';' after loop condition.")
+
+		exitJump = c.emitJump(JumpIfFalsy)
+		c.emitOpCode(Pop) // Condition
+	}
+
+	// The increment runs after the body, so the body jumps over it first time around and loops back to it
+	if !c.check(parser.LeftBrace) && !c.check(parser.Colon) {
+		bodyJump := c.emitJump(Jump)
+		incrementStart := c.startLoop()
+
+		c.expression()
+		c.emitOpCode(Pop)
+
+		c.emitLoop(loopStart)
+		loopStart = incrementStart
+		c.patchJump(bodyJump)
+	}
+
+	c.loops = append(c.loops, LoopContext{
+		label:      label,
+		start:      loopStart,
+		scopeDepth: c.scopeDepth,
+		breaks:     make([]int, 0),
+	})
+
+	// One-line notation
+	if c.match(parser.Colon) {
+		c.statement()
+	} else {
+		c.consume(parser.LeftBrace, "Expect '{' after for clauses.")
+
+		c.beginScope()
+		c.block()
+		c.endScope()
+	}
+
+	c.emitLoop(loopStart)
+
+	if exitJump != -1 {
+		c.patchJump(exitJump)
+		c.emitOpCode(Pop) // Condition
+	}
+
+	loop := c.loops[len(c.loops)-1]
+	for _, jump := range loop.breaks {
+		c.patchJump(jump)
+	}
+
+	c.loops = c.loops[:len(c.loops)-1]
+
+	c.endScope()
+}
+
+// Compiles 'do { body } while condition', which runs the body before checking the condition for the first time.
+func (c *Compiler) doWhileStatement(label string) {
+	bodyStart := c.startLoop()
+
+	// The condition follows the body, so continue jumps forward to it
+	c.loops = append(c.loops, LoopContext{
+		label:      label,
+		start:      -1,
+		scopeDepth: c.scopeDepth,
+		breaks:     make([]int, 0),
+		continues:  make([]int, 0),
+	})
+
+	c.consume(parser.LeftBrace, "Expect '{' after 'do'.")
+
+	c.beginScope()
+	c.block()
+	c.endScope()
+
+	c.consume(parser.While, "Expect 'while' after do loop body.")
+
+	loop := c.loops[len(c.loops)-1]
+	for _, jump := range loop.continues {
+		c.patchJump(jump)
+	}
+
+	// A literal true condition loops without checking it and a literal false one runs the body just once
+	literal, truthy := c.condition()
+
+	if !literal {
+		exitJump := c.emitJump(JumpIfFalsy)
+		c.emitOpCode(Pop) // Condition
+		c.emitLoop(bodyStart)
+
+		c.patchJump(exitJump)
+		c.emitOpCode(Pop) // Condition
+	} else if truthy {
+		c.emitLoop(bodyStart)
+	}
+
+	// A body running once is still a loop and its last statement is not the result of the script
+	c.lastExpressionPop = -1
+
+	for _, jump := range loop.breaks {
+		c.patchJump(jump)
+	}
+
+	c.loops = c.loops[:len(c.loops)-1]
+
+	c.expectNewlineOrSemicolon()
+}
+
+// Compiles a loop preceded by a label, which break and continue can refer to.
+func (c *Compiler) labeledStatement() {
+	c.advance()
+	label := c.p.Previous()
+
+	c.consume(parser.Colon, "Expect ':' after label.")
+	c.consumeNewlines()
+
+	for _, loop := range c.loops {
+		if loop.label == label.Lexeme() {
+			c.errorAt(label, "Already a loop with this label.")
+		}
+	}
+
+	if c.match(parser.While) {
+		c.whileStatement(label.Lexeme())
+	} else if c.match(parser.For) {
+		c.forStatement(label.Lexeme())
+	} else if c.match(parser.Do) {
+		c.doWhileStatement(label.Lexeme())
+	} else {
+		c.errorAtCurrent("Expect loop after label.")
+	}
+}
+
+func (c *Compiler) breakStatement() {
+	index := c.loopTarget("break")
+
+	if index != -1 {
+		c.exitLoopScopes(c.loops[index])
+
+		jump := c.emitJump(Jump)
+		c.loops[index].breaks = append(c.loops[index].breaks, jump)
+	}
+
+	c.expectNewlineOrSemicolon()
+}
+
+func (c *Compiler) continueStatement() {
+	index := c.loopTarget("continue")
+
+	if index != -1 {
+		c.exitLoopScopes(c.loops[index])
+
+		if c.loops[index].start == -1 {
+			jump := c.emitJump(Jump)
+			c.loops[index].continues = append(c.loops[index].continues, jump)
+		} else {
+			c.emitLoop(c.loops[index].start)
+		}
+	}
+
+	c.expectNewlineOrSemicolon()
+}
+
+// Parses an optional label after break or continue and returns index of the loop it refers to, or -1 on error.
+func (c *Compiler) loopTarget(keyword string) int {
+	if len(c.loops) == 0 {
+		c.error(fmt.Sprintf("Cannot use '%s' outside of a loop.", keyword))
+		return -1
+	}
+
+	if !c.match(parser.Identifier) {
+		return len(c.loops) - 1
+	}
+
+	for i := len(c.loops) - 1; i >= 0; i-- {
+		if c.loops[i].label == c.p.Previous().Lexeme() {
+			return i
+		}
+	}
+
+	c.error("Undefined loop label.")
+
+	return -1
+}
+
+// Emits popping of the locals declared inside the loop, which stay declared for the rest of the code.
+func (c *Compiler) exitLoopScopes(loop LoopContext) {
+	first := len(c.locals)
+	for first > 0 && (c.locals[first-1].depth > loop.scopeDepth || c.locals[first-1].depth == -1) {
+		first--
+	}
+
+	c.closeUpvalues(first)
+
+	for i := len(c.locals) - 1; i >= first; i-- {
+		// Local being initialized has no value on the stack yet
+		if c.locals[i].depth != -1 {
+			c.emitOpCode(Pop)
+		}
+	}
+}
+
+// Locals of the blocks the return is nested in are not popped, returning discards the whole call frame.
+//
+// Outside of functions the return ends the script with the value, no matter how deeply it is nested in blocks, loops
+// or block expressions.
+func (c *Compiler) returnStatement() {
+	if c.match(parser.Newline) || c.check(parser.RightBrace) || c.check(parser.Eof) {
+		c.emitReturn()
+	} else {
+		needsNewline := !c.check(parser.Fn)
+
+		c.expression()
+		c.emitTypeCheck(c.returnType)
+		c.emitOpCode(Return)
+
+		if needsNewline {
+			c.expectNewlineOrSemicolon()
+		}
+	}
+}
+
+// Compiles '_ = expression', which evaluates the expression only for its side effects. Unlike an expression
+// statement its value is never the result of the script, even if it is the last statement.
+func (c *Compiler) discardStatement() {
+	c.advance()
+	c.consume(parser.Equal, "Expect '=' after '_'.")
+
+	c.expression()
+	c.emitOpCode(Pop)
+
+	c.expectNewlineOrSemicolon()
+}
+
+func (c *Compiler) expressionStatement() {
+	c.expression()
+
+	c.lastExpressionPop = len(c.chunk.code)
+	c.emitOpCode(Pop)
+
+	c.expectNewlineOrSemicolon()
+}
+
+func (c *Compiler) expression() {
+	c.parsePrecedence(PrecedenceAssignment)
+}
+
+func (c *Compiler) parsePrecedence(precedence Precedence) {
+	if c.nestingDepth == c.maxNestingDepth() {
+		c.errorAtCurrent("Expression nesting too deep.")
+		return
+	}
+
+	c.nestingDepth++
+	defer func() { c.nestingDepth-- }()
+
+	c.advance()
+
+	prefixRule := parseRules[c.p.Previous().Type()].prefix
+	if prefixRule == nil {
+		c.error("Expect expression.")
+
+		return
+	}
+
+	start := len(c.chunk.code)
+
+	canAssign := precedence <= PrecedenceAssignment
+	prefixRule(c, canAssign)
+
+	for precedence <= parseRules[c.p.Current().Type()].precedence {
+		c.advance()
+
+		c.leftOperand = start
+
+		infixRule := parseRules[c.p.Previous().Type()].infix
+		infixRule(c, canAssign)
+	}
+
+	if canAssign && c.match(parser.Equal) {
+		c.error("Invalid assignment target.")
+
+		// Parse the expression so compiler prints proper error messages.
+		c.expression()
+	}
+}
+
+func (c *Compiler) maxNestingDepth() int {
+	if c.options.MaxNestingDepth == 0 {
+		return DefaultMaxNestingDepth
+	}
+
+	return c.options.MaxNestingDepth
+}
+
+func (c *Compiler) unary(canAssign bool) {
+	operatorType := c.p.Previous().Type()
+
+	c.parsePrecedence(PrecedenceUnary)
+
+	switch operatorType {
+	case parser.Bang:
+		c.emitOpCode(Not)
+	case parser.Minus:
+		c.emitOpCode(Negate)
+	default:
+		panic("unreachable")
+	}
+}
+
+func (c *Compiler) binary(canAssign bool) {
+	operator := c.p.Previous()
+	operatorType := operator.Type()
+
+	rule := parseRules[operatorType]
+
+	leftStart := c.leftOperand
+	rightStart := len(c.chunk.code)
+
+	left := c.lastConstant
+	if left+3 != len(c.chunk.code) {
+		left = -1
+	}
+
+	c.pushTemporary() // Left operand
+	c.parsePrecedence(rule.precedence + 1)
+	c.popTemporary()
+
+	if operatorType == parser.Plus && c.foldConcatenation(left) {
+		return
+	}
+
+	if rule.precedence == PrecedenceComparison || rule.precedence == PrecedenceEquality {
+		if c.sameOperands(leftStart, rightStart) {
+			c.warningAt(operator, fmt.Sprintf("Both sides of '%s' are the same expression.", operator.Lexeme()))
+		}
+	}
+
+	switch operatorType {
+	case parser.EqualEqual:
+		c.emitOpCode(Equal)
+	case parser.Greater:
+		c.emitOpCode(Greater)
+	case parser.GreaterEqual:
+		c.emitOpCode(GreaterEqual)
+	case parser.Less:
+		c.emitOpCode(Less)
+	case parser.LessEqual:
+		c.emitOpCode(LessEqual)
+	case parser.BangEqual:
+		c.emitOpCode(NotEqual)
+
+	case parser.Plus:
+		c.emitOpCode(Add)
+	case parser.Minus:
+		c.emitOpCode(Subtract)
+	case parser.Slash:
+		c.emitOpCode(Divide)
+	case parser.Star:
+		c.emitOpCode(Multiply)
+	case parser.Caret:
+		c.emitOpCode(Exponentiate)
+	case parser.Percent:
+		c.emitOpCode(Reminder)
+	}
+}
+
+func (c *Compiler) call(canAssign bool) {
+	argCount := c.argumentList()
+
+	c.emitOpCode(Call)
+	c.emitByte(argCount)
+}
+
+func (c *Compiler) argumentList() uint8 {
+	c.pushTemporary() // Callee
+
+	argCount := 0
+
+	// Arguments can be split across lines and followed by a trailing comma
+	c.consumeNewlines()
+
+	for !c.check(parser.RightParen) {
+		c.expression()
+		c.pushTemporary()
+
+		if argCount == 255 {
+			c.error("Cannot have more than 255 arguments.")
+		}
+
+		argCount++
+
+		c.consumeNewlines()
+		if !c.match(parser.Comma) {
+			break
+		}
+		c.consumeNewlines()
+	}
+
+	c.consume(parser.RightParen, "Expect ')' after arguments.")
+
+	for i := 0; i <= argCount; i++ {
+		c.popTemporary()
+	}
+
+	return uint8(argCount)
+}
+
+// Compiles access to a field of a record. Only fields the record was created with can be assigned.
+func (c *Compiler) dot(canAssign bool) {
+	c.consume(parser.Identifier, "Expect field name after '.'.")
+	name := c.identifierConstant(c.p.Previous())
+
+	if canAssign && c.match(parser.Equal) {
+		c.pushTemporary() // Record
+		c.expression()
+		c.popTemporary()
+
+		c.emitOpCode(SetProperty)
+		c.emitShort(name)
+	} else {
+		c.emitOpCode(GetProperty)
+		c.emitShort(name)
+	}
+}
+
+func (c *Compiler) number(canAssign bool) {
+	number, ok := parseNumber(c.p.Previous().Lexeme())
+	if !ok {
+		c.error("Invalid number literal.")
+		return
+	}
+
+	c.emitConstant(value.NumberVal(number))
+}
+
+// Parses the lexeme of a number token. Reports false for literals out of the range of numbers.
+func parseNumber(lexeme string) (float64, bool) {
+	number, err := strconv.ParseFloat(lexeme, 64)
+	if err != nil {
+		// Hexadecimal integers without an exponent are not accepted by ParseFloat
+		if integer, intErr := strconv.ParseUint(lexeme, 0, 64); intErr == nil {
+			return float64(integer), true
+		}
+
+		return 0, false
+	}
+
+	return number, true
+}
+
+// Replaces concatenation of two constant strings, the left one emitted at the given offset, with the concatenated
+// constant. Returns whether the operands were constant strings.
+func (c *Compiler) foldConcatenation(left int) bool {
+	if left == -1 {
+		return false
+	}
+
+	leftValue, ok := asConstantString(c.chunk.constants[c.chunk.operand(left)])
+	if !ok {
+		return false
+	}
+
+	right := left + 3
+
+	// The right operand is either the next constant or the left one duplicated
+	var rightValue value.String
+	if len(c.chunk.code) == right+1 && OpCode(c.chunk.code[right]) == Dup {
+		rightValue = leftValue
+	} else if c.lastConstant == right && len(c.chunk.code) == right+3 {
+		if rightValue, ok = asConstantString(c.chunk.constants[c.chunk.operand(right)]); !ok {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	// Constants no other code uses are dropped from the pool
+	if OpCode(c.chunk.code[right]) == Constant {
+		c.releaseConstant(c.chunk.operand(right))
+	}
+	c.releaseConstant(c.chunk.operand(left))
+	c.chunk.truncate(left)
+	c.lastConstant = -1
+
+	c.emitConstant(value.StringVal(string(leftValue + rightValue)))
+
+	return true
+}
+
+// Reports whether the code of the left operand, from the first offset up to the second one, and the code of the
+// right operand following it are the same, referring to equal constants. Operands calling functions are never the
+// same, each call can return something else.
+func (c *Compiler) sameOperands(leftStart int, rightStart int) bool {
+	left := c.chunk.code[leftStart:rightStart]
+	right := c.chunk.code[rightStart:]
+
+	// A constant repeated right after itself is only duplicated
+	if len(right) == 1 && OpCode(right[0]) == Dup {
+		return len(left) == 3 && OpCode(left[0]) == Constant
+	}
+
+	if len(left) != len(right) {
+		return false
+	}
+
+	for offset := 0; offset < len(left); offset += 1 + OpCode(left[offset]).OperandWidth() {
+		op := OpCode(left[offset])
+		if OpCode(right[offset]) != op || op == Call {
+			return false
+		}
+
+		if op.hasConstantOperand() {
+			leftConstant := c.chunk.constants[c.chunk.operand(leftStart+offset)]
+			rightConstant := c.chunk.constants[c.chunk.operand(rightStart+offset)]
+
+			if !value.Equals(leftConstant, rightConstant) {
+				return false
+			}
+
+			continue
+		}
+
+		for i := 1; i <= op.OperandWidth(); i++ {
+			if left[offset+i] != right[offset+i] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func asConstantString(constant value.Value) (value.String, bool) {
+	if !value.IsObject(constant) {
+		return "", false
+	}
+
+	str, ok := value.AsObject(constant).(value.String)
+
+	return str, ok
+}
+
+func (c *Compiler) string(canAssign bool) {
+	lexeme := c.p.Previous().Lexeme()
+	string := lexeme[1 : len(lexeme)-1]
+
+	// Adjacent string literals are a single string
+	for c.match(parser.String) {
+		lexeme = c.p.Previous().Lexeme()
+		string += lexeme[1 : len(lexeme)-1]
+	}
+
+	c.emitConstant(value.StringVal(string))
+}
+
+func (c *Compiler) literal(canAssign bool) {
+	switch c.p.Previous().Type() {
+	case parser.False:
+		c.emitOpCode(False)
+	case parser.True:
+		c.emitOpCode(True)
+	case parser.Nil:
+		c.emitOpCode(Nil)
+	default:
+		panic("unreachable")
+	}
+}
+
+func (c *Compiler) grouping(canAssign bool) {
 	c.expression()
-	exitJump := c.emitJump(JumpIfFalsy)
-	c.emitOpCode(Pop) // Condition
-
-	// One-line notation
-	if c.match(parser.Colon) {
-		c.statement()
-	} else {
-		c.consume(parser.LeftBrace, "Expect '{' after while condition.")
+	c.consumeNewlines()
+	c.consume(parser.RightParen, "Expect ')' after expression")
+}
 
-		c.beginScope()
-		c.block()
-		c.endScope()
+// Compiles a block in expression position which leaves the value of its last expression statement on the stack.
+// If the block does not end with an expression statement it evaluates to nil.
+func (c *Compiler) blockExpression(canAssign bool) {
+	if c.isRecordLiteral() {
+		c.record()
+		return
 	}
 
-	c.emitLoop(loopStart)
+	c.beginScope()
 
-	c.patchJump(exitJump)
-	c.emitOpCode(Pop) // Condition
-}
+	start := len(c.chunk.code)
 
-func (c *Compiler) returnStatement() {
-	if c.match(parser.Newline) {
-		c.emitReturn()
-	} else {
-		needsNewline := !c.check(parser.Fn)
+	var reachable reachability
 
-		c.expression()
-		c.emitOpCode(Return)
+	for !c.check(parser.RightBrace) && !c.check(parser.Eof) {
+		c.checkReachable(&reachable)
 
-		if needsNewline {
-			c.expectNewlineOrSemicolon()
+		// Nested ifs and blocks are compiled as expressions so their value can become the value of this block.
+		if c.check(parser.If) || c.check(parser.LeftBrace) {
+			c.expressionStatement()
+
+			if c.panicMode {
+				c.synchronize()
+			}
+		} else {
+			c.declaration()
 		}
 	}
-}
 
-func (c *Compiler) expressionStatement() {
-	c.expression()
+	c.consume(parser.RightBrace, "Expect '}' after block.")
 
-	c.emitOpCode(Pop)
+	if c.lastExpressionPop >= start && c.chunk.lastInstruction() == c.lastExpressionPop {
+		c.chunk.truncate(c.lastExpressionPop)
+		c.lastExpressionPop = -1
+	} else {
+		c.emitOpCode(Nil)
+	}
 
-	c.expectNewlineOrSemicolon()
+	c.endScopeKeepingResult()
 }
 
-func (c *Compiler) expression() {
-	c.parsePrecedence(PrecedenceAssignment)
-}
+// Reports whether the brace just consumed starts a record literal, whose fields are names followed by a colon,
+// instead of a block. A block can start with a labeled loop too, but a loop has to follow its label.
+func (c *Compiler) isRecordLiteral() bool {
+	if c.check(parser.DotDotDot) {
+		return true
+	}
 
-func (c *Compiler) parsePrecedence(precedence Precedence) {
-	c.advance()
+	if !c.check(parser.Identifier) {
+		return false
+	}
 
-	prefixRule := parseRules[c.p.Previous().Type()].prefix
-	if prefixRule == nil {
-		c.error("Expect expression.")
+	tokens := c.p.PeekTokens(2)
+	if tokens[0].Type() != parser.Colon {
+		return false
+	}
 
-		return
+	switch tokens[1].Type() {
+	case parser.While, parser.For, parser.Do, parser.Newline:
+		return false
 	}
 
-	canAssign := precedence <= PrecedenceAssignment
-	prefixRule(c, canAssign)
+	return true
+}
 
-	for precedence <= parseRules[c.p.Current().Type()].precedence {
-		c.advance()
+// Compiles the fields of a record literal. The name and the value of every field are pushed in order and the
+// Record instruction collects them into the record. Records spread into the literal are merged into the record
+// built from the fields before them, so fields written later override earlier ones.
+func (c *Compiler) record() {
+	fieldCount := 0
+	names := make(map[string]bool)
+	// Whether the record built from the fields before a spread is on the stack
+	merging := false
+
+	for !c.check(parser.RightBrace) {
+		if c.match(parser.DotDotDot) {
+			if fieldCount > 0 || !merging {
+				c.recordFields(fieldCount, merging)
+			}
 
-		infixRule := parseRules[c.p.Previous().Type()].infix
-		infixRule(c, canAssign)
-	}
+			c.pushTemporary() // Record built so far
+			c.expression()
+			c.emitOpCode(MergeRecords)
 
-	if canAssign && c.match(parser.Equal) {
-		c.error("Invalid assignment target.")
+			fieldCount = 0
+			merging = true
 
-		// Parse the expression so compiler prints proper error messages.
-		c.expression()
-	}
-}
+			c.consumeNewlines()
+			if !c.match(parser.Comma) {
+				break
+			}
+			c.consumeNewlines()
 
-func (c *Compiler) unary(canAssign bool) {
-	operatorType := c.p.Previous().Type()
+			continue
+		}
 
-	c.parsePrecedence(PrecedenceUnary)
+		c.consume(parser.Identifier, "Expect field name.")
 
-	switch operatorType {
-	case parser.Bang:
-		c.emitOpCode(Not)
-	case parser.Minus:
-		c.emitOpCode(Negate)
-	default:
-		panic("unreachable")
-	}
-}
+		name := c.p.Previous().Lexeme()
+		if names[name] {
+			c.error("Already a field with this name in this record.")
+		}
 
-func (c *Compiler) binary(canAssign bool) {
-	operatorType := c.p.Previous().Type()
+		names[name] = true
 
-	rule := parseRules[operatorType]
+		c.emitConstant(value.StringVal(name))
+		c.pushTemporary()
 
-	c.parsePrecedence(rule.precedence + 1)
+		c.consume(parser.Colon, "Expect ':' after field name.")
 
-	switch operatorType {
-	case parser.EqualEqual:
-		c.emitOpCode(Equal)
-	case parser.Greater:
-		c.emitOpCode(Greater)
-	case parser.GreaterEqual:
-		c.emitOpCode(GreaterEqual)
-	case parser.Less:
-		c.emitOpCode(Less)
-	case parser.LessEqual:
-		c.emitOpCode(LessEqual)
-	case parser.BangEqual:
-		c.emitOpCode(NotEqual)
+		c.expression()
+		c.pushTemporary()
 
-	case parser.Plus:
-		c.emitOpCode(Add)
-	case parser.Minus:
-		c.emitOpCode(Subtract)
-	case parser.Slash:
-		c.emitOpCode(Divide)
-	case parser.Star:
-		c.emitOpCode(Multiply)
-	case parser.Caret:
-		c.emitOpCode(Exponentiate)
-	case parser.Percent:
-		c.emitOpCode(Reminder)
+		if fieldCount == 255 {
+			c.error("Cannot have more than 255 fields.")
+		}
+
+		fieldCount++
+
+		c.consumeNewlines()
+		if !c.match(parser.Comma) {
+			break
+		}
+		c.consumeNewlines()
+	}
+
+	c.consume(parser.RightBrace, "Expect '}' after record fields.")
+
+	if fieldCount > 0 || !merging {
+		c.recordFields(fieldCount, merging)
+	} else {
+		c.popTemporary() // Record built so far
 	}
 }
 
-func (c *Compiler) number(canAssign bool) {
-	lexeme := c.p.Previous().Lexeme()
-	number, err := strconv.ParseFloat(lexeme, 64)
-	if err != nil {
-		panic(err)
+// Collects the fields pushed since the last spread into a record, which is merged into the record built so far if
+// there is one.
+func (c *Compiler) recordFields(fieldCount int, merging bool) {
+	for i := 0; i < fieldCount*2; i++ {
+		c.popTemporary()
 	}
 
-	c.emitConstant(value.NumberVal(number))
+	c.emitOpCode(Record)
+	c.emitByte(uint8(fieldCount))
+
+	if merging {
+		c.popTemporary() // Record built so far
+		c.emitOpCode(MergeRecords)
+	}
 }
 
-func (c *Compiler) string(canAssign bool) {
-	lexeme := c.p.Previous().Lexeme()
-	string := lexeme[1 : len(lexeme)-1]
+func (c *Compiler) ifExpression(canAssign bool) {
+	c.expression()
+	ifJump := c.emitJump(JumpIfFalsy)
+	c.emitOpCode(Pop) // Condition
 
-	c.emitConstant(value.StringVal(string))
-}
+	c.ifExpressionBranch()
 
-func (c *Compiler) literal(canAssign bool) {
-	switch c.p.Previous().Type() {
-	case parser.False:
-		c.emitOpCode(False)
-	case parser.True:
-		c.emitOpCode(True)
-	case parser.Nil:
+	elseJump := c.emitJump(Jump)
+	c.patchJump(ifJump)
+	c.emitOpCode(Pop) // Condition
+
+	if c.match(parser.Else) {
+		if c.match(parser.If) {
+			c.ifExpression(canAssign)
+		} else {
+			c.ifExpressionBranch()
+		}
+	} else {
 		c.emitOpCode(Nil)
-	default:
-		panic("unreachable")
 	}
+
+	c.patchJump(elseJump)
 }
 
-func (c *Compiler) grouping(canAssign bool) {
-	c.expression()
-	c.consume(parser.RightParen, "Expect ')' after expression")
+func (c *Compiler) ifExpressionBranch() {
+	// One-line notation
+	if c.match(parser.Colon) {
+		c.expression()
+		return
+	}
+
+	c.consume(parser.LeftBrace, "Expect '{' before if branch.")
+	c.blockExpression(false)
 }
 
 func (c *Compiler) resolveLocal(name parser.Token) (uint16, bool) {
@@ -417,13 +1757,54 @@ func (c *Compiler) resolveLocal(name parser.Token) (uint16, bool) {
 				c.error("Cannot read local variable in its own initializer.")
 			}
 
-			return uint16(i), true
+			return c.localSlot(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// Resolves the name as a local variable of one of the enclosing functions, captured through the chain of upvalues.
+func (c *Compiler) resolveUpvalue(name parser.Token) (uint16, bool) {
+	if c.enclosing == nil {
+		return 0, false
+	}
+
+	for i := len(c.enclosing.locals) - 1; i >= 0; i-- {
+		if c.enclosing.locals[i].name.Lexeme() == name.Lexeme() {
+			c.enclosing.locals[i].isUpvalue = true
+
+			return c.addUpvalue(c.enclosing.localSlot(i), true), true
 		}
 	}
 
+	if index, ok := c.enclosing.resolveUpvalue(name); ok {
+		return c.addUpvalue(index, false), true
+	}
+
 	return 0, false
 }
 
+func (c *Compiler) addUpvalue(index uint16, isLocal bool) uint16 {
+	for i, upvalue := range c.upvalues {
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return uint16(i)
+		}
+	}
+
+	if len(c.upvalues) == MaxLocals {
+		c.error("Too many closure variables in function.")
+		return 0
+	}
+
+	c.upvalues = append(c.upvalues, Upvalue{
+		index:   index,
+		isLocal: isLocal,
+	})
+
+	return uint16(len(c.upvalues) - 1)
+}
+
 func (c *Compiler) namedVariable(name parser.Token, canAssign bool) {
 	var getOp OpCode
 	var setOp OpCode
@@ -433,14 +1814,22 @@ func (c *Compiler) namedVariable(name parser.Token, canAssign bool) {
 	if ok {
 		getOp = GetLocal
 		setOp = SetLocal
+	} else if arg, ok = c.resolveUpvalue(name); ok {
+		getOp = GetUpvalue
+		setOp = SetUpvalue
 	} else {
 		arg = c.identifierConstant(name)
 		getOp = GetGlobal
 		setOp = SetGlobal
+
+		if c.analysis != nil {
+			c.analysis.references = append(c.analysis.references, name)
+		}
 	}
 
 	if canAssign && c.match(parser.Equal) {
 		c.expression()
+		c.emitTypeCheck(c.variableType(name))
 		c.emitOpCode(setOp)
 		c.emitShort(arg)
 	} else {
@@ -450,7 +1839,58 @@ func (c *Compiler) namedVariable(name parser.Token, canAssign bool) {
 }
 
 func (c *Compiler) variable(canAssign bool) {
-	c.namedVariable(c.p.Previous(), canAssign)
+	name := c.p.Previous()
+
+	if members, ok := c.enums[name.Lexeme()]; ok && !c.isLocal(name) {
+		c.enumMember(name, members, canAssign)
+		return
+	}
+
+	if constant, ok := builtinConstants[name.Lexeme()]; ok && !c.isLocal(name) {
+		c.builtinConstant(constant, canAssign)
+		return
+	}
+
+	c.namedVariable(name, canAssign)
+}
+
+// Reports whether the name refers to a local variable of this function or of any enclosing one.
+func (c *Compiler) isLocal(name parser.Token) bool {
+	for compiler := c; compiler != nil; compiler = compiler.enclosing {
+		for i := len(compiler.locals) - 1; i >= 0; i-- {
+			if compiler.locals[i].name.Lexeme() == name.Lexeme() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Built-in constants are not globals, their value is compiled right into the chunk.
+func (c *Compiler) builtinConstant(constant float64, canAssign bool) {
+	if canAssign && c.match(parser.Equal) {
+		c.error("Cannot assign to built-in constant.")
+	}
+
+	c.emitConstant(value.NumberVal(constant))
+}
+
+func (c *Compiler) enumMember(enum parser.Token, members map[string]bool, canAssign bool) {
+	c.consume(parser.Dot, "Expect '.' after enum name.")
+	c.consume(parser.Identifier, "Expect enum member name after '.'.")
+
+	member := c.p.Previous().Lexeme()
+	if !members[member] {
+		c.error("Undefined enum member.")
+	}
+
+	if canAssign && c.match(parser.Equal) {
+		c.error("Cannot assign to enum member.")
+	}
+
+	c.emitOpCode(GetGlobal)
+	c.emitShort(c.makeConstant(value.StringVal(enum.Lexeme() + "." + member)))
 }
 
 func (c *Compiler) emitByte(byte uint8) {
@@ -481,9 +1921,14 @@ func (c *Compiler) patchJump(jump int) {
 
 	c.chunk.code[jump] = uint8((length >> 8) & 0xff)
 	c.chunk.code[jump+1] = uint8(length & 0xff)
+
+	// Code following the jump target can be reached with a different value on top of the stack
+	c.lastConstant = -1
 }
 
 func (c *Compiler) startLoop() int {
+	c.lastConstant = -1
+
 	return len(c.chunk.code)
 }
 
@@ -498,26 +1943,66 @@ func (c *Compiler) emitLoop(loopStart int) {
 	c.emitShort(uint16(offset))
 }
 
-func (c *Compiler) makeConstant(value value.Value) uint16 {
-	constant := c.chunk.pushConstant(value)
-	if constant > MaxConstants {
-		c.error("Too many constants in one chunk.")
+func (c *Compiler) makeConstant(val value.Value) uint16 {
+	if str, ok := asConstantString(val); ok && c.interner != nil {
+		val = value.ObjectVal(c.interner.Intern(str))
+	}
+
+	constant, ok := c.pool.add(val)
+	if !ok {
+		c.error("Too many constants in one program.")
 		return 0
 	}
 
+	c.chunk.constants = c.pool.values
+
 	return constant
 }
 
+// Gives back the constant used by an instruction which was removed.
+func (c *Compiler) releaseConstant(constant int) {
+	c.pool.release(uint16(constant))
+	c.chunk.constants = c.pool.values
+}
+
 func (c *Compiler) emitConstant(value value.Value) {
+	// The same constant pushed right after itself is still on top of the stack, so it is only duplicated
+	if c.isLastConstant(value) {
+		c.emitOpCode(Dup)
+		return
+	}
+
 	constant := c.makeConstant(value)
 
+	c.lastConstant = len(c.chunk.code)
+
 	c.emitOpCode(Constant)
 	c.emitShort(constant)
 }
 
+// Returns true if the last emitted instruction pushes the given constant.
+func (c *Compiler) isLastConstant(value value.Value) bool {
+	last := c.lastConstant
+	if last < 0 || last+3 != len(c.chunk.code) || c.chunk.code[last] != uint8(Constant) {
+		return false
+	}
+
+	constant := int(c.chunk.code[last+1])<<8 | int(c.chunk.code[last+2])
+
+	return c.chunk.constants[constant] == value
+}
+
+// Returns nil from the function. In strict mode nil is checked against the declared return type like any other value.
 func (c *Compiler) emitReturn() {
-	c.emitOpCode(Nil)
-	c.emitOpCode(Return)
+	if c.needsTypeCheck(c.returnType) {
+		c.emitOpCode(Nil)
+		c.emitTypeCheck(c.returnType)
+		c.emitOpCode(Return)
+
+		return
+	}
+
+	c.emitOpCode(ReturnNil)
 }
 
 func (c *Compiler) consumeNewlines() {
@@ -530,6 +2015,12 @@ func (c *Compiler) skipNewlines() {
 	switch c.p.Previous().Type() {
 	case parser.Newline, parser.LeftBrace, parser.RightBrace, parser.Semicolon, parser.Dot:
 		c.consumeNewlines()
+
+	// A line ending with a binary operator or an open paren or bracket continues on the next line
+	case parser.LeftParen, parser.LeftBracket,
+		parser.Plus, parser.Minus, parser.Star, parser.Slash, parser.Percent, parser.Caret,
+		parser.EqualEqual, parser.BangEqual, parser.Greater, parser.GreaterEqual, parser.Less, parser.LessEqual:
+		c.consumeNewlines()
 	}
 }
 
@@ -606,8 +2097,13 @@ func (c *Compiler) synchronize() {
 	c.panicMode = false
 
 	for c.p.Current().Type() != parser.Eof {
+		switch c.p.Previous().Type() {
+		case parser.Newline, parser.Semicolon:
+			return
+		}
+
 		switch c.p.Current().Type() {
-		case parser.Class, parser.Fn, parser.Var, parser.For, parser.If, parser.While:
+		case parser.Class, parser.Enum, parser.Fn, parser.Var, parser.For, parser.Do, parser.If, parser.While, parser.RightBrace:
 			return
 		default:
 			c.advance()
@@ -619,6 +2115,39 @@ func (c *Compiler) error(message string) {
 	c.errorAt(c.p.Previous(), message)
 }
 
+func (c *Compiler) warning(line int, message string) {
+	warning := fmt.Sprintf("[line %d] Warning: %s", line, message)
+
+	c.warnings = append(c.warnings, warning)
+
+	// Warnings are reported for whole lines
+	c.diagnostics = append(c.diagnostics, Diagnostic{
+		Severity:  SeverityWarning,
+		Message:   message,
+		Line:      line,
+		Column:    1,
+		EndLine:   line + 1,
+		EndColumn: 1,
+	})
+	_, _ = fmt.Fprintln(os.Stderr, warning)
+}
+
+func (c *Compiler) warningAt(token parser.Token, message string) {
+	warning := fmt.Sprintf("[line %d] Warning at '%s': %s", token.Line(), token.Lexeme(), message)
+
+	c.warnings = append(c.warnings, warning)
+	_, _ = fmt.Fprintln(os.Stderr, warning)
+
+	c.diagnostics = append(c.diagnostics, Diagnostic{
+		Severity:  SeverityWarning,
+		Message:   message,
+		Line:      token.Line(),
+		Column:    token.Column(),
+		EndLine:   token.EndLine(),
+		EndColumn: token.EndColumn(),
+	})
+}
+
 func (c *Compiler) errorAtCurrent(message string) {
 	c.errorAt(c.p.Current(), message)
 }
@@ -630,18 +2159,33 @@ func (c *Compiler) errorAt(token parser.Token, message string) {
 
 	c.panicMode = true
 
-	_, _ = fmt.Fprintf(os.Stderr, "[line %d] Error", token.Line())
+	var sb strings.Builder
+
+	_, _ = fmt.Fprintf(&sb, "[line %d] Error", token.Line())
 
 	switch token.Type() {
 	case parser.Eof:
-		_, _ = fmt.Fprintf(os.Stderr, " at end")
+		_, _ = fmt.Fprintf(&sb, " at end")
 	case parser.Newline:
-		_, _ = fmt.Fprintf(os.Stderr, " at newline")
+		_, _ = fmt.Fprintf(&sb, " at newline")
+	case parser.Error:
+		// The message of the error token already describes the problem
 	default:
-		_, _ = fmt.Fprintf(os.Stderr, " at '%s'", token.Lexeme())
+		_, _ = fmt.Fprintf(&sb, " at '%s'", token.Lexeme())
 	}
 
-	_, _ = fmt.Fprintf(os.Stderr, ": %s\n", message)
+	_, _ = fmt.Fprintf(&sb, ": %s", message)
+
+	c.errors = append(c.errors, sb.String())
+	c.diagnostics = append(c.diagnostics, Diagnostic{
+		Severity:  SeverityError,
+		Message:   message,
+		Line:      token.Line(),
+		Column:    token.Column(),
+		EndLine:   token.EndLine(),
+		EndColumn: token.EndColumn(),
+	})
+	_, _ = fmt.Fprintln(os.Stderr, sb.String())
 
 	c.hadError = true
 }
@@ -0,0 +1,443 @@
+package compiler
+
+import (
+	"github.com/adamjedlicka/go-blu/src/parser"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func compileErrors(source string) []string {
+	c := NewCompiler("test", parser.NewParser([]rune(source)))
+	c.Compile()
+
+	return c.Errors()
+}
+
+func assertErrors(t *testing.T, source string, expected ...string) {
+	t.Helper()
+
+	errors := compileErrors(source)
+
+	if len(errors) != len(expected) {
+		t.Fatalf("Expected errors %q for '%s', got %q", expected, source, errors)
+	}
+
+	for i := range expected {
+		if errors[i] != expected[i] {
+			t.Errorf("Expected errors %q for '%s', got %q", expected, source, errors)
+		}
+	}
+}
+
+func TestDuplicateLocalInSameScope(t *testing.T) {
+	assertErrors(t, "{\nvar a = 1\nvar a = 2\n}",
+		"[line 3] Error at 'a': Already a variable with this name in this scope.")
+}
+
+func TestShadowingLocalInInnerScope(t *testing.T) {
+	assertErrors(t, "{\nvar a = 1\n{\nvar a = 2\n}\n}")
+}
+
+func TestDuplicateGlobalIsAnError(t *testing.T) {
+	assertErrors(t, "var a = 1\nvar a = 2", "[line 2] Error at 'a': Already a global variable with this name.")
+	assertErrors(t, "fn f() {}\nvar f = 1", "[line 2] Error at 'f': Already a global variable with this name.")
+	assertErrors(t, "var a = 1\na = 2\n{\nvar a = 3\n}")
+}
+
+func TestDuplicateGlobalIsAllowedWithOption(t *testing.T) {
+	c := NewCompilerWithOptions("test", parser.NewParser([]rune("var a = 1\nvar a = 2")), CompilerOptions{
+		AllowGlobalRedeclaration: true,
+	})
+
+	if chunk := c.Compile(); chunk == nil {
+		t.Errorf("Expected no errors, got %q", c.Errors())
+	}
+}
+
+func TestEveryLexerErrorIsReported(t *testing.T) {
+	assertErrors(t, "var a = 1 $\nvar b = a + 2\nvar c = #b",
+		"[line 1] Error: Unexpected character.",
+		"[line 3] Error: Unexpected character.")
+}
+
+func TestEnumErrors(t *testing.T) {
+	assertErrors(t, "enum Color { Red, Green, Red }",
+		"[line 1] Error at 'Red': Already a member with this name in this enum.")
+	assertErrors(t, "enum Color { Red }\nColor.Red = 1",
+		"[line 2] Error at '=': Cannot assign to enum member.")
+	assertErrors(t, "enum Color { Red }\nColor.Blue",
+		"[line 2] Error at 'Blue': Undefined enum member.")
+	assertErrors(t, "enum Color { Red }\nenum Color { Blue }",
+		"[line 2] Error at 'Color': Already an enum with this name.")
+	assertErrors(t, "{\nenum Color { Red }\n}",
+		"[line 2] Error at 'enum': Enums can only be declared at the top level.")
+	assertErrors(t, "enum Big { A = 1e400 }",
+		"[line 1] Error at '1e400': Invalid number literal.")
+}
+
+func TestRequiredParameterAfterDefault(t *testing.T) {
+	assertErrors(t, "fn f(a = 1, b) {}",
+		"[line 1] Error at 'b': Parameter without a default value cannot follow one with a default value.")
+}
+
+func TestInvalidCommasInArguments(t *testing.T) {
+	assertErrors(t, "fn f(a, b) {}\nf(, 1)",
+		"[line 2] Error at ',': Expect expression.")
+	assertErrors(t, "fn f(a, b) {}\nf(1,, 2)",
+		"[line 2] Error at ',': Expect expression.")
+	assertErrors(t, "fn f(a,, b) {}",
+		"[line 1] Error at ',': Expect parameter name.")
+}
+
+func TestUnknownTypeAnnotation(t *testing.T) {
+	assertErrors(t, "var a: int = 1", "[line 1] Error at 'int': Unknown type.")
+	assertErrors(t, "fn f(a: num) {\n}", "[line 1] Error at 'num': Unknown type.")
+	assertErrors(t, "var a: = 1", "[line 1] Error at '=': Expect type name after ':'.")
+}
+
+func TestUnknownDirectiveIsWarning(t *testing.T) {
+	c := NewCompiler("test", parser.NewParser([]rune("//go-blue:fast\nvar a = 1")))
+
+	if c.Compile() == nil {
+		t.Fatalf("Expected to compile, got %q", c.Errors())
+	}
+
+	expected := "[line 1] Warning: Unknown directive 'fast'."
+	if warnings := c.Warnings(); len(warnings) != 1 || warnings[0] != expected {
+		t.Errorf("Expected warnings %q, got %q", []string{expected}, warnings)
+	}
+}
+
+func TestReturnWithoutValueIsOneInstruction(t *testing.T) {
+	tests := map[string][]uint8{
+		"var a = 1":    {uint8(Constant), 0, 1, uint8(DefineGlobal), 0, 0, uint8(ReturnNil)},
+		"var a = 1\na": {uint8(Constant), 0, 1, uint8(DefineGlobal), 0, 0, uint8(GetGlobal), 0, 0, uint8(Return)},
+		"return":       {uint8(ReturnNil)},
+	}
+
+	for source, expected := range tests {
+		chunk := compile(source)
+		if chunk == nil {
+			t.Fatalf("Failed to compile '%s'", source)
+		}
+
+		assertCode(t, chunk, expected)
+	}
+}
+
+func TestSuspiciousConditionsAreWarnings(t *testing.T) {
+	tests := map[string][]string{
+		"while true {\n  break\n}":          {"[line 1] Warning at 'true': Condition is always true."},
+		"if nil {}":                         {"[line 1] Warning at 'nil': Condition is always false."},
+		"if \"a\" + \"b\" {}":               {"[line 1] Warning at '\"a\"': Condition is always true."},
+		"var x = 1\nif x == x {}":           {"[line 2] Warning at '==': Both sides of '==' are the same expression."},
+		"var x = 1\nvar y = x + 1 < x+1":    {"[line 2] Warning at '<': Both sides of '<' are the same expression."},
+		"var y = 2 != 2":                    {"[line 1] Warning at '!=': Both sides of '!=' are the same expression."},
+		"var x = 1\nif x == 1 {}":           {},
+		"var x = 1\nvar y = 2\nif x < y {}": {},
+		"fn f() {}\nvar b = f() == f()":     {},
+		"var x = 1 + 1":                     {},
+		// Warnings in functions are reported like the ones of the script
+		"fn f(x) {\nwhile true {}\nreturn x == x\n}": {"[line 2] Warning at 'true': Condition is always true.", "[line 3] Warning at '==': Both sides of '==' are the same expression."},
+	}
+
+	for source, expected := range tests {
+		c := NewCompiler("test", parser.NewParser([]rune(source)))
+
+		if c.Compile() == nil {
+			t.Fatalf("Expected '%s' to compile, got %q", source, c.Errors())
+		}
+
+		if warnings := c.Warnings(); !reflect.DeepEqual(warnings, expected) {
+			t.Errorf("Expected %q for '%s', got %q", expected, source, warnings)
+		}
+	}
+}
+
+func TestLiteralConditionsEmitOnlyReachableCode(t *testing.T) {
+	tests := map[string][]uint8{
+		"var a = 1\nif true { a = 2 } else { a = 3 }": {
+			uint8(Constant), 0, 1, uint8(DefineGlobal), 0, 0,
+			uint8(Constant), 0, 2, uint8(SetGlobal), 0, 0, uint8(Pop),
+			uint8(ReturnNil),
+		},
+		"var a = 1\nif false { a = 2 } else { a = 3 }": {
+			uint8(Constant), 0, 1, uint8(DefineGlobal), 0, 0,
+			uint8(Constant), 0, 3, uint8(SetGlobal), 0, 0, uint8(Pop),
+			uint8(ReturnNil),
+		},
+		"var a = 1\nif false: a = 2": {
+			uint8(Constant), 0, 1, uint8(DefineGlobal), 0, 0,
+			uint8(ReturnNil),
+		},
+		"var a = 1\nwhile false { a = 2 }": {
+			uint8(Constant), 0, 1, uint8(DefineGlobal), 0, 0,
+			uint8(ReturnNil),
+		},
+		"while true { pass }": {
+			uint8(Loop), 0, 3,
+			uint8(ReturnNil),
+		},
+		"var a = 1\ndo { a = 2 } while false": {
+			uint8(Constant), 0, 1, uint8(DefineGlobal), 0, 0,
+			uint8(Constant), 0, 2, uint8(SetGlobal), 0, 0, uint8(Pop),
+			uint8(ReturnNil),
+		},
+		"do { pass } while true": {
+			uint8(Loop), 0, 3,
+			uint8(ReturnNil),
+		},
+	}
+
+	for source, expected := range tests {
+		chunk := compile(source)
+		if chunk == nil {
+			t.Fatalf("Failed to compile '%s'", source)
+		}
+
+		assertCode(t, chunk, expected)
+	}
+}
+
+func TestLiteralConditionsReportErrorsInSkippedCode(t *testing.T) {
+	assertErrors(t, "if true {\n} else {\nvar = 1\n}", "[line 3] Error at '=': Expect variable name.")
+	assertErrors(t, "while false {\nbreak outer\n}", "[line 2] Error at 'outer': Undefined loop label.")
+}
+
+func TestCapturedVariablesUseUpvalues(t *testing.T) {
+	chunk := compile("{\nvar a = 1\nfn inner() {\na = 2\nreturn a\n}\n}")
+	if chunk == nil {
+		t.Fatal("Failed to compile")
+	}
+
+	inner := value.AsObject(chunk.constants[2]).(*Function)
+
+	if upvalues := inner.Upvalues(); len(upvalues) != 1 || !upvalues[0].IsLocal() || upvalues[0].Index() != 0 {
+		t.Errorf("Expected local 0 to be captured, got %v", upvalues)
+	}
+
+	listing := inner.chunk.Disassemble()
+	if !strings.Contains(listing, "SetUpvalue 0\n") || !strings.Contains(listing, "GetUpvalue 0\n") {
+		t.Errorf("Expected upvalue access, got\n%s", listing)
+	}
+
+	if !strings.Contains(chunk.Disassemble(), "CloseUpvalues 0\n") {
+		t.Errorf("Expected captured local to be closed, got\n%s", chunk.Disassemble())
+	}
+}
+
+func TestFunctionsShareConstantPool(t *testing.T) {
+	chunk := compile("fn f() {\nreturn \"hello\"\n}\nfn g() {\nreturn \"hello\"\n}\nvar x = \"hello\"")
+	if chunk == nil {
+		t.Fatal("Failed to compile")
+	}
+
+	hello := 0
+	for _, constant := range chunk.constants {
+		if constant == value.StringVal("hello") {
+			hello++
+		}
+	}
+
+	if hello != 1 {
+		t.Errorf("Expected one \"hello\" constant, got %v", chunk.constants)
+	}
+
+	for _, name := range []string{"f", "g"} {
+		for _, constant := range chunk.constants {
+			if function, ok := value.AsObject(constant).(*Function); ok && function.Name() == name && !sharesConstants(function.chunk, chunk) {
+				t.Errorf("Expected '%s' to share constants %v, got %v", name, chunk.constants, function.chunk.constants)
+			}
+		}
+	}
+}
+
+func TestMalformedNumberLiterals(t *testing.T) {
+	assertErrors(t, "var a = 1e", "[line 1] Error: Malformed exponent.")
+	assertErrors(t, "var a = 1e400", "[line 1] Error at '1e400': Invalid number literal.")
+	assertErrors(t, "enum E { A = 0x1p2000 }", "[line 1] Error at '0x1p2000': Invalid number literal.")
+	assertErrors(t, "enum E { A = 0x10000000000000000 }",
+		"[line 1] Error at '0x10000000000000000': Invalid number literal.")
+}
+
+func TestBreakAndContinueErrors(t *testing.T) {
+	assertErrors(t, "break", "[line 1] Error at 'break': Cannot use 'break' outside of a loop.")
+	assertErrors(t, "fn f() {\ncontinue\n}", "[line 2] Error at 'continue': Cannot use 'continue' outside of a loop.")
+	assertErrors(t, "while true {\nbreak outer\n}", "[line 2] Error at 'outer': Undefined loop label.")
+	assertErrors(t, "outer: while true {\nfn f() {\nbreak outer\n}\n}", "[line 3] Error at 'break': Cannot use 'break' outside of a loop.")
+	assertErrors(t, "a: while true {\na: while true {\n}\n}", "[line 2] Error at 'a': Already a loop with this label.")
+	assertErrors(t, "a: var b = 1", "[line 1] Error at 'var': Expect loop after label.")
+	assertErrors(t, "for var i = 0; i < 1 {\n}", "[line 1] Error at '{': Expect ';' after loop condition.")
+	assertErrors(t, "do {\n} until true", "[line 2] Error at 'until': Expect 'while' after do loop body.")
+}
+
+func TestCompilingFromReader(t *testing.T) {
+	source := "//go-blue:strict\nvar a: number = 1\nfn f(b) {\nreturn a + b\n}\nwhile a < 10 { a = f(a) }\nreturn \"done\""
+
+	c := NewCompiler("test", parser.NewParser([]rune(source)))
+	expected := c.Compile()
+
+	c = NewCompilerReader("test", strings.NewReader(source))
+	actual := c.Compile()
+
+	if expected == nil || actual == nil {
+		t.Fatalf("Failed to compile '%s'", source)
+	}
+
+	if expected.Disassemble() != actual.Disassemble() {
+		t.Errorf("Expected\n%s\ngot\n%s", expected.Disassemble(), actual.Disassemble())
+	}
+}
+
+func TestConstantStringConcatenationIsFolded(t *testing.T) {
+	tests := map[string]string{
+		`return "a" + "b"`:          "ab",
+		`return "a" "b" "c"`:        "abc",
+		`return "a" + "a" + "b"`:    "aab",
+		`return "a" + ("b" + "c")`:  "abc",
+		`return "a" "b" + "c" "d"`:  "abcd",
+		`return "a" + { "b" } + ""`: "ab",
+	}
+
+	for source, expected := range tests {
+		chunk := compile(source)
+		if chunk == nil {
+			t.Fatalf("Failed to compile '%s'", source)
+		}
+
+		assertCode(t, chunk, []uint8{uint8(Constant), 0, 0, uint8(Return)})
+
+		if len(chunk.constants) != 1 || chunk.constants[0] != value.StringVal(expected) {
+			t.Errorf("Expected constants [%s] for '%s', got %v", expected, source, chunk.constants)
+		}
+	}
+
+	chunk := compile(`return "ab" == "a" + "b"`)
+	if stats := chunk.Stats(); stats.OpCodes[Add] != 0 || stats.Constants != 1 {
+		t.Errorf("Expected no Add and 1 constant, got\n%s", chunk.Disassemble())
+	}
+}
+
+func TestNonConstantConcatenationIsNotFolded(t *testing.T) {
+	sources := []string{
+		"var a = \"a\"\nreturn a + \"b\"",
+		"var a = \"a\"\nreturn \"b\" + a",
+		"return \"a\" + 1",
+		"var a = true\nreturn (if a: \"a\" else: \"b\") + \"c\"",
+	}
+
+	for _, source := range sources {
+		chunk := compile(source)
+		if chunk == nil {
+			t.Fatalf("Failed to compile '%s'", source)
+		}
+
+		if stats := chunk.Stats(); stats.OpCodes[Add] != 1 {
+			t.Errorf("Expected Add for '%s', got\n%s", source, chunk.Disassemble())
+		}
+	}
+}
+
+func TestBuiltinConstantsAreCompiledIntoTheChunk(t *testing.T) {
+	tests := map[string]float64{
+		"return PI":  math.Pi,
+		"return Inf": math.Inf(1),
+	}
+
+	for source, expected := range tests {
+		chunk := compile(source)
+
+		assertCode(t, chunk, []uint8{uint8(Constant), 0, 0, uint8(Return)})
+
+		if len(chunk.constants) != 1 || chunk.constants[0] != value.NumberVal(expected) {
+			t.Errorf("Expected constants [%v] for '%s', got %v", expected, source, chunk.constants)
+		}
+	}
+}
+
+func TestBuiltinConstantsCannotBeRedefined(t *testing.T) {
+	assertErrors(t, "PI = 3", "[line 1] Error at '=': Cannot assign to built-in constant.")
+	assertErrors(t, "var PI = 3", "[line 1] Error at 'PI': Cannot redefine built-in constant.")
+	assertErrors(t, "fn Inf() {}", "[line 1] Error at 'Inf': Cannot redefine built-in constant.")
+	assertErrors(t, "{\nvar PI = 3\nPI = 4\n}")
+}
+
+func TestRecordErrors(t *testing.T) {
+	assertErrors(t, "var r = { a: 1, a: 2 }", "[line 1] Error at 'a': Already a field with this name in this record.")
+	assertErrors(t, "var r = { a: 1, 2 }", "[line 1] Error at '2': Expect field name.")
+	assertErrors(t, "var r = { a: 1 }\nreturn r.1", "[line 2] Error at '1': Expect field name after '.'.")
+}
+
+func TestDiagnosticsCoverTheOffendingToken(t *testing.T) {
+	tests := map[string]Diagnostic{
+		"var s = \"abc":      {SeverityError, "Unterminated string.", 1, 9, 1, 13},
+		"var s = \"ab\ncd":   {SeverityError, "Unterminated string.", 1, 9, 2, 3},
+		"var 12 = 2":         {SeverityError, "Expect variable name.", 1, 5, 1, 7},
+		"var a = 1\nvar b =": {SeverityError, "Expect expression.", 2, 8, 2, 8},
+		"//go-blue:fast\n1":  {SeverityWarning, "Unknown directive 'fast'.", 1, 1, 2, 1},
+	}
+
+	for source, expected := range tests {
+		c := NewCompiler("test", parser.NewParser([]rune(source)))
+		c.Compile()
+
+		if diagnostics := c.Diagnostics(); len(diagnostics) != 1 || diagnostics[0] != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, diagnostics)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := map[string][]Diagnostic{
+		"fn f() {\n  return count\n}":            {{SeverityError, "Undefined variable 'count'.", 2, 10, 2, 15}},
+		"fn f() {\n  return 1\n  f()\n}":         {{SeverityWarning, "Unreachable code.", 3, 3, 3, 4}},
+		"while true {\n  break\n  a = 1\n  b\n}": {{SeverityWarning, "Condition is always true.", 1, 7, 1, 11}, {SeverityWarning, "Unreachable code.", 3, 3, 3, 4}, {SeverityError, "Undefined variable 'a'.", 3, 3, 3, 4}, {SeverityError, "Undefined variable 'b'.", 4, 3, 4, 4}},
+		"fn f() {\n  return g()\n}\nfn g() {}":   {},
+		"var x = typeof(1)":                      {},
+		"fn f() {\n  var a = 1\n  var a = 2\n}":  {{SeverityError, "Already a variable with this name in this scope.", 3, 7, 3, 8}},
+		// A local used outside of its scope
+		"{\n  var a = 1\n}\nvar b = a": {{SeverityError, "Undefined variable 'a'.", 4, 9, 4, 10}},
+	}
+
+	for source, expected := range tests {
+		diagnostics := Check(source, "typeof")
+
+		if !reflect.DeepEqual(diagnostics, expected) {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, diagnostics)
+		}
+	}
+}
+
+func TestDeeplyNestedExpressionIsAnError(t *testing.T) {
+	sources := []string{
+		"var a = " + strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000),
+		"var a = " + strings.Repeat("-", 100000) + "1",
+		"var a = " + strings.Repeat("{ b: ", 100000) + "1" + strings.Repeat(" }", 100000),
+	}
+
+	for _, source := range sources {
+		// Closing braces of the records left after the error are reported too
+		errors := compileErrors(source)
+
+		if len(errors) == 0 || !strings.HasSuffix(errors[0], "Error at '"+source[8:9]+"': Expression nesting too deep.") {
+			t.Errorf("Expected a nesting error for '%.20s...', got %q", source, errors)
+		}
+	}
+}
+
+func TestMaxNestingDepthOption(t *testing.T) {
+	options := CompilerOptions{MaxNestingDepth: 4}
+
+	c := NewCompilerWithOptions("test", parser.NewParser([]rune("var a = (((1)))")), options)
+	if c.Compile() == nil {
+		t.Errorf("Expected expression within the limit to compile, got %q", c.Errors())
+	}
+
+	c = NewCompilerWithOptions("test", parser.NewParser([]rune("var a = ((((1))))")), options)
+	if c.Compile() != nil || len(c.Errors()) != 1 || c.Errors()[0] != "[line 1] Error at '1': Expression nesting too deep." {
+		t.Errorf("Expected a nesting error, got %q", c.Errors())
+	}
+}
@@ -0,0 +1,10 @@
+package compiler
+
+import "math"
+
+// Well-known numbers available to every program under these names. Locals can shadow them, globals cannot.
+var builtinConstants = map[string]float64{
+	"PI":  math.Pi,
+	"Inf": math.Inf(1),
+	"NaN": math.NaN(),
+}
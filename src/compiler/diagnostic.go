@@ -0,0 +1,30 @@
+package compiler
+
+type Severity uint8
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+
+	return "error"
+}
+
+// Diagnostic is an error or a warning together with the range of the source it refers to, for tools which mark
+// the range instead of printing the formatted message.
+type Diagnostic struct {
+	Severity Severity
+	// Description of the problem, without the position and the offending token.
+	Message string
+	// Position of the first rune of the range. Lines and columns are counted from 1.
+	Line   int
+	Column int
+	// Position following the last rune of the range.
+	EndLine   int
+	EndColumn int
+}
@@ -0,0 +1,132 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"strconv"
+	"strings"
+)
+
+// Returns a textual listing of the chunk which can be turned back into a chunk by AssembleText.
+//
+// The listing starts with a '.chunk' directive naming the chunk followed by one '.constant' directive per constant.
+// Every instruction is on its own line, '.line' directives record source lines and jump targets get labels.
+// Functions among the constants are listed between '.function' and '.end' with their entries, captured variables
+// and code. Functions sharing the constants of the chunk do not list them again.
+func (c *Chunk) Disassemble() string {
+	var sb strings.Builder
+
+	_, _ = fmt.Fprintf(&sb, ".chunk %s\n", c.name)
+
+	c.disassemble(&sb, "", false)
+
+	return sb.String()
+}
+
+// Writes the constants, unless they are shared with the enclosing chunk, and the code of the chunk with every line
+// indented.
+func (c *Chunk) disassemble(sb *strings.Builder, indent string, shared bool) {
+	if !shared {
+		for _, constant := range c.constants {
+			if function, ok := asFunction(constant); ok {
+				function.disassemble(sb, indent, sharesConstants(function.chunk, c))
+			} else {
+				_, _ = fmt.Fprintf(sb, "%s.constant %s\n", indent, formatConstant(constant))
+			}
+		}
+	}
+
+	targets := jumpTargets(c.code)
+	line := -1
+
+	for offset := 0; offset < len(c.code); {
+		op := OpCode(c.code[offset])
+
+		if targets[offset] {
+			_, _ = fmt.Fprintf(sb, "%s%s:\n", indent, label(offset))
+		}
+
+		if c.lines[offset] != line {
+			line = c.lines[offset]
+
+			_, _ = fmt.Fprintf(sb, "%s.line %d\n", indent, line)
+		}
+
+		_, _ = fmt.Fprintf(sb, "%s    %s", indent, op)
+
+		if op.IsJump() {
+			_, _ = fmt.Fprintf(sb, " %s", label(jumpTarget(c.code, offset)))
+		} else if op.OperandWidth() == 1 {
+			_, _ = fmt.Fprintf(sb, " %d", c.code[offset+1])
+		} else if op.OperandWidth() == 2 {
+			operand := int(c.code[offset+1])<<8 | int(c.code[offset+2])
+
+			_, _ = fmt.Fprintf(sb, " %d", operand)
+
+			if op.hasConstantOperand() && operand < len(c.constants) {
+				_, _ = fmt.Fprintf(sb, " ; %s", formatConstant(c.constants[operand]))
+			}
+		} else if op.OperandWidth() == 4 {
+			_, _ = fmt.Fprintf(sb, " %d %d", c.operand(offset), c.operand(offset+2))
+		}
+
+		sb.WriteString("\n")
+
+		offset += 1 + op.OperandWidth()
+	}
+
+	if targets[len(c.code)] {
+		_, _ = fmt.Fprintf(sb, "%s%s:\n", indent, label(len(c.code)))
+	}
+}
+
+// Writes the function as a '.function' block, which AssembleText turns back into a function constant.
+func (f *Function) disassemble(sb *strings.Builder, indent string, shared bool) {
+	_, _ = fmt.Fprintf(sb, "%s.function %s %d %d", indent, f.name, f.arity, f.minArity)
+	if shared {
+		sb.WriteString(" shared")
+	}
+	sb.WriteString("\n")
+
+	inner := indent + "    "
+
+	for _, entry := range f.entries {
+		_, _ = fmt.Fprintf(sb, "%s.entry %d\n", inner, entry)
+	}
+
+	for _, upvalue := range f.upvalues {
+		if upvalue.isLocal {
+			_, _ = fmt.Fprintf(sb, "%s.upvalue local %d\n", inner, upvalue.index)
+		} else {
+			_, _ = fmt.Fprintf(sb, "%s.upvalue upvalue %d\n", inner, upvalue.index)
+		}
+	}
+
+	f.chunk.disassemble(sb, inner, shared)
+
+	_, _ = fmt.Fprintf(sb, "%s.end\n", indent)
+}
+
+func asFunction(constant value.Value) (*Function, bool) {
+	if !value.IsObject(constant) {
+		return nil, false
+	}
+
+	function, ok := value.AsObject(constant).(*Function)
+
+	return function, ok
+}
+
+func label(offset int) string {
+	return fmt.Sprintf("L%04d", offset)
+}
+
+func formatConstant(constant value.Value) string {
+	if value.IsObject(constant) {
+		if str, ok := value.AsObject(constant).(value.String); ok {
+			return strconv.Quote(string(str))
+		}
+	}
+
+	return constant.String()
+}
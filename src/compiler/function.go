@@ -0,0 +1,81 @@
+package compiler
+
+import (
+	"github.com/adamjedlicka/go-blu/src/value"
+	"strings"
+)
+
+type Function struct {
+	name string
+
+	// Number of declared parameters.
+	arity int
+	// Number of parameters without a default value.
+	minArity int
+	// Offsets in the chunk to start executing at, one for every parameter with a default value followed by the start
+	// of the body. Code between the entries evaluates default values of omitted parameters.
+	entries []int
+	// Variables captured from enclosing functions, in the order of their upvalue indexes.
+	upvalues []Upvalue
+
+	chunk *Chunk
+}
+
+func NewFunction(name string) *Function {
+	return &Function{
+		name: name,
+
+		arity:    0,
+		minArity: 0,
+		entries:  make([]int, 0),
+		upvalues: make([]Upvalue, 0),
+
+		chunk: NewChunk(name),
+	}
+}
+
+func FunctionVal(function *Function) value.Value {
+	return value.ObjectVal(function)
+}
+
+func (f *Function) Name() string {
+	return f.name
+}
+
+func (f *Function) Arity() int {
+	return f.arity
+}
+
+func (f *Function) MinArity() int {
+	return f.minArity
+}
+
+func (f *Function) Upvalues() []Upvalue {
+	return f.upvalues
+}
+
+func (f *Function) Chunk() *Chunk {
+	return f.chunk
+}
+
+// Returns the offset execution starts at when the function is called with the given number of arguments.
+func (f *Function) Entry(argCount int) int {
+	return f.entries[len(f.entries)-1-(f.arity-argCount)]
+}
+
+func (f *Function) IsTruthy() bool {
+	return true
+}
+
+func (f *Function) ToString() string {
+	// Names of anonymous functions are already in the form of '<fn@line:column>'
+	if strings.HasPrefix(f.name, "<") {
+		return f.name
+	}
+
+	return "<fn " + f.name + ">"
+}
+
+func (f *Function) TypeName() string {
+	return "function"
+}
@@ -7,4 +7,6 @@ type Local struct {
 	depth int8
 	// True if this local variable is captured as an upvalue by a function.
 	isUpvalue bool
+	// Type from the annotation of the variable, empty if it has none.
+	typeName string
 }
@@ -0,0 +1,15 @@
+package compiler
+
+type LoopContext struct {
+	// Name given to the loop by a label, empty if it has none.
+	label string
+	// Offset continue jumps to, the condition of while loops and the increment clause of for loops. It is -1 for do
+	// loops, where the condition follows the body.
+	start int
+	// Scope depth outside of the loop.
+	scopeDepth int8
+	// Operands of the jumps of break statements, patched to the end of the loop.
+	breaks []int
+	// Operands of the jumps of continue statements in do loops, patched to the condition.
+	continues []int
+}
@@ -9,6 +9,8 @@ const (
 	Nil
 
 	Pop
+	Dup
+	Nop
 
 	GetLocal
 	SetLocal
@@ -17,6 +19,7 @@ const (
 	SetGlobal
 	GetUpvalue
 	SetUpvalue
+	CloseUpvalues
 	GetProperty
 	SetProperty
 	GetSubscript
@@ -28,6 +31,12 @@ const (
 	Less
 	LessEqual
 	NotEqual
+	EqualConstant
+	GreaterConstant
+	LessConstant
+	AddLocals
+	SubtractLocals
+	LessLocals
 
 	Not
 	Negate
@@ -44,5 +53,145 @@ const (
 	JumpIfTruthy
 	Loop
 
+	Call
+	Closure
+	Record
+	MergeRecords
+	CheckType
+	ReturnNil
 	Return
 )
+
+// Returns the number of operand bytes that follow the given opcode in the bytecode.
+func (op OpCode) OperandWidth() int {
+	switch op {
+	case Constant,
+		GetLocal, SetLocal, DefineGlobal, GetGlobal, SetGlobal, GetUpvalue, SetUpvalue, CloseUpvalues,
+		GetProperty, SetProperty,
+		Jump, JumpIfFalsy, JumpIfTruthy, Loop,
+		EqualConstant, GreaterConstant, LessConstant,
+		Closure, CheckType:
+		return 2
+	case AddLocals, SubtractLocals, LessLocals:
+		return 4
+	case Call, Record:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Returns the number of operands of the opcode. Superinstructions combining two locals take a slot of each.
+func (op OpCode) OperandCount() int {
+	switch op.OperandWidth() {
+	case 0:
+		return 0
+	case 4:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Returns true if the operand of the opcode is an index into the constants of the chunk.
+func (op OpCode) hasConstantOperand() bool {
+	switch op {
+	case Constant, DefineGlobal, GetGlobal, SetGlobal, GetProperty, SetProperty,
+		EqualConstant, GreaterConstant, LessConstant,
+		Closure, CheckType:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns true if the given opcode is a jump and its operand is an offset relative to the next instruction.
+func (op OpCode) IsJump() bool {
+	switch op {
+	case Jump, JumpIfFalsy, JumpIfTruthy, Loop:
+		return true
+	default:
+		return false
+	}
+}
+
+var opCodeNames = []string{
+	"Constant",
+	"False",
+	"True",
+	"Nil",
+
+	"Pop",
+	"Dup",
+	"Nop",
+
+	"GetLocal",
+	"SetLocal",
+	"DefineGlobal",
+	"GetGlobal",
+	"SetGlobal",
+	"GetUpvalue",
+	"SetUpvalue",
+	"CloseUpvalues",
+	"GetProperty",
+	"SetProperty",
+	"GetSubscript",
+	"SetSubscript",
+
+	"Equal",
+	"Greater",
+	"GreaterEqual",
+	"Less",
+	"LessEqual",
+	"NotEqual",
+	"EqualConstant",
+	"GreaterConstant",
+	"LessConstant",
+	"AddLocals",
+	"SubtractLocals",
+	"LessLocals",
+
+	"Not",
+	"Negate",
+
+	"Add",
+	"Divide",
+	"Exponentiate",
+	"Multiply",
+	"Reminder",
+	"Subtract",
+
+	"Jump",
+	"JumpIfFalsy",
+	"JumpIfTruthy",
+	"Loop",
+
+	"Call",
+	"Closure",
+	"Record",
+	"MergeRecords",
+	"CheckType",
+	"ReturnNil",
+	"Return",
+}
+
+var opCodesByName map[string]OpCode
+
+func init() {
+	if len(opCodeNames)-1 != int(Return) {
+		panic("OpCode names table corrupt.")
+	}
+
+	opCodesByName = make(map[string]OpCode)
+	for i, name := range opCodeNames {
+		opCodesByName[name] = OpCode(i)
+	}
+}
+
+func (op OpCode) String() string {
+	if int(op) >= len(opCodeNames) {
+		return "Unknown"
+	}
+
+	return opCodeNames[op]
+}
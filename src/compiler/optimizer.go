@@ -0,0 +1,188 @@
+package compiler
+
+// Runs all optimization passes over the chunk. Entries are the offsets a function can be entered at, which are kept
+// pointing at the same instructions.
+func optimize(chunk *Chunk, entries []int) {
+	eliminateDeadCode(chunk, entries)
+	fuseConstantComparisons(chunk, entries)
+	fuseLocalArithmetic(chunk, entries)
+	removeNops(chunk, entries)
+}
+
+// Returns the absolute offset the jump instruction at the given offset lands on.
+func jumpTarget(code []uint8, offset int) int {
+	jump := int(code[offset+1])<<8 | int(code[offset+2])
+
+	if OpCode(code[offset]) == Loop {
+		return offset + 3 - jump
+	}
+
+	return offset + 3 + jump
+}
+
+// Collects offsets of all instructions that are targeted by some jump.
+func jumpTargets(code []uint8) map[int]bool {
+	targets := make(map[int]bool)
+
+	for offset := 0; offset < len(code); offset += 1 + OpCode(code[offset]).OperandWidth() {
+		if OpCode(code[offset]).IsJump() {
+			targets[jumpTarget(code, offset)] = true
+		}
+	}
+
+	return targets
+}
+
+// Collects offsets of all instructions the execution can start at or jump to.
+func entryTargets(code []uint8, entries []int) map[int]bool {
+	targets := jumpTargets(code)
+
+	for _, entry := range entries {
+		targets[entry] = true
+	}
+
+	return targets
+}
+
+// Replaces instructions following an unconditional Jump, Return or ReturnNil with Nops, up to the next jump target.
+func eliminateDeadCode(chunk *Chunk, entries []int) {
+	code := chunk.code
+	targets := entryTargets(code, entries)
+
+	dead := false
+
+	for offset := 0; offset < len(code); {
+		op := OpCode(code[offset])
+		width := 1 + op.OperandWidth()
+
+		if targets[offset] {
+			dead = false
+		}
+
+		if dead {
+			for i := offset; i < offset+width; i++ {
+				code[i] = uint8(Nop)
+			}
+		} else if op == Jump || op == Return || op == ReturnNil {
+			dead = true
+		}
+
+		offset += width
+	}
+}
+
+// Opcodes comparing the value on top of the stack with a constant, by the comparison they replace.
+var constantComparisons = map[OpCode]OpCode{
+	Equal:   EqualConstant,
+	Greater: GreaterConstant,
+	Less:    LessConstant,
+}
+
+// Fuses a Constant followed by a comparison into a single instruction comparing with the constant.
+func fuseConstantComparisons(chunk *Chunk, entries []int) {
+	code := chunk.code
+	targets := entryTargets(code, entries)
+
+	for offset := 0; offset < len(code); offset += 1 + OpCode(code[offset]).OperandWidth() {
+		next := offset + 3
+		if OpCode(code[offset]) != Constant || next >= len(code) || targets[next] {
+			continue
+		}
+
+		if fused, ok := constantComparisons[OpCode(code[next])]; ok {
+			code[offset] = uint8(fused)
+			code[next] = uint8(Nop)
+		}
+	}
+}
+
+// Superinstructions operating on two locals, by the instruction they replace.
+var localArithmetic = map[OpCode]OpCode{
+	Add:      AddLocals,
+	Subtract: SubtractLocals,
+	Less:     LessLocals,
+}
+
+// Fuses two GetLocals followed by an arithmetic instruction or a comparison into a single instruction reading both
+// locals, which saves two dispatches in the most common loop bodies.
+func fuseLocalArithmetic(chunk *Chunk, entries []int) {
+	code := chunk.code
+	targets := entryTargets(code, entries)
+
+	for offset := 0; offset < len(code); offset += 1 + OpCode(code[offset]).OperandWidth() {
+		second := offset + 3
+		third := offset + 6
+		if OpCode(code[offset]) != GetLocal || third >= len(code) || targets[second] || targets[third] {
+			continue
+		}
+
+		if OpCode(code[second]) != GetLocal {
+			continue
+		}
+
+		if fused, ok := localArithmetic[OpCode(code[third])]; ok {
+			code[offset] = uint8(fused)
+			code[offset+3] = code[second+1]
+			code[offset+4] = code[second+2]
+			code[offset+5] = uint8(Nop)
+			code[offset+6] = uint8(Nop)
+		}
+	}
+}
+
+// Compacts Nops out of the chunk and fixes the offsets of jumps and entries that cross them.
+func removeNops(chunk *Chunk, entries []int) {
+	code := chunk.code
+
+	// Maps offsets of the original instructions to their offsets in the compacted code.
+	// The end of the code is included because forward jumps may land there.
+	offsets := make(map[int]int)
+
+	newCode := make([]uint8, 0, len(code))
+	newLines := make([]int, 0, len(chunk.lines))
+
+	for offset := 0; offset < len(code); {
+		op := OpCode(code[offset])
+		width := 1 + op.OperandWidth()
+
+		offsets[offset] = len(newCode)
+
+		if op != Nop {
+			newCode = append(newCode, code[offset:offset+width]...)
+			newLines = append(newLines, chunk.lines[offset:offset+width]...)
+		}
+
+		offset += width
+	}
+
+	offsets[len(code)] = len(newCode)
+
+	if len(newCode) == len(code) {
+		return
+	}
+
+	for offset := 0; offset < len(code); offset += 1 + OpCode(code[offset]).OperandWidth() {
+		op := OpCode(code[offset])
+		if op == Nop || !op.IsJump() {
+			continue
+		}
+
+		from := offsets[offset] + 3
+		to := offsets[jumpTarget(code, offset)]
+
+		jump := to - from
+		if op == Loop {
+			jump = from - to
+		}
+
+		newCode[offsets[offset]+1] = uint8((jump >> 8) & 0xff)
+		newCode[offsets[offset]+2] = uint8(jump & 0xff)
+	}
+
+	for i, entry := range entries {
+		entries[i] = offsets[entry]
+	}
+
+	chunk.code = newCode
+	chunk.lines = newLines
+}
@@ -0,0 +1,212 @@
+package compiler
+
+import (
+	"github.com/adamjedlicka/go-blu/src/parser"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"strings"
+	"testing"
+)
+
+func compile(source string) *Chunk {
+	c := NewCompiler("test", parser.NewParser([]rune(source)))
+
+	return c.Compile()
+}
+
+func assertCode(t *testing.T, chunk *Chunk, expected []uint8) {
+	t.Helper()
+
+	if len(chunk.code) != len(expected) {
+		t.Fatalf("Expected code %v, got %v", expected, chunk.code)
+	}
+
+	for i := range expected {
+		if chunk.code[i] != expected[i] {
+			t.Fatalf("Expected code %v, got %v", expected, chunk.code)
+		}
+	}
+
+	if len(chunk.lines) != len(chunk.code) {
+		t.Fatalf("Expected %d lines, got %d", len(chunk.code), len(chunk.lines))
+	}
+}
+
+func TestCodeAfterReturnIsEliminated(t *testing.T) {
+	chunk := compile("return 1\n2 + 3\n4")
+
+	assertCode(t, chunk, []uint8{
+		uint8(Constant), 0, 0,
+		uint8(Return),
+	})
+}
+
+func TestJumpOverEliminatedCodeIsFixed(t *testing.T) {
+	chunk := compile("var a = false\nif a { return 1\n2 }\nreturn 3")
+
+	assertCode(t, chunk, []uint8{
+		uint8(False),
+		uint8(DefineGlobal), 0, 0,
+		uint8(GetGlobal), 0, 0,
+		uint8(JumpIfFalsy), 0, 5,
+		uint8(Pop),
+		uint8(Constant), 0, 1,
+		uint8(Return),
+		uint8(Pop),
+		uint8(Constant), 0, 3,
+		uint8(Return),
+	})
+
+	if jumpTarget(chunk.code, 7) != 15 {
+		t.Errorf("Expected jump to land on offset 15, got %d", jumpTarget(chunk.code, 7))
+	}
+}
+
+func TestLoopTargetIsNotEliminated(t *testing.T) {
+	chunk := compile("var a = 1\nwhile a < 3 { a = a + 1 }\nreturn a\na")
+
+	loop := -1
+	for offset := 0; offset < len(chunk.code); offset += 1 + OpCode(chunk.code[offset]).OperandWidth() {
+		if OpCode(chunk.code[offset]) == Loop {
+			loop = offset
+		}
+	}
+
+	if loop == -1 {
+		t.Fatalf("Expected Loop in %v", chunk.code)
+	}
+
+	if jumpTarget(chunk.code, loop) != 6 || OpCode(chunk.code[6]) != GetGlobal {
+		t.Errorf("Expected loop to land on the condition at offset 6, got %d", jumpTarget(chunk.code, loop))
+	}
+
+	if OpCode(chunk.code[len(chunk.code)-1]) != Return || OpCode(chunk.code[len(chunk.code)-4]) != GetGlobal {
+		t.Errorf("Expected code to end with GetGlobal and Return, got %v", chunk.code)
+	}
+}
+
+func TestNopsAreRemoved(t *testing.T) {
+	chunk := NewChunk("test")
+	chunk.pushConstant(value.NumberVal(1))
+
+	for _, code := range []uint8{
+		uint8(True),
+		uint8(JumpIfFalsy), 0, 5,
+		uint8(Nop),
+		uint8(Constant), 0, 0,
+		uint8(Nop),
+		uint8(Return),
+		uint8(Nop),
+		uint8(Loop), 0, 9,
+	} {
+		chunk.pushCode(code, 1)
+	}
+
+	removeNops(chunk, nil)
+
+	assertCode(t, chunk, []uint8{
+		uint8(True),
+		uint8(JumpIfFalsy), 0, 3,
+		uint8(Constant), 0, 0,
+		uint8(Return),
+		uint8(Loop), 0, 7,
+	})
+}
+
+func TestRepeatedConstantIsDuplicated(t *testing.T) {
+	chunk := compile("return 2 * 2")
+
+	if !strings.Contains(chunk.Disassemble(), "    Constant 0 ; 2\n    Dup\n    Multiply\n") {
+		t.Errorf("Expected repeated constant to be duplicated, got\n%s", chunk.Disassemble())
+	}
+
+	if len(chunk.constants) != 1 {
+		t.Errorf("Expected 1 constant, got %v", chunk.constants)
+	}
+}
+
+func TestConstantAfterJumpTargetIsNotDuplicated(t *testing.T) {
+	// The second 1 follows the end of the if expression, which is reached with 2 on top of the stack as well
+	chunk := compile("var a = true\nreturn (if a: 2 else: 1) + 1")
+
+	if strings.Contains(chunk.Disassemble(), "Dup") {
+		t.Errorf("Expected no duplicated constant, got\n%s", chunk.Disassemble())
+	}
+}
+
+func TestComparisonWithConstantIsFused(t *testing.T) {
+	chunk := compile("var a = 1\nreturn a < 10")
+
+	expected := ".chunk test\n" +
+		".constant \"a\"\n" +
+		".constant 1\n" +
+		".constant 10\n" +
+		".line 1\n" +
+		"    Constant 1 ; 1\n" +
+		"    DefineGlobal 0 ; \"a\"\n" +
+		".line 2\n" +
+		"    GetGlobal 0 ; \"a\"\n" +
+		"    LessConstant 2 ; 10\n" +
+		"    Return\n"
+
+	if chunk.Disassemble() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, chunk.Disassemble())
+	}
+}
+
+func TestComparisonAtJumpTargetIsNotFused(t *testing.T) {
+	// The comparison is reached from both branches of the if expression, not only right after the Constant
+	chunk := compile("var a = 1\nreturn a == (if a: 1 else: 2)")
+
+	if strings.Contains(chunk.Disassemble(), "EqualConstant") {
+		t.Errorf("Expected no fused comparison, got\n%s", chunk.Disassemble())
+	}
+}
+
+func TestArithmeticOnLocalsIsFused(t *testing.T) {
+	chunk := compile("{\nvar a = 1\nvar b = 2\nreturn a + b < a - b\n}")
+
+	expected := ".chunk test\n" +
+		".constant 1\n" +
+		".constant 2\n" +
+		".line 2\n" +
+		"    Constant 0 ; 1\n" +
+		".line 3\n" +
+		"    Constant 1 ; 2\n" +
+		".line 4\n" +
+		"    AddLocals 0 1\n" +
+		"    SubtractLocals 0 1\n" +
+		"    Less\n" +
+		"    Return\n"
+
+	if chunk.Disassemble() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, chunk.Disassemble())
+	}
+
+	assembled, err := AssembleText(chunk.Disassemble())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertCode(t, assembled, chunk.code)
+}
+
+func TestArithmeticAtJumpTargetIsNotFused(t *testing.T) {
+	// The addition is reached from both branches of the if expression, not only right after the second GetLocal
+	chunk := compile("{\nvar a = 1\nvar b = 2\nreturn a + (if a: b else: a)\n}")
+
+	if strings.Contains(chunk.Disassemble(), "AddLocals") {
+		t.Errorf("Expected no fused addition, got\n%s", chunk.Disassemble())
+	}
+}
+
+func TestEntriesFollowOptimizedCode(t *testing.T) {
+	chunk := compile("fn f(a, b = a + a, c = a < b) {\nreturn b - c\n}")
+	function := value.AsObject(chunk.constants[1]).(*Function)
+
+	// Every entry still starts the evaluation of a default value or the body
+	for argCount, op := range map[int]OpCode{1: AddLocals, 2: LessLocals, 3: SubtractLocals} {
+		if entry := function.Entry(argCount); OpCode(function.chunk.code[entry]) != op {
+			t.Errorf("Expected %s at the entry for %d arguments, got\n%s", op, argCount, function.chunk.Disassemble())
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package compiler
+
+type CompilerOptions struct {
+	// Emits runtime checks of type annotations. Otherwise annotations only document the code.
+	Strict bool
+	// Lets a top-level declaration reuse the name of a global declared earlier, overwriting its value. Otherwise it
+	// is a compile error, which catches typos in scripts. The REPL enables it, so lines can redefine globals.
+	AllowGlobalRedeclaration bool
+	// Maximum depth of nested expressions, like parentheses or unary operators. Deeper expressions are a compile
+	// error instead of overflowing the stack of the compiler. Zero means DefaultMaxNestingDepth.
+	MaxNestingDepth int
+}
+
+const DefaultMaxNestingDepth = 1000
+
+// Names of types which can be used in type annotations. Except for 'any' they match value.TypeName.
+var typeNames = map[string]bool{
+	"any":      true,
+	"boolean":  true,
+	"function": true,
+	"native":   true,
+	"nil":      true,
+	"number":   true,
+	"record":   true,
+	"string":   true,
+}
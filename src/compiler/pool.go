@@ -0,0 +1,92 @@
+package compiler
+
+import "github.com/adamjedlicka/go-blu/src/value"
+
+// Constants of a program, shared by the chunk of the script and the chunks of all of its functions. Equal numbers and
+// strings are stored only once, no matter how many functions use them.
+type constantPool struct {
+	values []value.Value
+	// Number of instructions using every constant.
+	uses []int
+	// Indexes of the numbers and strings in the pool.
+	indexes map[value.Value]uint16
+}
+
+func newConstantPool() *constantPool {
+	return &constantPool{
+		values:  make([]value.Value, 0),
+		uses:    make([]int, 0),
+		indexes: make(map[value.Value]uint16),
+	}
+}
+
+// Returns the index of the constant, adding it unless an equal number or string is already in the pool. Reports false
+// if the pool is full.
+func (p *constantPool) add(constant value.Value) (uint16, bool) {
+	shared := value.IsNumber(constant) || isString(constant)
+
+	if index, ok := p.indexes[constant]; ok && shared {
+		p.uses[index]++
+		return index, true
+	}
+
+	if len(p.values) == MaxConstants {
+		return 0, false
+	}
+
+	index := uint16(len(p.values))
+
+	p.values = append(p.values, constant)
+	p.uses = append(p.uses, 1)
+
+	if shared {
+		p.indexes[constant] = index
+	}
+
+	return index, true
+}
+
+// Gives back a use of the constant by an instruction which was removed. Constants at the end of the pool which are
+// not used anymore are dropped.
+func (p *constantPool) release(index uint16) {
+	p.uses[index]--
+
+	for len(p.values) > 0 && p.uses[len(p.values)-1] == 0 {
+		last := len(p.values) - 1
+
+		if p.indexes[p.values[last]] == uint16(last) {
+			delete(p.indexes, p.values[last])
+		}
+
+		p.values = p.values[:last]
+		p.uses = p.uses[:last]
+	}
+}
+
+func isString(constant value.Value) bool {
+	_, ok := asConstantString(constant)
+
+	return ok
+}
+
+// Makes the chunk and the chunks of all functions of the program use the final constants of the pool.
+func (p *constantPool) share(chunk *Chunk) {
+	chunk.constants = p.values
+
+	for _, constant := range p.values {
+		if value.IsObject(constant) {
+			if function, ok := value.AsObject(constant).(*Function); ok {
+				function.chunk.constants = p.values
+			}
+		}
+	}
+}
+
+// Reports whether both chunks use the same constants, like the chunks of a program and its functions.
+func sharesConstants(a *Chunk, b *Chunk) bool {
+	if len(a.constants) != len(b.constants) {
+		return false
+	}
+
+	return len(a.constants) == 0 || &a.constants[0] == &b.constants[0]
+}
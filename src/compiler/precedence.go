@@ -33,26 +33,27 @@ var parseRules ParseRules
 
 func init() {
 	parseRules = ParseRules{
-		{nil, nil, PrecedenceNone},                              // At
-		{nil, (*Compiler).binary, PrecedencePower},              // Caret
-		{nil, nil, PrecedenceNone},                              // Colon
-		{nil, nil, PrecedenceNone},                              // Comma
-		{nil, nil, PrecedenceNone},                              // Dot
-		{nil, nil, PrecedenceNone},                              // LeftBrace
-		{nil, nil, PrecedenceNone},                              // LeftBracket
-		{(*Compiler).grouping, nil, PrecedenceCall},             // LeftParen
-		{(*Compiler).unary, (*Compiler).binary, PrecedenceTerm}, // Minus
-		{nil, (*Compiler).binary, PrecedenceFactor},             // Percent
-		{nil, (*Compiler).binary, PrecedenceTerm},               // Plus
-		{nil, nil, PrecedenceNone},                              // RightBrace
-		{nil, nil, PrecedenceNone},                              // RightBracket
-		{nil, nil, PrecedenceNone},                              // RightParen
-		{nil, nil, PrecedenceNone},                              // Semicolon
-		{nil, (*Compiler).binary, PrecedenceFactor},             // Slash
-		{nil, (*Compiler).binary, PrecedenceFactor},             // Star
+		{nil, nil, PrecedenceNone},                               // At
+		{nil, (*Compiler).binary, PrecedencePower},               // Caret
+		{nil, nil, PrecedenceNone},                               // Colon
+		{nil, nil, PrecedenceNone},                               // Comma
+		{nil, (*Compiler).dot, PrecedenceCall},                   // Dot
+		{(*Compiler).blockExpression, nil, PrecedenceNone},       // LeftBrace
+		{nil, nil, PrecedenceNone},                               // LeftBracket
+		{(*Compiler).grouping, (*Compiler).call, PrecedenceCall}, // LeftParen
+		{(*Compiler).unary, (*Compiler).binary, PrecedenceTerm},  // Minus
+		{nil, (*Compiler).binary, PrecedenceFactor},              // Percent
+		{nil, (*Compiler).binary, PrecedenceTerm},                // Plus
+		{nil, nil, PrecedenceNone},                               // RightBrace
+		{nil, nil, PrecedenceNone},                               // RightBracket
+		{nil, nil, PrecedenceNone},                               // RightParen
+		{nil, nil, PrecedenceNone},                               // Semicolon
+		{nil, (*Compiler).binary, PrecedenceFactor},              // Slash
+		{nil, (*Compiler).binary, PrecedenceFactor},              // Star
 
 		{(*Compiler).unary, nil, PrecedenceNone},        // Bang
 		{nil, (*Compiler).binary, PrecedenceEquality},   // BangEqual
+		{nil, nil, PrecedenceNone},                      // DotDotDot
 		{nil, (*Compiler).binary, PrecedenceNone},       // Equal
 		{nil, (*Compiler).binary, PrecedenceEquality},   // EqualEqual
 		{nil, (*Compiler).binary, PrecedenceComparison}, // Greater
@@ -64,24 +65,28 @@ func init() {
 		{(*Compiler).number, nil, PrecedenceNone},   // Number
 		{(*Compiler).string, nil, PrecedenceNone},   // String
 
-		{nil, nil, PrecedenceNone},                 // And
-		{nil, nil, PrecedenceNone},                 // Assert
-		{nil, nil, PrecedenceNone},                 // Break
-		{nil, nil, PrecedenceNone},                 // Class
-		{nil, nil, PrecedenceNone},                 // Echo
-		{nil, nil, PrecedenceNone},                 // Else
-		{(*Compiler).literal, nil, PrecedenceNone}, // False
-		{nil, nil, PrecedenceNone},                 // Fn
-		{nil, nil, PrecedenceNone},                 // For
-		{nil, nil, PrecedenceNone},                 // Foreign
-		{nil, nil, PrecedenceNone},                 // If
-		{nil, nil, PrecedenceNone},                 // Import
-		{(*Compiler).literal, nil, PrecedenceNone}, // Nil
-		{nil, nil, PrecedenceNone},                 // Or
-		{nil, nil, PrecedenceNone},                 // Return
-		{(*Compiler).literal, nil, PrecedenceNone}, // True
-		{nil, nil, PrecedenceNone},                 // Var
-		{nil, nil, PrecedenceNone},                 // While
+		{nil, nil, PrecedenceNone},                      // And
+		{nil, nil, PrecedenceNone},                      // Assert
+		{nil, nil, PrecedenceNone},                      // Break
+		{nil, nil, PrecedenceNone},                      // Class
+		{nil, nil, PrecedenceNone},                      // Continue
+		{nil, nil, PrecedenceNone},                      // Do
+		{nil, nil, PrecedenceNone},                      // Echo
+		{nil, nil, PrecedenceNone},                      // Else
+		{nil, nil, PrecedenceNone},                      // Enum
+		{(*Compiler).literal, nil, PrecedenceNone},      // False
+		{(*Compiler).fnExpression, nil, PrecedenceNone}, // Fn
+		{nil, nil, PrecedenceNone},                      // For
+		{nil, nil, PrecedenceNone},                      // Foreign
+		{(*Compiler).ifExpression, nil, PrecedenceNone}, // If
+		{nil, nil, PrecedenceNone},                      // Import
+		{(*Compiler).literal, nil, PrecedenceNone},      // Nil
+		{nil, nil, PrecedenceNone},                      // Or
+		{nil, nil, PrecedenceNone},                      // Pass
+		{nil, nil, PrecedenceNone},                      // Return
+		{(*Compiler).literal, nil, PrecedenceNone},      // True
+		{nil, nil, PrecedenceNone},                      // Var
+		{nil, nil, PrecedenceNone},                      // While
 
 		{nil, nil, PrecedenceNone}, // Eof
 		{nil, nil, PrecedenceNone}, // Newline
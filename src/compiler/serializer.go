@@ -0,0 +1,331 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"math"
+)
+
+// Version of the serialized bytecode. It has to be changed whenever opcodes, their operands or the format itself
+// change, so chunks compiled by a different version are not run as if they were compatible.
+const BytecodeVersion = 3
+
+// Tags of the kinds of constants in a serialized chunk.
+const (
+	constantNil uint8 = iota
+	constantFalse
+	constantTrue
+	constantNumber
+	constantString
+	constantFunction
+)
+
+// Encodes the chunk, including the functions among its constants, into bytes which can be loaded by
+// DeserializeChunk in any other process running the same bytecode version. Multi-byte numbers are big-endian like
+// the operands in the code.
+func SerializeChunk(chunk *Chunk) ([]byte, error) {
+	data := []byte{BytecodeVersion}
+
+	return appendChunk(data, chunk, false)
+}
+
+// Decodes a chunk encoded by SerializeChunk and validates it.
+func DeserializeChunk(data []byte) (*Chunk, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("missing bytecode version")
+	}
+
+	if data[0] != BytecodeVersion {
+		return nil, fmt.Errorf("incompatible bytecode version %d, expected %d", data[0], BytecodeVersion)
+	}
+
+	d := decoder{data: data, offset: 1}
+
+	chunk := d.chunk(false)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if d.offset != len(data) {
+		return nil, fmt.Errorf("unexpected data after the chunk at byte %d", d.offset)
+	}
+
+	if err := chunk.Validate(); err != nil {
+		return nil, err
+	}
+
+	return chunk, nil
+}
+
+// Constants of a chunk sharing them with the chunk it is a constant of are not repeated, which would never end.
+func appendChunk(data []byte, chunk *Chunk, shared bool) ([]byte, error) {
+	data = appendString(data, chunk.name)
+
+	data = appendUint32(data, len(chunk.code))
+	data = append(data, chunk.code...)
+
+	// Lines are stored only where they change, most instructions share the line of the previous one
+	changes := make([]int, 0)
+	for offset, line := range chunk.lines {
+		if offset == 0 || line != chunk.lines[offset-1] {
+			changes = append(changes, offset, line)
+		}
+	}
+
+	data = appendUint32(data, len(changes)/2)
+	for _, n := range changes {
+		data = appendUint32(data, n)
+	}
+
+	if shared {
+		return data, nil
+	}
+
+	data = appendUint32(data, len(chunk.constants))
+	for _, constant := range chunk.constants {
+		var err error
+
+		data, err = appendConstant(data, constant, chunk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+func appendConstant(data []byte, constant value.Value, parent *Chunk) ([]byte, error) {
+	switch {
+	case value.IsBoolean(constant):
+		if value.AsBoolean(constant) {
+			return append(data, constantTrue), nil
+		}
+
+		return append(data, constantFalse), nil
+
+	case value.IsNumber(constant):
+		data = append(data, constantNumber)
+
+		return appendUint64(data, math.Float64bits(value.AsNumber(constant))), nil
+	}
+
+	switch object := value.AsObject(constant).(type) {
+	case value.Nil:
+		return append(data, constantNil), nil
+
+	case value.String:
+		data = append(data, constantString)
+
+		return appendString(data, string(object)), nil
+
+	case *Function:
+		data = append(data, constantFunction)
+		data = appendString(data, object.name)
+		data = appendUint32(data, object.arity)
+		data = appendUint32(data, object.minArity)
+
+		data = appendUint32(data, len(object.entries))
+		for _, entry := range object.entries {
+			data = appendUint32(data, entry)
+		}
+
+		data = appendUint32(data, len(object.upvalues))
+		for _, upvalue := range object.upvalues {
+			data = appendUint32(data, int(upvalue.index))
+
+			if upvalue.isLocal {
+				data = append(data, 1)
+			} else {
+				data = append(data, 0)
+			}
+		}
+
+		shared := sharesConstants(object.chunk, parent)
+		if shared {
+			data = append(data, 1)
+		} else {
+			data = append(data, 0)
+		}
+
+		return appendChunk(data, object.chunk, shared)
+
+	default:
+		return nil, fmt.Errorf("cannot serialize constant of type %s", value.TypeName(constant))
+	}
+}
+
+func appendString(data []byte, str string) []byte {
+	return append(appendUint32(data, len(str)), str...)
+}
+
+func appendUint32(data []byte, n int) []byte {
+	var bytes [4]byte
+	binary.BigEndian.PutUint32(bytes[:], uint32(n))
+
+	return append(data, bytes[:]...)
+}
+
+func appendUint64(data []byte, n uint64) []byte {
+	var bytes [8]byte
+	binary.BigEndian.PutUint64(bytes[:], n)
+
+	return append(data, bytes[:]...)
+}
+
+// Reads the parts of a serialized chunk. After the first error every read returns a zero value and the error is
+// kept in err.
+type decoder struct {
+	data   []byte
+	offset int
+	err    error
+	// Functions waiting for the constants of the chunk they share them with.
+	shared []*Function
+}
+
+func (d *decoder) bytes(count int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if count < 0 || count > len(d.data)-d.offset {
+		d.err = fmt.Errorf("unexpected end of data at byte %d", d.offset)
+		return nil
+	}
+
+	bytes := d.data[d.offset : d.offset+count]
+	d.offset += count
+
+	return bytes
+}
+
+func (d *decoder) byte() uint8 {
+	if bytes := d.bytes(1); bytes != nil {
+		return bytes[0]
+	}
+
+	return 0
+}
+
+func (d *decoder) uint32() int {
+	if bytes := d.bytes(4); bytes != nil {
+		return int(binary.BigEndian.Uint32(bytes))
+	}
+
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if bytes := d.bytes(8); bytes != nil {
+		return binary.BigEndian.Uint64(bytes)
+	}
+
+	return 0
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.uint32()))
+}
+
+func (d *decoder) chunk(shared bool) *Chunk {
+	chunk := NewChunk(d.string())
+	chunk.code = append(chunk.code, d.bytes(d.uint32())...)
+
+	changes := d.uint32()
+	line := 0
+
+	for i := 0; i < changes && d.err == nil; i++ {
+		offset, next := d.uint32(), d.uint32()
+		if offset < len(chunk.lines) || offset > len(chunk.code) {
+			d.err = fmt.Errorf("invalid line table of chunk '%s'", chunk.name)
+			return nil
+		}
+
+		for len(chunk.lines) < offset {
+			chunk.lines = append(chunk.lines, line)
+		}
+
+		line = next
+	}
+
+	for len(chunk.lines) < len(chunk.code) {
+		chunk.lines = append(chunk.lines, line)
+	}
+
+	if shared {
+		return chunk
+	}
+
+	pending := len(d.shared)
+
+	constants := d.uint32()
+	for i := 0; i < constants && d.err == nil; i++ {
+		if i == MaxConstants {
+			d.err = fmt.Errorf("too many constants in chunk '%s'", chunk.name)
+			return nil
+		}
+
+		chunk.constants = append(chunk.constants, d.constant())
+	}
+
+	for _, function := range d.shared[pending:] {
+		function.chunk.constants = chunk.constants
+	}
+	d.shared = d.shared[:pending]
+
+	return chunk
+}
+
+func (d *decoder) constant() value.Value {
+	switch tag := d.byte(); tag {
+	case constantNil:
+		return value.NilVal()
+
+	case constantFalse:
+		return value.FalseVal()
+
+	case constantTrue:
+		return value.TrueVal()
+
+	case constantNumber:
+		return value.NumberVal(math.Float64frombits(d.uint64()))
+
+	case constantString:
+		return value.StringVal(d.string())
+
+	case constantFunction:
+		function := NewFunction(d.string())
+		function.arity = d.uint32()
+		function.minArity = d.uint32()
+
+		entries := d.uint32()
+		for i := 0; i < entries && d.err == nil; i++ {
+			function.entries = append(function.entries, d.uint32())
+		}
+
+		upvalues := d.uint32()
+		for i := 0; i < upvalues && d.err == nil; i++ {
+			function.upvalues = append(function.upvalues, NewUpvalue(uint16(d.uint32()), d.byte() == 1))
+		}
+
+		shared := d.byte() == 1
+
+		function.chunk = d.chunk(shared)
+		if shared && function.chunk != nil {
+			d.shared = append(d.shared, function)
+		}
+
+		if d.err == nil && len(function.entries) != function.arity-function.minArity+1 {
+			d.err = fmt.Errorf("function '%s' has %d entries for arity %d", function.name, entries, function.arity)
+		}
+
+		return FunctionVal(function)
+
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unknown constant tag %d at byte %d", tag, d.offset-1)
+		}
+
+		return value.NilVal()
+	}
+}
@@ -0,0 +1,57 @@
+package compiler
+
+import (
+	"github.com/adamjedlicka/go-blu/src/parser"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSerializedChunkRoundTrips(t *testing.T) {
+	source := "var greeting = \"hi\"\nfn f(a, b = 2) {\n  return fn() { return a + b }\n}\nvar x = f(1)() > 2\nvar y = nil == false"
+
+	c := NewCompiler("test", parser.NewParser([]rune(source)))
+	chunk := c.Compile()
+
+	data, err := SerializeChunk(chunk)
+	if err != nil {
+		t.Fatalf("Expected chunk to serialize, got %s", err)
+	}
+
+	if data[0] != BytecodeVersion {
+		t.Errorf("Expected data to start with version %d, got %d", BytecodeVersion, data[0])
+	}
+
+	loaded, err := DeserializeChunk(append([]byte(nil), data...))
+	if err != nil {
+		t.Fatalf("Expected chunk to deserialize, got %s", err)
+	}
+
+	if !reflect.DeepEqual(loaded, chunk) {
+		t.Errorf("Expected %s, got %s", chunk.Disassemble(), loaded.Disassemble())
+	}
+}
+
+func TestDeserializeChunkErrors(t *testing.T) {
+	chunk := NewChunkBuilder("test").Emit(Nil).Emit(Return).Chunk()
+
+	data, err := SerializeChunk(chunk)
+	if err != nil {
+		t.Fatalf("Expected chunk to serialize, got %s", err)
+	}
+
+	incompatible := append([]byte{BytecodeVersion + 1}, data[1:]...)
+
+	tests := map[string][]byte{
+		"incompatible bytecode version 4, expected 3": incompatible,
+		"missing bytecode version":                    {},
+		"unexpected end of data":                      data[:len(data)-1],
+		"unexpected data after the chunk":             append(append([]byte(nil), data...), 0),
+	}
+
+	for expected, data := range tests {
+		if _, err := DeserializeChunk(data); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("Expected %v for '%v', got %v", expected, data, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package compiler
+
+import "github.com/adamjedlicka/go-blu/src/value"
+
+// Definition of a global variable by a Constant or Closure followed by DefineGlobal, which has no side effects and
+// can be removed if the variable is never used.
+type definition struct {
+	offset int
+	name   value.String
+	// Function the variable is defined to, nil for a Constant.
+	function *Function
+}
+
+// Removes definitions of global variables of the script, usually functions, which are never referenced by the code
+// that can run, and then drops the constants no code refers to anymore.
+//
+// Meant for chunks of whole programs. A global referenced by any reachable function is kept, even if that function
+// is never called. The REPL must not use it, later lines may refer to globals removed from earlier ones.
+func (c *Chunk) TreeShake() {
+	definitions := c.definitions()
+
+	defined := make(map[int]bool)
+	for _, d := range definitions {
+		defined[d.offset] = true
+	}
+
+	used := make(map[value.String]bool)
+	pending := []*Chunk{c}
+
+	for len(pending) > 0 {
+		chunk := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		for offset := 0; offset < len(chunk.code); offset += 1 + OpCode(chunk.code[offset]).OperandWidth() {
+			if chunk == c && defined[offset] {
+				continue
+			}
+
+			switch OpCode(chunk.code[offset]) {
+			case GetGlobal, SetGlobal:
+				name := value.AsObject(chunk.constants[chunk.operand(offset)]).(value.String)
+				if used[name] {
+					continue
+				}
+
+				used[name] = true
+
+				for _, d := range definitions {
+					if d.name == name && d.function != nil {
+						pending = append(pending, d.function.chunk)
+					}
+				}
+
+			case Closure:
+				pending = append(pending, value.AsObject(chunk.constants[chunk.operand(offset)]).(*Function).chunk)
+			}
+		}
+	}
+
+	removed := false
+
+	for _, d := range definitions {
+		if !used[d.name] {
+			for i := d.offset; i < d.offset+6; i++ {
+				c.code[i] = uint8(Nop)
+			}
+
+			removed = true
+		}
+	}
+
+	if removed {
+		removeNops(c, nil)
+		c.removeUnusedConstants()
+	}
+}
+
+// Collects the definitions of global variables in the code of the chunk.
+func (c *Chunk) definitions() []definition {
+	definitions := make([]definition, 0)
+	targets := jumpTargets(c.code)
+
+	for offset := 0; offset < len(c.code); offset += 1 + OpCode(c.code[offset]).OperandWidth() {
+		op := OpCode(c.code[offset])
+		next := offset + 3
+
+		if op != Constant && op != Closure || next >= len(c.code) || OpCode(c.code[next]) != DefineGlobal {
+			continue
+		}
+
+		// A jump landing between the value and DefineGlobal defines the variable with some other value
+		if targets[next] {
+			continue
+		}
+
+		d := definition{
+			offset: offset,
+			name:   value.AsObject(c.constants[c.operand(next)]).(value.String),
+		}
+
+		if op == Closure {
+			d.function = value.AsObject(c.constants[c.operand(offset)]).(*Function)
+		}
+
+		definitions = append(definitions, d)
+	}
+
+	return definitions
+}
+
+// Drops constants which are not an operand of any instruction and renumbers the remaining ones, also in the chunks of
+// the functions sharing the constants with the chunk.
+func (c *Chunk) removeUnusedConstants() {
+	chunks := []*Chunk{c}
+	visited := map[*Chunk]bool{c: true}
+
+	for i := 0; i < len(chunks); i++ {
+		chunk := chunks[i]
+
+		for offset := 0; offset < len(chunk.code); offset += 1 + OpCode(chunk.code[offset]).OperandWidth() {
+			if OpCode(chunk.code[offset]) != Closure {
+				continue
+			}
+
+			function := value.AsObject(chunk.constants[chunk.operand(offset)]).(*Function)
+			if !visited[function.chunk] && sharesConstants(function.chunk, c) {
+				visited[function.chunk] = true
+				chunks = append(chunks, function.chunk)
+			}
+		}
+	}
+
+	indexes := make(map[int]int)
+	constants := make([]value.Value, 0, len(c.constants))
+
+	for _, chunk := range chunks {
+		for offset := 0; offset < len(chunk.code); offset += 1 + OpCode(chunk.code[offset]).OperandWidth() {
+			if !OpCode(chunk.code[offset]).hasConstantOperand() {
+				continue
+			}
+
+			constant := chunk.operand(offset)
+
+			index, ok := indexes[constant]
+			if !ok {
+				index = len(constants)
+				indexes[constant] = index
+				constants = append(constants, c.constants[constant])
+			}
+
+			chunk.code[offset+1] = uint8((index >> 8) & 0xff)
+			chunk.code[offset+2] = uint8(index & 0xff)
+		}
+	}
+
+	for _, chunk := range chunks {
+		chunk.constants = constants
+	}
+}
+
+// Returns the two-byte operand of the instruction at the given offset.
+func (c *Chunk) operand(offset int) int {
+	return int(c.code[offset+1])<<8 | int(c.code[offset+2])
+}
@@ -0,0 +1,101 @@
+package compiler
+
+import (
+	"github.com/adamjedlicka/go-blu/src/value"
+	"testing"
+)
+
+// Returns names of the functions in the constants of the chunk.
+func functionNames(chunk *Chunk) []string {
+	names := make([]string, 0)
+
+	for _, constant := range chunk.constants {
+		if value.IsObject(constant) {
+			if function, ok := value.AsObject(constant).(*Function); ok {
+				names = append(names, function.Name())
+			}
+		}
+	}
+
+	return names
+}
+
+func TestTreeShake(t *testing.T) {
+	tests := map[string][]string{
+		"fn used() {\nreturn 1\n}\nfn unused() {\nreturn 2\n}\nreturn used()": {"used"},
+		// Functions reachable from used functions are kept
+		"fn a() {\nreturn b()\n}\nfn b() {\nreturn 1\n}\nfn c() {\nreturn a()\n}\nreturn a()": {"a", "b"},
+		"fn a() {\nreturn a()\n}\nfn b() {\nreturn b()\n}\nreturn b":                          {"b"},
+		"var f = fn() {}\nvar g = fn() {}\ng = 1":                                             {"<fn@2:9>"},
+		"fn f() {}\n{\nvar g = fn() {\nreturn f()\n}\n}":                                      {"f", "<fn@3:9>"},
+	}
+
+	for source, expected := range tests {
+		chunk := compile(source)
+		if chunk == nil {
+			t.Fatalf("Failed to compile '%s'", source)
+		}
+
+		chunk.TreeShake()
+
+		if err := chunk.Validate(); err != nil {
+			t.Errorf("Expected valid chunk for '%s', got %s", source, err)
+		}
+
+		names := functionNames(chunk)
+		if len(names) != len(expected) {
+			t.Errorf("Expected functions %v for '%s', got %v", expected, source, names)
+			continue
+		}
+
+		for i := range expected {
+			if names[i] != expected[i] {
+				t.Errorf("Expected functions %v for '%s', got %v", expected, source, names)
+				break
+			}
+		}
+	}
+}
+
+func TestTreeShakeDropsUnusedConstants(t *testing.T) {
+	chunk := compile("var unused = 123\nvar used = 4\nreturn used")
+	if chunk == nil {
+		t.Fatal("Failed to compile")
+	}
+
+	chunk.TreeShake()
+
+	expected := []value.Value{value.NumberVal(4), value.StringVal("used")}
+	if len(chunk.constants) != len(expected) {
+		t.Fatalf("Expected constants %v, got %v", expected, chunk.constants)
+	}
+
+	for i := range expected {
+		if chunk.constants[i] != expected[i] {
+			t.Errorf("Expected constants %v, got %v", expected, chunk.constants)
+		}
+	}
+}
+
+func TestTreeShakeRenumbersConstantsOfFunctions(t *testing.T) {
+	chunk := compile("fn unused() {\nreturn 111\n}\nfn used() {\nreturn 222\n}\nreturn used()")
+	if chunk == nil {
+		t.Fatal("Failed to compile")
+	}
+
+	chunk.TreeShake()
+
+	used := value.AsObject(chunk.constants[0]).(*Function)
+
+	if !sharesConstants(used.chunk, chunk) {
+		t.Fatalf("Expected function to share constants %v, got %v", chunk.constants, used.chunk.constants)
+	}
+
+	if constant := used.chunk.constants[used.chunk.operand(0)]; constant != value.NumberVal(222) {
+		t.Errorf("Expected function to return 222, got %v", constant)
+	}
+
+	if err := chunk.Validate(); err != nil {
+		t.Errorf("Expected valid chunk, got %s", err)
+	}
+}
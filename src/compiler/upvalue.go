@@ -6,3 +6,11 @@ type Upvalue struct {
 	// Whether the captured variable is a local or upvalue in the enclosing function.
 	isLocal bool
 }
+
+func (u Upvalue) Index() uint16 {
+	return u.index
+}
+
+func (u Upvalue) IsLocal() bool {
+	return u.isLocal
+}
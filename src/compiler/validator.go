@@ -0,0 +1,252 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/adamjedlicka/go-blu/src/value"
+)
+
+// Checks that the chunk can be executed safely: every opcode is known and implemented, operands are complete,
+// constant indexes are in range and of the right type, every jump lands on an instruction and locals are only
+// accessed in slots that are on the stack. Functions created by the chunk are checked as well, including their entries
+// and the variables they capture.
+func (c *Chunk) Validate() error {
+	if err := c.validate(0); err != nil {
+		return err
+	}
+
+	return c.validateSlots(0, []int{0})
+}
+
+// Validates the chunk of a function with the given number of upvalues, zero for the script.
+func (c *Chunk) validate(upvalues int) error {
+	if len(c.lines) != len(c.code) {
+		return fmt.Errorf("chunk '%s' has %d lines for %d bytes of code", c.name, len(c.lines), len(c.code))
+	}
+
+	boundaries := make(map[int]bool)
+
+	for offset := 0; offset < len(c.code); {
+		boundaries[offset] = true
+
+		if int(c.code[offset]) >= len(opCodeNames) {
+			return c.validationError(offset, "unknown opcode %d", c.code[offset])
+		}
+
+		op := OpCode(c.code[offset])
+		if offset+op.OperandWidth() >= len(c.code) {
+			return c.validationError(offset, "missing operand of %s", op)
+		}
+
+		switch op {
+		case GetSubscript, SetSubscript:
+			return c.validationError(offset, "%s is not supported", op)
+
+		case GetUpvalue, SetUpvalue:
+			if index := c.operand(offset); index >= upvalues {
+				return c.validationError(offset, "upvalue %d out of range of %d upvalues", index, upvalues)
+			}
+		}
+
+		if op.hasConstantOperand() {
+			if err := c.validateConstant(offset, op, upvalues); err != nil {
+				return err
+			}
+		}
+
+		offset += 1 + op.OperandWidth()
+	}
+
+	for offset := 0; offset < len(c.code); offset += 1 + OpCode(c.code[offset]).OperandWidth() {
+		if !OpCode(c.code[offset]).IsJump() {
+			continue
+		}
+
+		if target := jumpTarget(c.code, offset); !boundaries[target] {
+			return c.validationError(offset, "jump to %d which is not the start of an instruction", target)
+		}
+	}
+
+	last := c.lastInstruction()
+	if last == -1 {
+		return fmt.Errorf("chunk '%s' does not end with Return or a jump", c.name)
+	}
+
+	switch OpCode(c.code[last]) {
+	case Return, ReturnNil, Jump, Loop:
+	default:
+		return fmt.Errorf("chunk '%s' does not end with Return or a jump", c.name)
+	}
+
+	return nil
+}
+
+// Follows every path of execution from the entries, which start with the given number of values in the slots of the
+// frame, and checks that locals, including those captured by closures, are
+// in slots below the height of the stack. Where paths meet, the lowest height of them is checked.
+func (c *Chunk) validateSlots(slots int, entries []int) error {
+	heights := make(map[int]int)
+	pending := make([]int, 0, len(entries))
+
+	for _, entry := range entries {
+		heights[entry] = slots
+		pending = append(pending, entry)
+	}
+
+	for len(pending) > 0 {
+		offset := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		op := OpCode(c.code[offset])
+		height := heights[offset]
+
+		for _, slot := range c.localSlots(offset) {
+			if slot >= height {
+				return c.validationError(offset, "local %d out of range of %d slots on the stack", slot, height)
+			}
+		}
+
+		if op == Closure {
+			function := value.AsObject(c.constants[c.operand(offset)]).(*Function)
+
+			for _, upvalue := range function.upvalues {
+				if upvalue.isLocal && int(upvalue.index) >= height {
+					return c.validationError(offset, "function '%s' captures local %d out of range of %d slots on the stack", function.name, upvalue.index, height)
+				}
+			}
+		}
+
+		height += c.stackEffect(offset)
+		if height < 0 {
+			return c.validationError(offset, "%s takes more values than there are on the stack", op)
+		}
+
+		for _, next := range c.successors(offset) {
+			if known, ok := heights[next]; ok && known <= height {
+				continue
+			}
+
+			heights[next] = height
+			pending = append(pending, next)
+		}
+	}
+
+	return nil
+}
+
+// Returns the local slots accessed by the instruction at the given offset.
+func (c *Chunk) localSlots(offset int) []int {
+	switch OpCode(c.code[offset]) {
+	case GetLocal, SetLocal, CloseUpvalues:
+		return []int{c.operand(offset)}
+	case AddLocals, SubtractLocals, LessLocals:
+		return []int{c.operand(offset), c.operand(offset + 2)}
+	default:
+		return nil
+	}
+}
+
+// Returns by how many values the instruction at the given offset changes the height of the stack.
+func (c *Chunk) stackEffect(offset int) int {
+	switch op := OpCode(c.code[offset]); op {
+	case Constant, False, True, Nil, Dup, GetLocal, GetGlobal, GetUpvalue, AddLocals, SubtractLocals, LessLocals, Closure:
+		return 1
+	case Pop, DefineGlobal, SetProperty, MergeRecords, Equal, Greater, GreaterEqual, Less, LessEqual, NotEqual,
+		Add, Divide, Exponentiate, Multiply, Reminder, Subtract, Return:
+		return -1
+	case Call:
+		// The callee and the arguments are replaced by the result
+		return -int(c.code[offset+1])
+	case Record:
+		// Names and values of the fields are replaced by the record
+		return 1 - 2*int(c.code[offset+1])
+	default:
+		return 0
+	}
+}
+
+// Returns offsets of the instructions that can execute after the one at the given offset.
+func (c *Chunk) successors(offset int) []int {
+	op := OpCode(c.code[offset])
+	next := offset + 1 + op.OperandWidth()
+
+	switch op {
+	case Return, ReturnNil:
+		return nil
+	case Jump, Loop:
+		return []int{jumpTarget(c.code, offset)}
+	case JumpIfFalsy, JumpIfTruthy:
+		return []int{next, jumpTarget(c.code, offset)}
+	}
+
+	if next >= len(c.code) {
+		return nil
+	}
+
+	return []int{next}
+}
+
+func (c *Chunk) validateConstant(offset int, op OpCode, upvalues int) error {
+	index := int(c.code[offset+1])<<8 | int(c.code[offset+2])
+	if index >= len(c.constants) {
+		return c.validationError(offset, "constant %d out of range of %d constants", index, len(c.constants))
+	}
+
+	constant := c.constants[index]
+
+	switch op {
+	case DefineGlobal, GetGlobal, SetGlobal, GetProperty, SetProperty, CheckType:
+		if _, ok := value.AsObject(constant).(value.String); !value.IsObject(constant) || !ok {
+			return c.validationError(offset, "%s expects a string constant, got %s", op, value.TypeName(constant))
+		}
+
+	case Closure:
+		function, ok := value.AsObject(constant).(*Function)
+		if !value.IsObject(constant) || !ok {
+			return c.validationError(offset, "%s expects a function constant, got %s", op, value.TypeName(constant))
+		}
+
+		return c.validateFunction(offset, function, upvalues)
+	}
+
+	return nil
+}
+
+// Validates the function created by the Closure at the given offset in a chunk with the given number of upvalues.
+func (c *Chunk) validateFunction(offset int, function *Function, upvalues int) error {
+	if err := function.chunk.validate(len(function.upvalues)); err != nil {
+		return err
+	}
+
+	if len(function.entries) != function.arity-function.minArity+1 {
+		return c.validationError(offset, "function '%s' has %d entries for arity %d", function.name, len(function.entries), function.arity)
+	}
+
+	starts := make(map[int]bool)
+	for start := 0; start < len(function.chunk.code); start += 1 + OpCode(function.chunk.code[start]).OperandWidth() {
+		starts[start] = true
+	}
+
+	for _, entry := range function.entries {
+		if !starts[entry] {
+			return c.validationError(offset, "entry %d of function '%s' is not the start of an instruction", entry, function.name)
+		}
+	}
+
+	// The frame holds the closure and the arguments, omitted ones are reserved before entering
+	if err := function.chunk.validateSlots(function.arity+1, function.entries); err != nil {
+		return err
+	}
+
+	// Locals are captured from the frame creating the closure, other variables from the upvalues of its function
+	for _, upvalue := range function.upvalues {
+		if !upvalue.isLocal && int(upvalue.index) >= upvalues {
+			return c.validationError(offset, "function '%s' captures upvalue %d out of range of %d upvalues", function.name, upvalue.index, upvalues)
+		}
+	}
+
+	return nil
+}
+
+func (c *Chunk) validationError(offset int, message string, a ...interface{}) error {
+	return fmt.Errorf("chunk '%s' at offset %d: %s", c.name, offset, fmt.Sprintf(message, a...))
+}
@@ -0,0 +1,178 @@
+package compiler
+
+import (
+	"github.com/adamjedlicka/go-blu/src/value"
+	"strings"
+	"testing"
+)
+
+func chunkOf(constants []value.Value, code ...uint8) *Chunk {
+	chunk := NewChunk("test")
+	chunk.constants = constants
+
+	for _, b := range code {
+		chunk.pushCode(b, 1)
+	}
+
+	return chunk
+}
+
+// Returns a function named f with a single entry at the given offset of its code.
+func function(entry int, upvalues []Upvalue, code ...uint8) *Function {
+	function := NewFunction("f")
+	function.entries = append(function.entries, entry)
+	function.upvalues = append(function.upvalues, upvalues...)
+	function.chunk = chunkOf(nil, code...)
+	function.chunk.name = "f"
+
+	return function
+}
+
+// Returns the function with every parameter required.
+func arity(n int, function *Function) *Function {
+	function.arity = n
+	function.minArity = n
+
+	return function
+}
+
+func TestCompiledChunksAreValid(t *testing.T) {
+	sources := []string{
+		"var a = 1\nwhile a < 10 { a = a + 1 }\nreturn a",
+		"fn f(a, b = 2) {\nvar c = fn() { return a + b }\nreturn c()\n}\nreturn f(1)",
+		"enum E { A, B }\nvar a = E.A\nif a == 0 { a = 1 } else { a = 2 }",
+	}
+
+	for _, source := range sources {
+		if err := compile(source).Validate(); err != nil {
+			t.Errorf("Expected '%s' to be valid, got %s", source, err)
+		}
+	}
+}
+
+func TestInvalidChunks(t *testing.T) {
+	numbers := []value.Value{value.NumberVal(1)}
+
+	tests := []struct {
+		chunk   *Chunk
+		message string
+	}{
+		{
+			chunkOf(numbers, uint8(Constant), 0, 5, uint8(Return)),
+			"chunk 'test' at offset 0: constant 5 out of range of 1 constants",
+		},
+		{
+			// Jumps 1 byte forward, into the operand of the Constant
+			chunkOf(numbers, uint8(Jump), 0, 1, uint8(Constant), 0, 0, uint8(Return)),
+			"chunk 'test' at offset 0: jump to 4 which is not the start of an instruction",
+		},
+		{
+			chunkOf(numbers, uint8(Loop), 0, 10, uint8(Return)),
+			"chunk 'test' at offset 0: jump to -7 which is not the start of an instruction",
+		},
+		{
+			chunkOf(numbers, 250, uint8(Return)),
+			"chunk 'test' at offset 0: unknown opcode 250",
+		},
+		{
+			chunkOf(numbers, uint8(Nil), uint8(Constant), 0),
+			"chunk 'test' at offset 1: missing operand of Constant",
+		},
+		{
+			chunkOf(numbers, uint8(Constant), 0, 0, uint8(DefineGlobal), 0, 0, uint8(Return)),
+			"chunk 'test' at offset 3: DefineGlobal expects a string constant, got number",
+		},
+		{
+			chunkOf(numbers, uint8(Constant), 0, 0),
+			"chunk 'test' does not end with Return or a jump",
+		},
+		{
+			chunkOf([]value.Value{FunctionVal(NewFunction("f"))}, uint8(Closure), 0, 0, uint8(Return)),
+			"chunk 'f' does not end with Return or a jump",
+		},
+		{
+			chunkOf(numbers, uint8(Nil), uint8(Nil), uint8(GetSubscript), uint8(Return)),
+			"chunk 'test' at offset 2: GetSubscript is not supported",
+		},
+		{
+			chunkOf(numbers, uint8(Nil), uint8(Nil), uint8(Nil), uint8(SetSubscript), uint8(Return)),
+			"chunk 'test' at offset 3: SetSubscript is not supported",
+		},
+		{
+			chunkOf(numbers, uint8(GetUpvalue), 0, 0, uint8(Return)),
+			"chunk 'test' at offset 0: upvalue 0 out of range of 0 upvalues",
+		},
+		{
+			chunkOf([]value.Value{FunctionVal(function(1, nil, uint8(GetLocal), 0, 0, uint8(Return)))}, uint8(Closure), 0, 0, uint8(Return)),
+			"chunk 'test' at offset 0: entry 1 of function 'f' is not the start of an instruction",
+		},
+		{
+			chunkOf([]value.Value{FunctionVal(function(5, nil, uint8(Nil), uint8(Return)))}, uint8(Closure), 0, 0, uint8(Return)),
+			"chunk 'test' at offset 0: entry 5 of function 'f' is not the start of an instruction",
+		},
+		{
+			chunkOf([]value.Value{FunctionVal(function(0, []Upvalue{NewUpvalue(0, false)}, uint8(ReturnNil)))}, uint8(Closure), 0, 0, uint8(Return)),
+			"chunk 'test' at offset 0: function 'f' captures upvalue 0 out of range of 0 upvalues",
+		},
+		{
+			chunkOf([]value.Value{FunctionVal(function(0, []Upvalue{NewUpvalue(0, true)}, uint8(GetUpvalue), 0, 1, uint8(Return)))}, uint8(Closure), 0, 0, uint8(Return)),
+			"chunk 'f' at offset 0: upvalue 1 out of range of 1 upvalues",
+		},
+		{
+			chunkOf(numbers, uint8(GetLocal), 255, 255, uint8(Return)),
+			"chunk 'test' at offset 0: local 65535 out of range of 0 slots on the stack",
+		},
+		{
+			chunkOf(numbers, uint8(Nil), uint8(Nil), uint8(SetLocal), 0, 2, uint8(Return)),
+			"chunk 'test' at offset 2: local 2 out of range of 2 slots on the stack",
+		},
+		{
+			chunkOf(numbers, uint8(Nil), uint8(AddLocals), 0, 0, 0, 1, uint8(Return)),
+			"chunk 'test' at offset 1: local 1 out of range of 1 slots on the stack",
+		},
+		{
+			chunkOf(numbers, uint8(Nil), uint8(CloseUpvalues), 0, 1, uint8(Return)),
+			"chunk 'test' at offset 1: local 1 out of range of 1 slots on the stack",
+		},
+		{
+			// The local is popped on the path skipping the jump
+			chunkOf(numbers, uint8(Nil), uint8(True), uint8(JumpIfFalsy), 0, 1, uint8(Pop), uint8(GetLocal), 0, 1, uint8(Return)),
+			"chunk 'test' at offset 6: local 1 out of range of 1 slots on the stack",
+		},
+		{
+			// A function of arity 1 has the closure and the argument in its frame
+			chunkOf([]value.Value{FunctionVal(arity(1, function(0, nil, uint8(GetLocal), 0, 2, uint8(Return))))}, uint8(Closure), 0, 0, uint8(Return)),
+			"chunk 'f' at offset 0: local 2 out of range of 2 slots on the stack",
+		},
+		{
+			chunkOf([]value.Value{FunctionVal(function(0, []Upvalue{NewUpvalue(0, true)}, uint8(GetUpvalue), 0, 0, uint8(Return)))}, uint8(Closure), 0, 0, uint8(Return)),
+			"chunk 'test' at offset 0: function 'f' captures local 0 out of range of 0 slots on the stack",
+		},
+		{
+			chunkOf(numbers, uint8(Pop), uint8(ReturnNil)),
+			"chunk 'test' at offset 0: Pop takes more values than there are on the stack",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.chunk.Validate()
+
+		if err == nil || err.Error() != test.message {
+			t.Errorf("Expected error '%s', got %v", test.message, err)
+		}
+	}
+}
+
+func TestAssemblerValidatesChunk(t *testing.T) {
+	_, err := AssembleText(".chunk test\n.constant 1\n    Constant 3\n    Return\n")
+
+	if err == nil || !strings.Contains(err.Error(), "constant 3 out of range") {
+		t.Errorf("Expected validation error, got %v", err)
+	}
+
+	_, err = AssembleText(".chunk test\n    GetLocal 65535\n    Return\n")
+
+	if err == nil || !strings.Contains(err.Error(), "local 65535 out of range") {
+		t.Errorf("Expected validation error, got %v", err)
+	}
+}
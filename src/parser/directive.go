@@ -0,0 +1,62 @@
+package parser
+
+import "strings"
+
+// Prefix of comments which are treated as compiler directives.
+const directivePrefix = "//go-blue:"
+
+// Directive is a comment of the form '//go-blue:name' placed before the first statement of the source.
+type Directive struct {
+	name string
+	line int
+}
+
+func (d Directive) Name() string {
+	return d.name
+}
+
+func (d Directive) Line() int {
+	return d.line
+}
+
+// Returns the directives from the comments leading the source. Scanning stops at the first line that is neither
+// blank nor a comment, so directives have no effect anywhere else. The position of the parser is not affected, but
+// a parser reading from a reader has to be asked before it produces the first token.
+func (p *Parser) Directives() []Directive {
+	directives := make([]Directive, 0)
+
+	if p.source.base > 0 {
+		return directives
+	}
+
+	for i, line := 0, p.source.start(); p.source.has(line); i++ {
+		end := line
+		for p.source.has(end) && p.source.at(end) != '\n' {
+			end++
+		}
+
+		text := strings.TrimSpace(string(p.source.slice(line, end)))
+		line = end + 1
+
+		if text == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(text, "//") {
+			break
+		}
+
+		if strings.HasPrefix(text, directivePrefix) {
+			fields := strings.Fields(strings.TrimPrefix(text, directivePrefix))
+
+			name := ""
+			if len(fields) > 0 {
+				name = fields[0]
+			}
+
+			directives = append(directives, Directive{name: name, line: i + 1})
+		}
+	}
+
+	return directives
+}
@@ -1,22 +1,26 @@
 package parser
 
 var keywords = map[string]TokenType{
-	"and":     And,
-	"assert":  Assert,
-	"break":   Break,
-	"class":   Class,
-	"echo":    Echo,
-	"else":    Else,
-	"false":   False,
-	"fn":      Fn,
-	"for":     For,
-	"foreign": Foreign,
-	"if":      If,
-	"import":  Import,
-	"nil":     Nil,
-	"or":      Or,
-	"return":  Return,
-	"true":    True,
-	"var":     Var,
-	"while":   While,
+	"and":      And,
+	"assert":   Assert,
+	"break":    Break,
+	"class":    Class,
+	"continue": Continue,
+	"do":       Do,
+	"echo":     Echo,
+	"else":     Else,
+	"enum":     Enum,
+	"false":    False,
+	"fn":       Fn,
+	"for":      For,
+	"foreign":  Foreign,
+	"if":       If,
+	"import":   Import,
+	"nil":      Nil,
+	"or":       Or,
+	"pass":     Pass,
+	"return":   Return,
+	"true":     True,
+	"var":      Var,
+	"while":    While,
 }
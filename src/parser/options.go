@@ -0,0 +1,9 @@
+package parser
+
+// Number of columns a tab advances the column counter by, unless configured otherwise.
+const DefaultTabWidth = 1
+
+type ParserOptions struct {
+	// Number of columns a tab character takes up in the reported token columns.
+	TabWidth int
+}
@@ -1,36 +1,108 @@
 package parser
 
+import (
+	"io"
+)
+
+// The byte order mark which is stripped from the start of the source.
+const bom = '\uFEFF'
+
 type Parser struct {
-	source   []rune
+	source   *source
 	from     int
 	at       int
 	lineFrom int
 	lineTo   int
+	// Index of the first rune of the line the parser is currently at.
+	lineStart int
+	// Number of tabs on the line the parser is currently at, up to the current rune.
+	lineTabs   int
+	columnFrom int
+	tabWidth   int
+	// Set while looking ahead, when the runes of the tokens are still needed once the parser is restored.
+	peeking bool
 
 	previous Token
 	current  Token
 }
 
 func NewParser(source []rune) *Parser {
+	return NewParserWithOptions(source, ParserOptions{TabWidth: DefaultTabWidth})
+}
+
+func NewParserWithOptions(source []rune, options ParserOptions) *Parser {
+	return newParser(newSource(source), options)
+}
+
+// Returns a parser which reads the source from the reader as it produces tokens.
+func NewParserReader(reader io.RuneReader, options ParserOptions) *Parser {
+	return newParser(newReaderSource(reader), options)
+}
+
+func newParser(source *source, options ParserOptions) *Parser {
+	from := source.start()
+
+	tabWidth := options.TabWidth
+	if tabWidth < 1 {
+		tabWidth = DefaultTabWidth
+	}
+
 	return &Parser{
-		source:   source,
-		from:     0,
-		at:       0,
-		lineFrom: 1,
-		lineTo:   1,
+		source:     source,
+		from:       from,
+		at:         from,
+		lineFrom:   1,
+		lineTo:     1,
+		lineStart:  from,
+		lineTabs:   0,
+		columnFrom: 1,
+		tabWidth:   tabWidth,
+		peeking:    false,
 	}
 }
 
+// Returns the token NextToken would return, without consuming it.
+func (p *Parser) PeekToken() Token {
+	return p.PeekTokens(1)[0]
+}
+
+// Returns the tokens the next count calls of NextToken would return, without consuming them.
+func (p *Parser) PeekTokens(count int) []Token {
+	saved := *p
+	p.peeking = true
+
+	tokens := make([]Token, 0, count)
+	for i := 0; i < count; i++ {
+		tokens = append(tokens, p.NextToken())
+	}
+
+	*p = saved
+
+	return tokens
+}
+
 func (p *Parser) NextToken() Token {
+	// Nothing before the token can be needed again, not even by a parser restored after PeekTokens
+	if !p.peeking {
+		p.source.discard(p.at)
+	}
+
 	p.skipWhitespace()
 
+	p.from = p.at
+	p.lineFrom = p.lineTo
+	p.columnFrom = p.column()
+
 	if p.isAtEnd() {
+		if err := p.source.err; err != nil {
+			p.source.err = nil
+
+			return p.error("Cannot read source: " + err.Error())
+		}
+
 		return p.eof()
 	}
 
-	p.from = p.at
-	p.lineFrom = p.lineTo
-
 	r := p.advance()
 	if isAlpha(r) {
 		return p.identifier()
@@ -64,6 +136,13 @@ func (p *Parser) NextToken() Token {
 	case ',':
 		return p.makeToken(Comma)
 	case '.':
+		if p.peek() == '.' && p.peekNext() == '.' {
+			p.advance()
+			p.advance()
+
+			return p.makeToken(DotDotDot)
+		}
+
 		return p.makeToken(Dot)
 	case '-':
 		return p.makeToken(Minus)
@@ -99,6 +178,17 @@ func (p *Parser) NextToken() Token {
 		return p.string()
 	case '\n':
 		return p.newline()
+	case '\r':
+		// A CRLF line ending is a single newline, lone carriage returns are skipped as whitespace
+		p.match('\n')
+		return p.newline()
+	case invalidRune:
+		return p.error("Invalid UTF-8 in source.")
+	}
+
+	// Skip the whole run of unexpected characters so they produce only one error
+	for !p.isAtEnd() && isUnexpected(p.peek()) {
+		p.advance()
 	}
 
 	return p.error("Unexpected character.")
@@ -137,6 +227,10 @@ func (p *Parser) SetCurrent(token Token) {
 }
 
 func (p *Parser) number() Token {
+	if p.source.at(p.from) == '0' && (p.peek() == 'x' || p.peek() == 'X') && isHexDigit(p.peekNext()) {
+		return p.hexNumber()
+	}
+
 	for isDigit(p.peek()) {
 		p.advance()
 	}
@@ -151,16 +245,73 @@ func (p *Parser) number() Token {
 		}
 	}
 
+	if (p.peek() == 'e' || p.peek() == 'E') && !p.exponent() {
+		return p.error("Malformed exponent.")
+	}
+
 	return p.makeToken(Number)
 }
 
+// Scans a hexadecimal number like '0x1F'. A fractional part like in '0x1.8p1' requires a binary exponent.
+func (p *Parser) hexNumber() Token {
+	// Consume the "x"
+	p.advance()
+
+	for isHexDigit(p.peek()) {
+		p.advance()
+	}
+
+	fraction := false
+	if p.peek() == '.' && isHexDigit(p.peekNext()) {
+		fraction = true
+		p.advance()
+
+		for isHexDigit(p.peek()) {
+			p.advance()
+		}
+	}
+
+	if p.peek() == 'p' || p.peek() == 'P' {
+		if !p.exponent() {
+			return p.error("Malformed exponent.")
+		}
+	} else if fraction {
+		return p.error("Hexadecimal fraction requires an exponent.")
+	}
+
+	return p.makeToken(Number)
+}
+
+// Consumes an exponent like 'e-3' and returns false if it has no digits.
+func (p *Parser) exponent() bool {
+	// Consume the "e" or "p"
+	p.advance()
+
+	if p.peek() == '+' || p.peek() == '-' {
+		p.advance()
+	}
+
+	if !isDigit(p.peek()) {
+		return false
+	}
+
+	for isDigit(p.peek()) {
+		p.advance()
+	}
+
+	return true
+}
+
 func (p *Parser) string() Token {
+	valid := true
+
 	for p.peek() != '"' && !p.isAtEnd() {
-		if p.peek() == '\n' {
+		switch p.advance() {
+		case '\n':
 			p.newline()
+		case invalidRune:
+			valid = false
 		}
-
-		p.advance()
 	}
 
 	if p.isAtEnd() {
@@ -170,6 +321,10 @@ func (p *Parser) string() Token {
 	// The closing "
 	p.advance()
 
+	if !valid {
+		return p.error("Invalid UTF-8 in source.")
+	}
+
 	return p.makeToken(String)
 }
 
@@ -178,7 +333,7 @@ func (p *Parser) identifier() Token {
 		p.advance()
 	}
 
-	if tokenType, ok := keywords[string(p.source[p.from:p.at])]; ok {
+	if tokenType, ok := keywords[string(p.source.slice(p.from, p.at))]; ok {
 		return p.makeToken(tokenType)
 	}
 
@@ -188,26 +343,34 @@ func (p *Parser) identifier() Token {
 func (p *Parser) makeToken(tokenType TokenType) Token {
 	switch tokenType {
 	case Newline:
-		return NewToken(tokenType, "<Newline>", p.lineFrom)
+		return newTokenRange(tokenType, "<Newline>", p.lineFrom, p.columnFrom, p.lineTo, p.column())
 	case Eof:
-		return NewToken(tokenType, "<Eof>", p.lineFrom)
+		return newTokenRange(tokenType, "<Eof>", p.lineFrom, p.columnFrom, p.lineTo, p.column())
 	default:
-		return NewToken(tokenType, string(p.source[p.from:p.at]), p.lineFrom)
+		return newTokenRange(tokenType, string(p.source.slice(p.from, p.at)), p.lineFrom, p.columnFrom, p.lineTo, p.column())
 	}
 }
 
+// Returns the column of the rune the parser is at.
+func (p *Parser) column() int {
+	return p.at - p.lineStart + p.lineTabs*(p.tabWidth-1) + 1
+}
+
 func (p *Parser) eof() Token {
 	return p.makeToken(Eof)
 }
 
 func (p *Parser) newline() Token {
 	p.lineTo++
+	p.lineStart = p.at
+	p.lineTabs = 0
 
 	return p.makeToken(Newline)
 }
 
+// Returns an error token spanning the runes consumed since the start of the token.
 func (p *Parser) error(message string) Token {
-	return NewToken(Error, message, p.lineFrom)
+	return newTokenRange(Error, message, p.lineFrom, p.columnFrom, p.lineTo, p.column())
 }
 
 func (p *Parser) advance() rune {
@@ -215,9 +378,14 @@ func (p *Parser) advance() rune {
 		return 0
 	}
 
+	r := p.source.at(p.at)
 	p.at++
 
-	return p.source[p.at-1]
+	if r == '\t' {
+		p.lineTabs++
+	}
+
+	return r
 }
 
 func (p *Parser) peek() rune {
@@ -225,7 +393,7 @@ func (p *Parser) peek() rune {
 		return 0
 	}
 
-	return p.source[p.at]
+	return p.source.at(p.at)
 }
 
 func (p *Parser) peekNext() rune {
@@ -233,7 +401,7 @@ func (p *Parser) peekNext() rune {
 		return 0
 	}
 
-	return p.source[p.at+1]
+	return p.source.at(p.at + 1)
 }
 
 func (p *Parser) match(expected rune) bool {
@@ -250,11 +418,16 @@ func (p *Parser) match(expected rune) bool {
 }
 
 func (p *Parser) isAtEnd() bool {
-	return len(p.source) == p.at
+	return !p.source.has(p.at)
 }
 
 func (p *Parser) isBeforeTheEnd() bool {
-	return len(p.source) == p.at+1
+	return !p.source.has(p.at + 1)
+}
+
+// Returns whether the current rune starts a line ending, either LF or CRLF.
+func (p *Parser) isAtLineEnd() bool {
+	return p.peek() == '\n' || p.peek() == '\r' && p.peekNext() == '\n'
 }
 
 func (p *Parser) skipWhitespace() {
@@ -262,12 +435,18 @@ func (p *Parser) skipWhitespace() {
 		r := p.peek()
 
 		switch r {
-		case ' ', '\r', '\t':
+		case ' ', '\t':
+			p.advance()
+		case '\r':
+			if p.isAtLineEnd() {
+				return
+			}
+
 			p.advance()
 		case '/':
 			if p.peekNext() == '/' {
 				// A comment goes until the end of the line
-				for p.peek() != '\n' && !p.isAtEnd() {
+				for !p.isAtLineEnd() && !p.isAtEnd() {
 					p.advance()
 				}
 			} else {
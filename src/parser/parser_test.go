@@ -0,0 +1,317 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLeadingBomIsStripped(t *testing.T) {
+	p := NewParser([]rune("\uFEFFvar a = 1"))
+
+	token := p.NextToken()
+	if token.Type() != Var {
+		t.Fatalf("Expected 'var' token, got %v", token)
+	}
+
+	if token.Line() != 1 || token.Column() != 1 {
+		t.Errorf("Expected token at 1:1, got %d:%d", token.Line(), token.Column())
+	}
+}
+
+func TestInvalidUtf8InStringIsError(t *testing.T) {
+	p := NewParser(Runes("var s = \"a\xffb\"\ns"))
+
+	tokens := p.GetTokens()
+
+	if tokens[3].Type() != Error || tokens[3].Lexeme() != "Invalid UTF-8 in source." {
+		t.Fatalf("Expected invalid UTF-8 error, got %v", tokens[3])
+	}
+
+	if tokens[4].Type() != Newline || tokens[5].Type() != Identifier || tokens[5].Line() != 2 {
+		t.Errorf("Expected tokenizing to continue after the string, got %v", tokens[4:])
+	}
+}
+
+func TestInvalidUtf8OutsideStringIsError(t *testing.T) {
+	p := NewParser(Runes("1 \xff 2"))
+
+	tokens := p.GetTokens()
+
+	if tokens[1].Type() != Error || tokens[1].Lexeme() != "Invalid UTF-8 in source." {
+		t.Errorf("Expected invalid UTF-8 error, got %v", tokens[1])
+	}
+}
+
+func TestReplacementCharacterIsValid(t *testing.T) {
+	parsers := []*Parser{
+		NewParser(Runes("var s = \"a\uFFFDb\"")),
+		NewParserReader(strings.NewReader("var s = \"a\uFFFDb\""), ParserOptions{}),
+	}
+
+	for _, p := range parsers {
+		tokens := p.GetTokens()
+
+		if tokens[3].Type() != String || tokens[3].Lexeme() != "\"a\uFFFDb\"" {
+			t.Errorf("Expected string with the replacement character, got %v", tokens[3])
+		}
+	}
+}
+
+func TestInvalidUtf8FromReaderIsError(t *testing.T) {
+	p := NewParserReader(strings.NewReader("1 \xff 2"), ParserOptions{})
+
+	tokens := p.GetTokens()
+
+	if tokens[1].Type() != Error || tokens[1].Lexeme() != "Invalid UTF-8 in source." {
+		t.Errorf("Expected invalid UTF-8 error, got %v", tokens[1])
+	}
+}
+
+func TestColumnsAreCountedInRunes(t *testing.T) {
+	p := NewParser([]rune("var ž = \"čau\"\n  ž + 1"))
+
+	expected := []struct {
+		tokenType TokenType
+		line      int
+		column    int
+	}{
+		{Var, 1, 1},
+		{Identifier, 1, 5},
+		{Equal, 1, 7},
+		{String, 1, 9},
+		{Newline, 1, 14},
+		{Identifier, 2, 3},
+		{Plus, 2, 5},
+		{Number, 2, 7},
+		{Eof, 2, 8},
+	}
+
+	for _, e := range expected {
+		token := p.NextToken()
+
+		if token.Type() != e.tokenType || token.Line() != e.line || token.Column() != e.column {
+			t.Errorf("Expected %v at %d:%d, got %v at %d:%d", e.tokenType, e.line, e.column, token, token.Line(), token.Column())
+		}
+	}
+}
+
+type position struct {
+	tokenType TokenType
+	line      int
+	column    int
+}
+
+func assertPositions(t *testing.T, p *Parser, expected []position) {
+	t.Helper()
+
+	for _, e := range expected {
+		token := p.NextToken()
+
+		if token.Type() != e.tokenType || token.Line() != e.line || token.Column() != e.column {
+			t.Errorf("Expected %v at %d:%d, got %v at %d:%d", e.tokenType, e.line, e.column, token, token.Line(), token.Column())
+		}
+	}
+}
+
+func TestTabWidth(t *testing.T) {
+	source := []rune("{\n\tvar a = 1\n\t\ta\t+ 1\n}")
+
+	assertPositions(t, NewParser(source), []position{
+		{LeftBrace, 1, 1},
+		{Newline, 1, 2},
+		{Var, 2, 2},
+		{Identifier, 2, 6},
+		{Equal, 2, 8},
+		{Number, 2, 10},
+		{Newline, 2, 11},
+		{Identifier, 3, 3},
+		{Plus, 3, 5},
+	})
+
+	assertPositions(t, NewParserWithOptions(source, ParserOptions{TabWidth: 4}), []position{
+		{LeftBrace, 1, 1},
+		{Newline, 1, 2},
+		{Var, 2, 5},
+		{Identifier, 2, 9},
+		{Equal, 2, 11},
+		{Number, 2, 13},
+		{Newline, 2, 14},
+		{Identifier, 3, 9},
+		{Plus, 3, 14},
+		{Number, 3, 16},
+		{Newline, 3, 17},
+		{RightBrace, 4, 1},
+	})
+}
+
+func TestCrlfLineEndings(t *testing.T) {
+	p := NewParser([]rune("var a = 1\r\n// comment\r\n\r\na\r + \"b\r\nc\"\r\n"))
+
+	assertPositions(t, p, []position{
+		{Var, 1, 1},
+		{Identifier, 1, 5},
+		{Equal, 1, 7},
+		{Number, 1, 9},
+		{Newline, 1, 10},
+		{Newline, 2, 11},
+		{Newline, 3, 1},
+		{Identifier, 4, 1},
+		{Plus, 4, 4},
+		{String, 4, 6},
+		{Newline, 5, 3},
+		{Eof, 6, 1},
+	})
+}
+
+func TestRunOfUnexpectedCharactersIsOneError(t *testing.T) {
+	p := NewParser([]rune("1 $#~ 2"))
+
+	tokens := p.GetTokens()
+
+	expected := []TokenType{Number, Error, Number, Eof}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %v", len(expected), tokens)
+	}
+
+	for i := range expected {
+		if tokens[i].Type() != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, tokens)
+		}
+	}
+
+	if tokens[1].Lexeme() != "Unexpected character." || tokens[1].Column() != 3 {
+		t.Errorf("Expected unexpected character error at column 3, got %v at %d", tokens[1], tokens[1].Column())
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	p := NewParser([]rune("\n// A comment\n//go-blue:strict\n  //go-blue:other trailing\nvar a = 1\n//go-blue:late"))
+
+	directives := p.Directives()
+
+	if len(directives) != 2 {
+		t.Fatalf("Expected 2 directives, got %v", directives)
+	}
+
+	if directives[0].Name() != "strict" || directives[0].Line() != 3 {
+		t.Errorf("Expected strict at line 3, got %s at %d", directives[0].Name(), directives[0].Line())
+	}
+
+	if directives[1].Name() != "other" || directives[1].Line() != 4 {
+		t.Errorf("Expected other at line 4, got %s at %d", directives[1].Name(), directives[1].Line())
+	}
+
+	if token := p.NextToken(); token.Type() != Newline {
+		t.Errorf("Expected scanning from the start, got %v", token)
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	tests := []struct {
+		source    string
+		tokenType TokenType
+		lexeme    string
+	}{
+		{"1e10", Number, "1e10"},
+		{"1.5e-3", Number, "1.5e-3"},
+		{"2E3", Number, "2E3"},
+		{"2e+3", Number, "2e+3"},
+		{"0x1F", Number, "0x1F"},
+		{"0x1p-2", Number, "0x1p-2"},
+		{"0X1.8P1", Number, "0X1.8P1"},
+		{"1e", Error, "Malformed exponent."},
+		{"1e+", Error, "Malformed exponent."},
+		{"0x1p", Error, "Malformed exponent."},
+		{"0x1.8", Error, "Hexadecimal fraction requires an exponent."},
+	}
+
+	for _, test := range tests {
+		token := NewParser([]rune(test.source)).NextToken()
+
+		if token.Type() != test.tokenType || token.Lexeme() != test.lexeme {
+			t.Errorf("Expected %v '%s' for '%s', got %v", test.tokenType, test.lexeme, test.source, token)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) ReadRune() (rune, int, error) {
+	return 0, 0, errors.New("disk on fire")
+}
+
+func TestReaderProducesSameTokens(t *testing.T) {
+	source := "\uFEFF//go-blue:strict\nvar s = \"multi\nline\"\r\n\tfn f(a) { return a * 0x10 }\n"
+
+	expected := NewParser([]rune(source))
+	actual := NewParserReader(bufio.NewReader(iotest.OneByteReader(strings.NewReader(source))), ParserOptions{})
+
+	if d := actual.Directives(); len(d) != 1 || d[0].Name() != "strict" {
+		t.Errorf("Expected strict directive, got %v", d)
+	}
+
+	for {
+		e := expected.NextToken()
+		a := actual.NextToken()
+
+		if e != a {
+			t.Fatalf("Expected %v at %d:%d, got %v at %d:%d", e, e.Line(), e.Column(), a, a.Line(), a.Column())
+		}
+
+		if e.Type() == Eof {
+			break
+		}
+	}
+}
+
+func TestReaderKeepsOnlyCurrentLine(t *testing.T) {
+	line := "var a = 1 + 2 // comment\n"
+	source := strings.Repeat(line, 1000)
+
+	p := NewParserReader(strings.NewReader(source), ParserOptions{})
+
+	for token := p.NextToken(); token.Type() != Eof; token = p.NextToken() {
+		if len(p.source.runes) > len(line) {
+			t.Fatalf("Expected at most %d buffered runes, got %d after %v", len(line), len(p.source.runes), token)
+		}
+	}
+}
+
+func TestReaderErrorIsErrorToken(t *testing.T) {
+	p := NewParserReader(failingReader{}, ParserOptions{})
+
+	if token := p.NextToken(); token.Type() != Error || token.Lexeme() != "Cannot read source: disk on fire" {
+		t.Errorf("Expected read error, got %v", token)
+	}
+
+	if token := p.NextToken(); token.Type() != Eof {
+		t.Errorf("Expected end after read error, got %v", token)
+	}
+}
+
+func TestPeekTokensDoesNotConsume(t *testing.T) {
+	source := "outer: while a"
+
+	parsers := []*Parser{
+		NewParser([]rune(source)),
+		NewParserReader(strings.NewReader(source), ParserOptions{}),
+	}
+
+	for _, p := range parsers {
+		first := p.NextToken()
+
+		peeked := p.PeekTokens(3)
+		if len(peeked) != 3 || peeked[0].Type() != Colon || peeked[1].Type() != While || peeked[2].Lexeme() != "a" {
+			t.Fatalf("Expected ':', 'while' and 'a' after %v, got %v", first, peeked)
+		}
+
+		for _, expected := range peeked {
+			if token := p.NextToken(); token != expected {
+				t.Errorf("Expected %v after peeking, got %v", expected, token)
+			}
+		}
+	}
+}
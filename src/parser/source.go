@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// Stands for a byte of the source which is not valid UTF-8. Unlike utf8.RuneError, which valid source may contain as
+// the replacement character, no valid source can contain it.
+const invalidRune rune = -1
+
+// Decodes the source into runes for NewParser, turning bytes which are not valid UTF-8 into runes the parser reports
+// as invalid. Converting malformed source with []rune would make them indistinguishable from the replacement
+// character.
+func Runes(source string) []rune {
+	runes := make([]rune, 0, len(source))
+
+	for len(source) > 0 {
+		r, size := utf8.DecodeRuneInString(source)
+		runes = append(runes, decoded(r, size))
+		source = source[size:]
+	}
+
+	return runes
+}
+
+// Returns the decoded rune of the given size in bytes, or invalidRune if it was not valid UTF-8.
+func decoded(r rune, size int) rune {
+	if r == utf8.RuneError && size == 1 {
+		return invalidRune
+	}
+
+	return r
+}
+
+// source holds the runes of the code being parsed, indexed from the start of the code. A source read from a reader
+// pulls runes from it only when they are needed and drops the runes already turned into tokens, so the whole code
+// is never held in memory at once.
+type source struct {
+	reader io.RuneReader
+	// Error the reader failed with, other than the end of the input.
+	err error
+
+	runes []rune
+	// Index of the first rune in runes.
+	base int
+}
+
+func newSource(runes []rune) *source {
+	return &source{
+		reader: nil,
+		err:    nil,
+
+		runes: runes,
+		base:  0,
+	}
+}
+
+func newReaderSource(reader io.RuneReader) *source {
+	return &source{
+		reader: reader,
+		err:    nil,
+
+		runes: make([]rune, 0),
+		base:  0,
+	}
+}
+
+// Returns whether the rune at the given index exists, reading it if necessary.
+func (s *source) has(index int) bool {
+	for s.reader != nil && index >= s.base+len(s.runes) {
+		r, size, err := s.reader.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+
+			s.reader = nil
+			break
+		}
+
+		s.runes = append(s.runes, decoded(r, size))
+	}
+
+	return index < s.base+len(s.runes)
+}
+
+// Returns the index of the first rune of the code, which follows the byte order mark if there is one.
+func (s *source) start() int {
+	if s.has(0) && s.at(0) == bom {
+		return 1
+	}
+
+	return 0
+}
+
+func (s *source) at(index int) rune {
+	return s.runes[index-s.base]
+}
+
+func (s *source) slice(from int, to int) []rune {
+	return s.runes[from-s.base : to-s.base]
+}
+
+// Drops the runes before the given index, which will not be needed anymore. Sources which are not read from a reader
+// keep all of their runes.
+func (s *source) discard(index int) {
+	if s.reader == nil || index <= s.base {
+		return
+	}
+
+	s.runes = append(s.runes[:0], s.runes[index-s.base:]...)
+	s.base = index
+}
@@ -1,16 +1,34 @@
 package parser
 
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
 type Token struct {
 	tokenType TokenType
 	lexeme    string
 	line      int
+	// Column of the first rune of the token, counted in runes from 1.
+	column int
+	// Position following the last rune of the token, which is on a later line if the token spans more lines.
+	endLine   int
+	endColumn int
+}
+
+// Returns a token ending on its line right after the runes of the lexeme.
+func NewToken(tokenType TokenType, lexeme string, line int, column int) Token {
+	return newTokenRange(tokenType, lexeme, line, column, line, column+utf8.RuneCountInString(lexeme))
 }
 
-func NewToken(tokenType TokenType, lexeme string, line int) Token {
+func newTokenRange(tokenType TokenType, lexeme string, line int, column int, endLine int, endColumn int) Token {
 	return Token{
 		tokenType: tokenType,
 		lexeme:    lexeme,
 		line:      line,
+		column:    column,
+		endLine:   endLine,
+		endColumn: endColumn,
 	}
 }
 
@@ -26,6 +44,19 @@ func (t Token) Line() int {
 	return t.line
 }
 
+func (t Token) Column() int {
+	return t.column
+}
+
+func (t Token) EndLine() int {
+	return t.endLine
+}
+
+// Returns the column following the last rune of the token.
+func (t Token) EndColumn() int {
+	return t.endColumn
+}
+
 func (t Token) String() string {
-	return "Token{" + string(t.tokenType) + "<" + t.lexeme + ">}"
+	return "Token{" + strconv.Itoa(int(t.tokenType)) + "<" + t.lexeme + ">}"
 }
@@ -22,9 +22,10 @@ const (
 	Slash
 	Star
 
-	// One or two character tokens
+	// One or more character tokens
 	Bang
 	BangEqual
+	DotDotDot
 	Equal
 	EqualEqual
 	Greater
@@ -42,8 +43,11 @@ const (
 	Assert
 	Break
 	Class
+	Continue
+	Do
 	Echo
 	Else
+	Enum
 	False
 	Fn
 	For
@@ -52,6 +56,7 @@ const (
 	Import
 	Nil
 	Or
+	Pass
 	Return
 	True
 	Var
@@ -1,11 +1,21 @@
 package parser
 
-import "unicode"
+import (
+	"strings"
+	"unicode"
+)
+
+// Characters which start a token or are skipped as whitespace.
+const expectedCharacters = "()[]{};@^:,.-+%/*!=<>\"\n \r\t"
 
 func isDigit(r rune) bool {
 	return unicode.IsDigit(r)
 }
 
+func isHexDigit(r rune) bool {
+	return (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
 func isLetter(r rune) bool {
 	return unicode.IsLetter(r)
 }
@@ -13,3 +23,7 @@ func isLetter(r rune) bool {
 func isAlpha(r rune) bool {
 	return isLetter(r) || r == '_'
 }
+
+func isUnexpected(r rune) bool {
+	return !isAlpha(r) && !isDigit(r) && r != invalidRune && !strings.ContainsRune(expectedCharacters, r)
+}
@@ -0,0 +1,110 @@
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/adamjedlicka/go-blu/src/compiler"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"github.com/adamjedlicka/go-blu/src/vm"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Repl evaluates the input line by line in a single VM, so globals are kept between the lines.
+type Repl struct {
+	machine vm.VM
+}
+
+func NewRepl(options compiler.CompilerOptions) *Repl {
+	// Lines commonly redefine what earlier lines defined
+	options.AllowGlobalRedeclaration = true
+
+	machine := vm.NewVM()
+	machine.SetCompilerOptions(options)
+	// A literal repeated on many lines is kept only once
+	machine.SetInterner(value.NewInterner())
+
+	return &Repl{
+		machine: machine,
+	}
+}
+
+// Reads lines from the input until it ends, printing results to out and runtime errors to errOut.
+// Compile errors are already reported by the compiler.
+func (r *Repl) Run(in io.Reader, out io.Writer, errOut io.Writer) error {
+	reader := bufio.NewReader(in)
+
+	for true {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		if command := strings.Fields(line); len(command) > 0 && command[0] == ":doc" {
+			r.doc(command[1:], out, errOut)
+			continue
+		}
+
+		result, err := r.machine.Exec(line)
+		if err != nil {
+			if _, ok := err.(*vm.RuntimeError); ok {
+				_, _ = fmt.Fprintln(errOut, err)
+			}
+
+			continue
+		}
+
+		if formatted := r.FormatResult(result); formatted != "" {
+			_, _ = fmt.Fprintln(out, formatted)
+		}
+	}
+
+	return nil
+}
+
+// Prints the documentation of the named global functions, or of all natives if no name is given.
+func (r *Repl) doc(names []string, out io.Writer, errOut io.Writer) {
+	if len(names) == 0 {
+		for _, native := range r.machine.Natives() {
+			doc, _ := vm.Doc(value.NativeVal(native))
+			_, _ = fmt.Fprintln(out, doc)
+		}
+
+		return
+	}
+
+	for _, name := range names {
+		fn, ok := r.machine.Global(name)
+		if !ok {
+			_, _ = fmt.Fprintf(errOut, "Undefined global variable '%s'\n", name)
+			continue
+		}
+
+		doc, ok := vm.Doc(fn)
+		if !ok {
+			_, _ = fmt.Fprintf(errOut, "'%s' is not a function, got %s.\n", name, value.TypeName(fn))
+			continue
+		}
+
+		_, _ = fmt.Fprintln(out, doc)
+	}
+}
+
+// Returns the result of a line as shown to the user. Unlike String it quotes strings so they can be told apart
+// from other values, and nil gives an empty string so statements print nothing.
+func (r *Repl) FormatResult(result value.Value) string {
+	if value.IsNil(result) {
+		return ""
+	}
+
+	if value.IsObject(result) {
+		if str, ok := value.AsObject(result).(value.String); ok {
+			return strconv.Quote(string(str))
+		}
+	}
+
+	return result.String()
+}
@@ -0,0 +1,159 @@
+package repl
+
+import (
+	"bytes"
+	"github.com/adamjedlicka/go-blu/src/compiler"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestFormatResult(t *testing.T) {
+	r := NewRepl(compiler.CompilerOptions{})
+
+	tests := []struct {
+		result   value.Value
+		expected string
+	}{
+		{value.StringVal("hello"), `"hello"`},
+		{value.StringVal("say \"hi\"\n"), `"say \"hi\"\n"`},
+		{value.NumberVal(1.5), "1.5"},
+		{value.TrueVal(), "true"},
+		{value.NilVal(), ""},
+	}
+
+	for _, test := range tests {
+		if formatted := r.FormatResult(test.result); formatted != test.expected {
+			t.Errorf("Expected '%s' for %v, got '%s'", test.expected, test.result, formatted)
+		}
+	}
+
+	if str := value.StringVal("hello"); str.String() != "hello" {
+		t.Errorf("Expected string itself to be unquoted, got '%s'", str.String())
+	}
+}
+
+func TestRun(t *testing.T) {
+	r := NewRepl(compiler.CompilerOptions{})
+
+	var out, errOut bytes.Buffer
+
+	in := strings.NewReader("var a = \"ab\"\na * 2\nvar b = nil\nb\n1 + 2\nb()\na")
+	if err := r.Run(in, &out, &errOut); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "\"abab\"\n3\n\"ab\"\n" {
+		t.Errorf("Unexpected output '%s'", out.String())
+	}
+
+	if !strings.HasPrefix(errOut.String(), "Can only call functions and natives, got nil.") {
+		t.Errorf("Expected runtime error, got '%s'", errOut.String())
+	}
+}
+
+func TestLastExpressionOfLineIsPrinted(t *testing.T) {
+	r := NewRepl(compiler.CompilerOptions{})
+
+	var out, errOut bytes.Buffer
+
+	in := strings.NewReader("var a = 1; a + 1\nvar b = 2\nfn f() { return }\nf()\nb; a\n")
+	if err := r.Run(in, &out, &errOut); err != nil {
+		t.Fatal(err)
+	}
+
+	// A nil result, like the one of f(), is not printed
+	if out.String() != "2\n1\n" || errOut.String() != "" {
+		t.Errorf("Expected 2 and 1, got '%s' and errors '%s'", out.String(), errOut.String())
+	}
+}
+
+func TestDiscardedResultIsNotPrinted(t *testing.T) {
+	r := NewRepl(compiler.CompilerOptions{})
+
+	var out, errOut bytes.Buffer
+
+	in := strings.NewReader("fn f() { return \"result\" }\n_ = f()\nf()\n_ = { f() }\n")
+	if err := r.Run(in, &out, &errOut); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "\"result\"\n" || errOut.String() != "" {
+		t.Errorf("Expected only the result of f(), got '%s' and errors '%s'", out.String(), errOut.String())
+	}
+}
+
+func TestLineCanRedeclareGlobal(t *testing.T) {
+	r := NewRepl(compiler.CompilerOptions{})
+
+	var out, errOut bytes.Buffer
+
+	in := strings.NewReader("var a = 1; var a = a + 1\na\n")
+	if err := r.Run(in, &out, &errOut); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "2\n" || errOut.String() != "" {
+		t.Errorf("Expected 2, got '%s' and errors '%s'", out.String(), errOut.String())
+	}
+}
+
+func TestDocCommand(t *testing.T) {
+	r := NewRepl(compiler.CompilerOptions{})
+
+	var out, errOut bytes.Buffer
+
+	in := strings.NewReader("fn f(a) {}\n:doc typeof f\n:doc g\nvar n = 1\n:doc n\n")
+	if err := r.Run(in, &out, &errOut); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "typeof(1): Returns the name of the type of the argument.\nf(1)\n" {
+		t.Errorf("Unexpected output '%s'", out.String())
+	}
+
+	if errOut.String() != "Undefined global variable 'g'\n'n' is not a function, got number.\n" {
+		t.Errorf("Unexpected errors '%s'", errOut.String())
+	}
+
+	out.Reset()
+	if err := r.Run(strings.NewReader(":doc\n"), &out, &errOut); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(out.String(), "arity(1): ") || strings.Count(out.String(), "\n") != len(r.machine.Natives()) {
+		t.Errorf("Expected all natives, got '%s'", out.String())
+	}
+}
+
+func TestStringLiteralsAreSharedAcrossLines(t *testing.T) {
+	r := NewRepl(compiler.CompilerOptions{})
+
+	var out, errOut bytes.Buffer
+
+	in := strings.NewReader("var a = \"shared literal\"\nvar b = \"shared \" + \"literal\"\nvar c = \"other\"\n")
+	if err := r.Run(in, &out, &errOut); err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := r.machine.Global("a")
+	b, _ := r.machine.Global("b")
+	c, _ := r.machine.Global("c")
+
+	if stringData(a) != stringData(b) {
+		t.Errorf("Expected %v and %v to share the interned string", a, b)
+	}
+
+	if stringData(a) == stringData(c) {
+		t.Errorf("Expected %v and %v to be different strings", a, c)
+	}
+}
+
+// Returns the address of the bytes of the string value.
+func stringData(val value.Value) uintptr {
+	str := string(value.AsObject(val).(value.String))
+
+	return (*reflect.StringHeader)(unsafe.Pointer(&str)).Data
+}
@@ -0,0 +1,23 @@
+package value
+
+// Interner keeps a single copy of every string given to it, so equal strings share their storage.
+type Interner struct {
+	strings map[string]String
+}
+
+func NewInterner() *Interner {
+	return &Interner{
+		strings: make(map[string]String),
+	}
+}
+
+// Returns the copy of the string kept by the interner, storing the string if it is the first one with its contents.
+func (i *Interner) Intern(str String) String {
+	if interned, ok := i.strings[string(str)]; ok {
+		return interned
+	}
+
+	i.strings[string(str)] = str
+
+	return str
+}
@@ -0,0 +1,59 @@
+package value
+
+// Signature of functions implemented in Go which can be called from scripts.
+// The arguments slice is only valid for the duration of the call.
+type NativeFn func(args []Value) (Value, error)
+
+type Native struct {
+	name string
+	// Number of arguments the function expects, or -1 if it accepts any number of them.
+	arity int
+	// Description of what the function does, empty if it is not documented.
+	doc string
+	fn  NativeFn
+}
+
+func NewNative(name string, arity int, fn NativeFn) *Native {
+	return NewDocumentedNative(name, arity, "", fn)
+}
+
+func NewDocumentedNative(name string, arity int, doc string, fn NativeFn) *Native {
+	return &Native{
+		name:  name,
+		arity: arity,
+		doc:   doc,
+		fn:    fn,
+	}
+}
+
+func NativeVal(native *Native) Value {
+	return ObjectVal(native)
+}
+
+func (n *Native) Name() string {
+	return n.name
+}
+
+func (n *Native) Arity() int {
+	return n.arity
+}
+
+func (n *Native) Doc() string {
+	return n.doc
+}
+
+func (n *Native) Call(args []Value) (Value, error) {
+	return n.fn(args)
+}
+
+func (n *Native) IsTruthy() bool {
+	return true
+}
+
+func (n *Native) ToString() string {
+	return "<native fn " + n.name + ">"
+}
+
+func (n *Native) TypeName() string {
+	return "native"
+}
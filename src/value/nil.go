@@ -1,5 +1,25 @@
 package value
 
+// Nil is the Go counterpart of the nil value. Inside Value nil is only a tag, but AsObject returns Nil for it, so
+// type switches and type assertions match nil as a case of its own rather than a Go nil interface.
+type Nil struct{}
+
+func (Nil) IsTruthy() bool {
+	return false
+}
+
+func (n Nil) ToString() string {
+	return n.String()
+}
+
+func (Nil) TypeName() string {
+	return "nil"
+}
+
+func (Nil) String() string {
+	return "nil"
+}
+
 func NilVal() Value {
 	return Value{
 		value:  tagNil,
@@ -1,8 +1,20 @@
 package value
 
+import "math"
+
+// The quiet NaN every NaN is stored as. Other NaNs could have the bits of the tags set and be taken for other values.
+var canonicalNaN = math.Float64bits(math.NaN())
+
 func NumberVal(number float64) Value {
+	if number != number {
+		return Value{
+			value:  uintptr(canonicalNaN),
+			object: nil,
+		}
+	}
+
 	return Value{
-		value:  uintptr(number),
+		value:  uintptr(math.Float64bits(number)),
 		object: nil,
 	}
 }
@@ -12,5 +24,5 @@ func IsNumber(value Value) bool {
 }
 
 func AsNumber(value Value) float64 {
-	return float64(value.value)
+	return math.Float64frombits(uint64(value.value))
 }
@@ -3,9 +3,16 @@ package value
 type Object interface {
 	IsTruthy() bool
 	ToString() string
+	// Name of the type of the object as shown to the user in error messages.
+	TypeName() string
 }
 
+// Returns the value of the object. Nil becomes the nil value, so ObjectVal(AsObject(v)) is v for nil too.
 func ObjectVal(object Object) Value {
+	if _, ok := object.(Nil); ok {
+		return NilVal()
+	}
+
 	return Value{
 		value:  qNaN | signBit,
 		object: object,
@@ -16,6 +23,11 @@ func IsObject(value Value) bool {
 	return value.object != nil
 }
 
+// Returns the object of the value, Nil for nil. Booleans and numbers have no object.
 func AsObject(value Value) Object {
+	if IsNil(value) {
+		return Nil{}
+	}
+
 	return value.object
 }
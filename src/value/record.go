@@ -0,0 +1,95 @@
+package value
+
+import "strings"
+
+// Record has a fixed set of named fields, kept in the order they were written in. Values of the fields can change,
+// but fields cannot be added or removed.
+type Record struct {
+	names  []String
+	values []Value
+}
+
+func NewRecord(names []String, values []Value) *Record {
+	return &Record{
+		names:  names,
+		values: values,
+	}
+}
+
+func RecordVal(record *Record) Value {
+	return ObjectVal(record)
+}
+
+// Returns the names of the fields in the order they were written in.
+func (r *Record) Fields() []String {
+	return r.names
+}
+
+// Returns the value of the field and whether the record has it.
+func (r *Record) Get(name String) (Value, bool) {
+	for i, field := range r.names {
+		if field == name {
+			return r.values[i], true
+		}
+	}
+
+	return NilVal(), false
+}
+
+// Sets the value of the field and returns whether the record has it. Records without the field are left unchanged.
+func (r *Record) Set(name String, value Value) bool {
+	for i, field := range r.names {
+		if field == name {
+			r.values[i] = value
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a new record with the fields of both records. Fields of the other record which this one does not have
+// follow the fields of this one, and values of the other record override values of fields both records have.
+func (r *Record) Merge(other *Record) *Record {
+	merged := NewRecord(
+		append(make([]String, 0, len(r.names)+len(other.names)), r.names...),
+		append(make([]Value, 0, len(r.values)+len(other.values)), r.values...),
+	)
+
+	for i, name := range other.names {
+		if !merged.Set(name, other.values[i]) {
+			merged.names = append(merged.names, name)
+			merged.values = append(merged.values, other.values[i])
+		}
+	}
+
+	return merged
+}
+
+func (r *Record) IsTruthy() bool {
+	return true
+}
+
+func (r *Record) ToString() string {
+	var sb strings.Builder
+
+	sb.WriteString("{")
+
+	for i, name := range r.names {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+
+		sb.WriteString(string(name))
+		sb.WriteString(": ")
+		sb.WriteString(r.values[i].String())
+	}
+
+	sb.WriteString("}")
+
+	return sb.String()
+}
+
+func (r *Record) TypeName() string {
+	return "record"
+}
@@ -7,9 +7,13 @@ func StringVal(str string) Value {
 }
 
 func (s String) IsTruthy() bool {
-	return s != ""
+	return true
 }
 
 func (s String) ToString() string {
 	return string(s)
 }
+
+func (s String) TypeName() string {
+	return "string"
+}
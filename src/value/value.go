@@ -18,26 +18,51 @@ const tagNil = qNaN | 1
 const tagFalse = qNaN | 2
 const tagTrue = qNaN | 3
 
+// Reports whether conditions treat the value as true. Only nil and false are falsy, every other value is truthy,
+// including 0 and empty strings. Collections will be truthy even when empty too.
 func IsTruthy(value Value) bool {
-	if IsNil(value) || AsBoolean(value) == false {
-		return false
+	if IsBoolean(value) {
+		return AsBoolean(value)
+	} else if IsNumber(value) {
+		return true
 	}
 
-	return true
+	return AsObject(value).IsTruthy()
+}
+
+// Reports whether the values are equal. Numbers follow IEEE 754, so NaN is not equal to anything, not even itself.
+// Strings are equal by their contents, every other object, like a function or a record, only to itself.
+func Equals(a Value, b Value) bool {
+	if IsNumber(a) && IsNumber(b) {
+		return AsNumber(a) == AsNumber(b)
+	} else if IsNil(a) || IsNil(b) {
+		return AsObject(a) == AsObject(b)
+	}
+
+	return a == b
+}
+
+// Returns the name of the type of the value as shown to the user in error messages.
+func TypeName(value Value) string {
+	if IsBoolean(value) {
+		return "boolean"
+	} else if IsNumber(value) {
+		return "number"
+	} else {
+		return AsObject(value).TypeName()
+	}
 }
 
 func (v Value) String() string {
-	if IsNil(v) {
-		return "nil"
-	} else if IsBoolean(v) {
+	if IsBoolean(v) {
 		if AsBoolean(v) {
 			return "true"
 		} else {
 			return "false"
 		}
 	} else if IsNumber(v) {
-		return strconv.FormatFloat(float64(v.value), 'f', -1, 64)
+		return strconv.FormatFloat(AsNumber(v), 'f', -1, 64)
 	} else {
-		return v.object.ToString()
+		return AsObject(v).ToString()
 	}
 }
@@ -1,6 +1,9 @@
 package value
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestNilEqualsToItself(t *testing.T) {
 	a := Nil{}
@@ -10,3 +13,79 @@ func TestNilEqualsToItself(t *testing.T) {
 		t.Error("Nil does not equal to itself")
 	}
 }
+
+func TestNilValue(t *testing.T) {
+	if !Equals(NilVal(), NilVal()) {
+		t.Error("Expected nil to equal nil")
+	}
+
+	if Equals(NilVal(), FalseVal()) || Equals(NilVal(), NumberVal(0)) {
+		t.Error("Expected nil not to equal false or 0")
+	}
+
+	if !IsNil(NilVal()) || IsNil(FalseVal()) || IsBoolean(NilVal()) || IsNumber(NilVal()) || IsObject(NilVal()) {
+		t.Error("Expected nil to be only nil")
+	}
+
+	if NilVal().String() != "nil" || TypeName(NilVal()) != "nil" {
+		t.Errorf("Expected nil of type nil, got %s of type %s", NilVal().String(), TypeName(NilVal()))
+	}
+}
+
+func TestNilIsTheObjectOfNil(t *testing.T) {
+	if object, ok := AsObject(NilVal()).(Nil); !ok || object.TypeName() != "nil" || object.IsTruthy() {
+		t.Errorf("Expected Nil as the object of nil, got %v", AsObject(NilVal()))
+	}
+
+	if ObjectVal(Nil{}) != NilVal() || !IsNil(ObjectVal(Nil{})) || IsObject(ObjectVal(Nil{})) {
+		t.Error("Expected Nil to become the nil value")
+	}
+
+	if _, ok := AsObject(FalseVal()).(Nil); ok {
+		t.Error("Expected false not to be Nil")
+	}
+
+	if !Equals(ObjectVal(Nil{}), NilVal()) || Equals(ObjectVal(Nil{}), FalseVal()) {
+		t.Error("Expected Nil to equal only nil")
+	}
+}
+
+func TestOnlyNilAndFalseAreFalsy(t *testing.T) {
+	tests := map[Value]bool{
+		NilVal():       false,
+		FalseVal():     false,
+		TrueVal():      true,
+		NumberVal(0):   true,
+		NumberVal(1):   true,
+		StringVal(""):  true,
+		StringVal("a"): true,
+	}
+
+	for val, expected := range tests {
+		if IsTruthy(val) != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, val.String(), IsTruthy(val))
+		}
+	}
+}
+
+func TestEveryNaNIsANumber(t *testing.T) {
+	// A NaN with the quiet bit and the next one set has the bits of the tags
+	nans := []float64{math.NaN(), math.Float64frombits(qNaN | 1), math.Float64frombits(qNaN | 3 | signBit)}
+
+	for _, nan := range nans {
+		if val := NumberVal(nan); !IsNumber(val) || IsNil(val) || IsBoolean(val) || !math.IsNaN(AsNumber(val)) {
+			t.Errorf("Expected NaN for %x, got %v", math.Float64bits(nan), val)
+		}
+	}
+}
+
+func TestNativesAreEqualOnlyToThemselves(t *testing.T) {
+	fn := func(args []Value) (Value, error) { return NilVal(), nil }
+
+	a := ObjectVal(NewNative("a", 0, fn))
+	b := ObjectVal(NewNative("a", 0, fn))
+
+	if !Equals(a, a) || Equals(a, b) {
+		t.Errorf("Expected native to equal only itself, got %v and %v", Equals(a, a), Equals(a, b))
+	}
+}
@@ -0,0 +1,113 @@
+package vm
+
+import "testing"
+
+// Compiles the source once and runs the chunk in the benchmark loop, so only the VM is measured.
+func benchmark(b *testing.B, source string) {
+	chunk := compile(source)
+	if chunk == nil {
+		b.Fatalf("Failed to compile '%s'", source)
+	}
+
+	vm := NewVM()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.Interpret(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkArithmeticLoop(b *testing.B) {
+	benchmark(b, `
+var i = 0
+var sum = 0
+while i < 1000 {
+	sum = sum + i * 2 - i / 2
+	i = i + 1
+}
+return sum
+`)
+}
+
+// Keeps the counters in locals, so the loop runs on the superinstructions reading two locals.
+func BenchmarkLocalArithmeticLoop(b *testing.B) {
+	benchmark(b, `
+fn loop(n) {
+	var i = 0
+	var sum = 0
+	var step = 1
+	while i < n {
+		sum = sum + i
+		i = i + step
+	}
+	return sum
+}
+return loop(1000)
+`)
+}
+
+func BenchmarkFib(b *testing.B) {
+	benchmark(b, `
+fn fib(n) {
+	if n < 2 { return n }
+	return fib(n - 1) + fib(n - 2)
+}
+return fib(15)
+`)
+}
+
+func BenchmarkStringConcatenation(b *testing.B) {
+	benchmark(b, `
+var i = 0
+var s = ""
+while i < 100 {
+	s = s + "x"
+	i = i + 1
+}
+return s
+`)
+}
+
+// Consists of cheap instructions only, so most of the time is spent in the dispatch loop itself.
+func BenchmarkDispatch(b *testing.B) {
+	benchmark(b, `
+var i = 0
+while i < 1000 {
+	true
+	false
+	nil
+	!true
+	i = i + 1
+}
+return i
+`)
+}
+
+func BenchmarkRepeatedConstants(b *testing.B) {
+	benchmark(b, `
+var i = 0
+var sum = 0
+while i < 1000 {
+	sum = sum + (2 * 2 + 2 * 2) * i
+	i = i + 1
+}
+return sum
+`)
+}
+
+func BenchmarkConstantComparisons(b *testing.B) {
+	benchmark(b, `
+var i = 0
+var hits = 0
+while i < 1000 {
+	if i == 0 { hits = hits + 1 }
+	if i < 10 { hits = hits + 1 }
+	if i > 990 { hits = hits + 1 }
+	i = i + 1
+}
+return hits
+`)
+}
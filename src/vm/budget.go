@@ -0,0 +1,31 @@
+package vm
+
+import (
+	"github.com/adamjedlicka/go-blu/src/value"
+	"unsafe"
+)
+
+// MemoryBudget is charged for the heap values created by the VM, for example to limit the memory a script can use.
+// The memory itself is managed by Go and reclaimed by its garbage collector, which tells nothing about values being
+// freed, so charges only ever add up over the life of the VM. The budget can only refuse them.
+type MemoryBudget interface {
+	// Called before a value of the given size in bytes is created. Returning an error aborts the script.
+	Charge(size int) error
+}
+
+// The default budget, which accepts every charge.
+type unlimitedBudget struct{}
+
+func (unlimitedBudget) Charge(size int) error {
+	return nil
+}
+
+// Returns the size of the closure together with the upvalues it may create.
+func closureSize(upvalues int) int {
+	return int(unsafe.Sizeof(Closure{})) + upvalues*int(unsafe.Sizeof(&Upvalue{})+unsafe.Sizeof(Upvalue{}))
+}
+
+// Returns the size of the record together with the names and values of its fields.
+func recordSize(fields int) int {
+	return int(unsafe.Sizeof(value.Record{})) + fields*int(unsafe.Sizeof(value.String(""))+unsafe.Sizeof(value.Value{}))
+}
@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Budget which refuses charges once the quota of bytes is used up.
+type quotaBudget struct {
+	quota   int
+	charged int
+}
+
+func (b *quotaBudget) Charge(size int) error {
+	if b.charged+size > b.quota {
+		return errQuotaExceeded
+	}
+
+	b.charged += size
+
+	return nil
+}
+
+func TestQuotaBudget(t *testing.T) {
+	budget := &quotaBudget{quota: 1024}
+
+	vm := NewVM()
+	vm.SetMemoryBudget(budget)
+
+	err := runtimeError(t, &vm, "var s = \"ab\"\nwhile true {\ns = s + s\n}")
+
+	if err.Message != "Out of memory: quota exceeded" || !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("Expected quota to be exceeded, got %v", err)
+	}
+
+	if budget.charged > budget.quota || budget.charged < 512 {
+		t.Errorf("Expected charges close to the quota, got %d bytes", budget.charged)
+	}
+
+	vm = NewVM()
+	vm.SetMemoryBudget(&quotaBudget{quota: 1024})
+
+	if err := runtimeError(t, &vm, "var s = \"abc\" * 1000"); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("Expected quota to be exceeded, got %v", err)
+	}
+
+	vm = NewVM()
+	vm.SetMemoryBudget(&quotaBudget{quota: 1024})
+
+	if _, err := vm.Exec("fn f() {\nreturn 1\n}\nreturn \"a\" * 100 + \"b\""); err != nil {
+		t.Errorf("Expected script within the quota to run, got %v", err)
+	}
+}
+
+func TestStringsOfNativesAreCharged(t *testing.T) {
+	budget := &quotaBudget{quota: 1 << 20}
+
+	vm := NewVM()
+	vm.SetMemoryBudget(budget)
+
+	if _, err := vm.Exec("format(\"{}-{}\", 1, 2)"); err != nil {
+		t.Fatalf("Failed to run, got %v", err)
+	}
+
+	if budget.charged != len("1-2") {
+		t.Errorf("Expected %d bytes to be charged, got %d", len("1-2"), budget.charged)
+	}
+
+	vm = NewVM()
+	vm.SetMemoryBudget(&quotaBudget{quota: 16})
+
+	if err := runtimeError(t, &vm, "while true {\ntypeof(1)\n}"); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("Expected quota to be exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package vm
+
+import (
+	"github.com/adamjedlicka/go-blu/src/compiler"
+	"github.com/adamjedlicka/go-blu/src/value"
+)
+
+// Closure is a function together with the variables it captured from the enclosing functions.
+type Closure struct {
+	function *compiler.Function
+	upvalues []*Upvalue
+}
+
+func NewClosure(function *compiler.Function) *Closure {
+	return &Closure{
+		function: function,
+		upvalues: make([]*Upvalue, len(function.Upvalues())),
+	}
+}
+
+func ClosureVal(closure *Closure) value.Value {
+	return value.ObjectVal(closure)
+}
+
+func (c *Closure) Function() *compiler.Function {
+	return c.function
+}
+
+func (c *Closure) IsTruthy() bool {
+	return true
+}
+
+func (c *Closure) ToString() string {
+	return c.function.ToString()
+}
+
+func (c *Closure) TypeName() string {
+	return "function"
+}
+
+// Upvalue is a variable captured by a closure. While the variable is still on the stack the upvalue is open and
+// points into the stack, once the variable goes out of scope the upvalue is closed and holds the value itself.
+type Upvalue struct {
+	location *value.Value
+	closed   value.Value
+
+	// Index of the captured stack slot, used only while the upvalue is open.
+	slot int
+	// Next open upvalue, the list is sorted by slots from the top of the stack.
+	next *Upvalue
+}
@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Frame of the call stack at the moment a runtime error was raised.
+type TraceFrame struct {
+	// Name of the called function, or name of the chunk for the frame of the script itself.
+	Name string
+	// Source line of the instruction being executed in the frame.
+	Line int
+	// False for the frame of the script itself.
+	InFunction bool
+}
+
+func (f TraceFrame) String() string {
+	if f.InFunction {
+		return fmt.Sprintf("in function %s (line %d)", f.Name, f.Line)
+	}
+
+	return fmt.Sprintf("in %s (line %d)", f.Name, f.Line)
+}
+
+// Error raised while executing a chunk.
+type RuntimeError struct {
+	Message string
+	// Source line of the instruction which raised the error.
+	Line int
+	// Name of the chunk the instruction belongs to.
+	Chunk string
+	// Error returned by the native function which raised this error, nil if the VM raised it.
+	Err error
+	// Frames of the call stack, starting with the one which raised the error.
+	Backtrace []TraceFrame
+}
+
+func (e *RuntimeError) Error() string {
+	var sb strings.Builder
+
+	sb.WriteString(e.Message)
+
+	for _, frame := range e.Backtrace {
+		_, _ = fmt.Fprintf(&sb, "\n    %s", frame)
+	}
+
+	return sb.String()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Error returned when the source could not be compiled.
+type CompileError struct {
+	Errors []string
+}
+
+func (e *CompileError) Error() string {
+	return strings.Join(e.Errors, "\n")
+}
@@ -0,0 +1,53 @@
+package vm
+
+import "github.com/adamjedlicka/go-blu/src/value"
+
+// LineHook is called before the first instruction of every newly reached source line.
+type LineHook func(line int, frame Frame)
+
+// Frame gives a line hook access to the function being executed. It is only valid until the hook returns.
+type Frame struct {
+	vm    *VM
+	frame *CallFrame
+}
+
+// Returns the name of the function being executed, or of the chunk for the script itself.
+func (f Frame) Name() string {
+	return f.frame.chunk.Name()
+}
+
+// Returns the number of values on the stack of the function, its locals and temporaries. The first one is the function
+// itself, the script has no such value.
+func (f Frame) SlotCount() int {
+	return f.vm.stackLen - f.frame.slots
+}
+
+// Returns the value in the given stack slot of the function.
+func (f Frame) Slot(slot int) value.Value {
+	return f.vm.stack[f.frame.slots+slot]
+}
+
+// Returns the value of the global variable and whether it is defined.
+func (f Frame) Global(name string) (value.Value, bool) {
+	return f.vm.Global(name)
+}
+
+// Sets the hook called whenever execution moves to another source line, or to another function. A nil hook disables
+// it again.
+func (vm *VM) SetLineHook(hook LineHook) {
+	vm.lineHook = hook
+}
+
+// Calls the line hook if the instruction about to execute starts another line than the previous one.
+func (vm *VM) traceLine() {
+	line := vm.frame.chunk.Lines()[vm.frame.ip]
+
+	if line == vm.hookLine && vm.frame == vm.hookFrame {
+		return
+	}
+
+	vm.hookLine = line
+	vm.hookFrame = vm.frame
+
+	vm.lineHook(line, Frame{vm: vm, frame: vm.frame})
+}
@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"github.com/adamjedlicka/go-blu/src/value"
+	"testing"
+)
+
+func TestLineHook(t *testing.T) {
+	source := "var a = 1\nif a == 2 {\na = 3\n} else {\na = 4\n}\nfn f(b) {\nreturn b + 1\n}\nvar c = f(a)\nreturn c"
+
+	lines := make([]int, 0)
+
+	vm := NewVM()
+	vm.SetLineHook(func(line int, frame Frame) {
+		lines = append(lines, line)
+	})
+
+	if _, err := vm.Interpret(compile(source)); err != nil {
+		t.Fatalf("Failed to run '%s': %s", source, err)
+	}
+
+	// The hoisted definition of f runs before the rest of the script
+	expected := []int{10, 1, 2, 4, 5, 10, 8, 10, 11}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected lines %v, got %v", expected, lines)
+	}
+
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Fatalf("Expected lines %v, got %v", expected, lines)
+		}
+	}
+}
+
+func TestLineHookFrame(t *testing.T) {
+	source := "var g = 1\nfn f(a) {\nvar b = a * 2\nreturn b\n}\nreturn f(5)"
+
+	var slots []value.Value
+	var global value.Value
+
+	vm := NewVM()
+	vm.SetLineHook(func(line int, frame Frame) {
+		if line == 4 && frame.Name() == "f" {
+			for i := 0; i < frame.SlotCount(); i++ {
+				slots = append(slots, frame.Slot(i))
+			}
+
+			global, _ = frame.Global("g")
+		}
+	})
+
+	if _, err := vm.Interpret(compile(source)); err != nil {
+		t.Fatalf("Failed to run '%s': %s", source, err)
+	}
+
+	if len(slots) != 3 || slots[1] != value.NumberVal(5) || slots[2] != value.NumberVal(10) {
+		t.Errorf("Expected the function, 5 and 10 in slots of f, got %v", slots)
+	}
+
+	if global != value.NumberVal(1) {
+		t.Errorf("Expected global g to be 1, got %v", global)
+	}
+}
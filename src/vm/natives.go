@@ -0,0 +1,363 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Defines natives available to every script.
+func (vm *VM) defineNatives() {
+	vm.DefineDocumentedNative("format", -1, "Replaces every '{}' placeholder in the template with the next argument.", nativeFormat)
+	vm.DefineDocumentedNative("typeof", 1, "Returns the name of the type of the argument.", nativeTypeof)
+	vm.DefineDocumentedNative("bool", 1, "Returns whether conditions treat the argument as true.", nativeBool)
+	vm.DefineDocumentedNative("arity", 1, "Returns the number of parameters of a function.", nativeArity)
+	vm.DefineDocumentedNative("name", 1, "Returns the name a function was declared with.", nativeName)
+	vm.DefineDocumentedNative("doc", 1, "Returns the signature and the description of a function.", nativeDoc)
+	vm.DefineDocumentedNative("assertEq", 2, "Raises an error showing both values if the first does not equal the second.", nativeAssertEq)
+	vm.DefineDocumentedNative("bitCount", 1, "Returns the number of one bits of a non-negative integer.", nativeBitCount)
+	vm.DefineDocumentedNative("leadingZeros", 1, "Returns the number of leading zero bits of a non-negative integer in 64 bits.", nativeLeadingZeros)
+	vm.DefineDocumentedNative("trailingZeros", 1, "Returns the number of trailing zero bits of a non-negative integer, 64 for zero.", nativeTrailingZeros)
+	vm.DefineDocumentedNative("gcd", 2, "Returns the greatest common divisor of two integers.", nativeGcd)
+	vm.DefineDocumentedNative("lcm", 2, "Returns the least common multiple of two integers.", nativeLcm)
+}
+
+// Returns the name of the type of the argument.
+func nativeTypeof(args []value.Value) (value.Value, error) {
+	return value.StringVal(value.TypeName(args[0])), nil
+}
+
+// Returns whether conditions treat the argument as true, see value.IsTruthy.
+func nativeBool(args []value.Value) (value.Value, error) {
+	return value.BooleanVal(value.IsTruthy(args[0])), nil
+}
+
+// Returns the number of declared parameters of a function or native, -1 for natives taking any number of arguments.
+func nativeArity(args []value.Value) (value.Value, error) {
+	if value.IsObject(args[0]) {
+		switch fn := value.AsObject(args[0]).(type) {
+		case *Closure:
+			return value.NumberVal(float64(fn.function.Arity())), nil
+		case *value.Native:
+			return value.NumberVal(float64(fn.Arity())), nil
+		}
+	}
+
+	return value.NilVal(), fmt.Errorf("Expected a function, got %s.", value.TypeName(args[0]))
+}
+
+// Returns the name a function or native was declared with.
+func nativeName(args []value.Value) (value.Value, error) {
+	if value.IsObject(args[0]) {
+		switch fn := value.AsObject(args[0]).(type) {
+		case *Closure:
+			return value.StringVal(fn.function.Name()), nil
+		case *value.Native:
+			return value.StringVal(fn.Name()), nil
+		}
+	}
+
+	return value.NilVal(), fmt.Errorf("Expected a function, got %s.", value.TypeName(args[0]))
+}
+
+// Returns the documentation of a function or native.
+func nativeDoc(args []value.Value) (value.Value, error) {
+	doc, ok := Doc(args[0])
+	if !ok {
+		return value.NilVal(), fmt.Errorf("Expected a function, got %s.", value.TypeName(args[0]))
+	}
+
+	return value.StringVal(doc), nil
+}
+
+// Returns the signature of a function or native in the form 'name(arity)', with '...' as the arity of variadic
+// natives, followed by the description of documented natives. Reports false if the value is not a function.
+func Doc(fn value.Value) (string, bool) {
+	if !value.IsObject(fn) {
+		return "", false
+	}
+
+	switch fn := value.AsObject(fn).(type) {
+	case *Closure:
+		return fmt.Sprintf("%s(%d)", fn.function.Name(), fn.function.Arity()), true
+	case *value.Native:
+		arity := "..."
+		if fn.Arity() != -1 {
+			arity = strconv.Itoa(fn.Arity())
+		}
+
+		if fn.Doc() == "" {
+			return fmt.Sprintf("%s(%s)", fn.Name(), arity), true
+		}
+
+		return fmt.Sprintf("%s(%s): %s", fn.Name(), arity, fn.Doc()), true
+	}
+
+	return "", false
+}
+
+// Replaces every '{}' placeholder in the template with the next argument. '{{' and '}}' produce literal braces.
+// The number of arguments has to match the number of placeholders.
+func nativeFormat(args []value.Value) (value.Value, error) {
+	if len(args) == 0 {
+		return value.NilVal(), errors.New("Expected format template.")
+	}
+
+	str, ok := asString(args[0])
+	if !ok {
+		return value.NilVal(), fmt.Errorf("Format template must be a string, got %s.", value.TypeName(args[0]))
+	}
+
+	template := string(str)
+
+	var sb strings.Builder
+
+	next := 1
+
+	for i := 0; i < len(template); i++ {
+		switch template[i] {
+		case '{':
+			if strings.HasPrefix(template[i:], "{{") {
+				sb.WriteByte('{')
+				i++
+			} else if strings.HasPrefix(template[i:], "{}") {
+				if next == len(args) {
+					return value.NilVal(), errors.New("Not enough arguments for format template.")
+				}
+
+				sb.WriteString(args[next].String())
+				next++
+				i++
+			} else if strings.ContainsRune(template[i:], '}') {
+				return value.NilVal(), errors.New("Named placeholders are not supported.")
+			} else {
+				return value.NilVal(), errors.New("Unclosed '{' in format template.")
+			}
+
+		case '}':
+			if !strings.HasPrefix(template[i:], "}}") {
+				return value.NilVal(), errors.New("Unmatched '}' in format template.")
+			}
+
+			sb.WriteByte('}')
+			i++
+
+		default:
+			sb.WriteByte(template[i])
+		}
+	}
+
+	if next != len(args) {
+		return value.NilVal(), errors.New("Too many arguments for format template.")
+	}
+
+	return value.StringVal(sb.String()), nil
+}
+
+// Raises an error if the actual value, the first argument, differs from the expected one. Records are compared field
+// by field and the error names the first field which differs.
+func nativeAssertEq(args []value.Value) (value.Value, error) {
+	actual, expected := args[0], args[1]
+
+	path, differ := difference(actual, expected)
+	if !differ {
+		return value.NilVal(), nil
+	}
+
+	message := fmt.Sprintf("Expected %s but got %s.", describe(expected), describe(actual))
+
+	if path != "" {
+		actualField, expectedField := fieldAt(actual, path), fieldAt(expected, path)
+		message += fmt.Sprintf(" Field %s differs: expected %s but got %s.", path, describe(expectedField), describe(actualField))
+	}
+
+	return value.NilVal(), errors.New(message)
+}
+
+// Returns the path of fields leading to the first part of the values which differs, empty if the values differ
+// as a whole, and whether they differ at all. Other values than records are compared by value.Equals.
+func difference(actual value.Value, expected value.Value) (string, bool) {
+	actualRecord, ok := asRecord(actual)
+	expectedRecord, expectedOk := asRecord(expected)
+	if !ok || !expectedOk {
+		return "", !value.Equals(actual, expected)
+	}
+
+	if len(actualRecord.Fields()) != len(expectedRecord.Fields()) {
+		return "", true
+	}
+
+	for _, name := range expectedRecord.Fields() {
+		if _, ok := actualRecord.Get(name); !ok {
+			return "", true
+		}
+	}
+
+	for _, name := range expectedRecord.Fields() {
+		actualField, _ := actualRecord.Get(name)
+		expectedField, _ := expectedRecord.Get(name)
+
+		if path, differ := difference(actualField, expectedField); differ {
+			return "." + string(name) + path, true
+		}
+	}
+
+	return "", false
+}
+
+// Returns the field of the record at the path returned by difference.
+func fieldAt(val value.Value, path string) value.Value {
+	for _, name := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		record, _ := asRecord(val)
+		val, _ = record.Get(value.String(name))
+	}
+
+	return val
+}
+
+// Returns the value as shown in error messages, with strings quoted so they can be told apart from other values.
+func describe(val value.Value) string {
+	if str, ok := asString(val); ok {
+		return strconv.Quote(string(str))
+	}
+
+	if record, ok := asRecord(val); ok {
+		fields := make([]string, 0, len(record.Fields()))
+		for _, name := range record.Fields() {
+			field, _ := record.Get(name)
+			fields = append(fields, string(name)+": "+describe(field))
+		}
+
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+
+	return val.String()
+}
+
+// Numbers up to this magnitude are integers which are represented exactly. From 2^53 on neighbouring integers round
+// to the same number, so 2^53 may as well have been 2^53 + 1.
+const maxExactInteger = 1<<53 - 1
+
+// Returns the argument as an integer. Numbers with a fraction, NaN and integers too large to be exact are rejected.
+func integerArgument(arg value.Value) (int64, error) {
+	if !value.IsNumber(arg) {
+		return 0, fmt.Errorf("Expected an integer, got %s.", value.TypeName(arg))
+	}
+
+	number := value.AsNumber(arg)
+	if math.Abs(number) > maxExactInteger && !math.IsNaN(number) {
+		return 0, fmt.Errorf("Expected an integer from -%d to %d, got %s.", maxExactInteger, maxExactInteger, arg)
+	}
+
+	if number != math.Trunc(number) {
+		return 0, fmt.Errorf("Expected an integer, got %s.", arg)
+	}
+
+	return int64(number), nil
+}
+
+// Returns the argument as the bits of a non-negative integer.
+func bitsArgument(arg value.Value) (uint64, error) {
+	integer, err := integerArgument(arg)
+	if err != nil {
+		return 0, err
+	}
+
+	if integer < 0 {
+		return 0, fmt.Errorf("Expected a non-negative integer, got %s.", arg)
+	}
+
+	return uint64(integer), nil
+}
+
+func nativeBitCount(args []value.Value) (value.Value, error) {
+	n, err := bitsArgument(args[0])
+	if err != nil {
+		return value.NilVal(), err
+	}
+
+	return value.NumberVal(float64(bits.OnesCount64(n))), nil
+}
+
+func nativeLeadingZeros(args []value.Value) (value.Value, error) {
+	n, err := bitsArgument(args[0])
+	if err != nil {
+		return value.NilVal(), err
+	}
+
+	return value.NumberVal(float64(bits.LeadingZeros64(n))), nil
+}
+
+func nativeTrailingZeros(args []value.Value) (value.Value, error) {
+	n, err := bitsArgument(args[0])
+	if err != nil {
+		return value.NilVal(), err
+	}
+
+	return value.NumberVal(float64(bits.TrailingZeros64(n))), nil
+}
+
+// Returns the greatest common divisor of the absolute values of the arguments, which is 0 only if both are 0.
+func nativeGcd(args []value.Value) (value.Value, error) {
+	a, b, err := integerArguments(args)
+	if err != nil {
+		return value.NilVal(), err
+	}
+
+	return value.NumberVal(float64(gcd(a, b))), nil
+}
+
+// Returns the least common multiple of the absolute values of the arguments, 0 if either of them is 0. Multiples
+// too large to be exact are an error.
+func nativeLcm(args []value.Value) (value.Value, error) {
+	a, b, err := integerArguments(args)
+	if err != nil {
+		return value.NilVal(), err
+	}
+
+	if a == 0 || b == 0 {
+		return value.NumberVal(0), nil
+	}
+
+	hi, lcm := bits.Mul64(a/gcd(a, b), b)
+	if hi != 0 || lcm > maxExactInteger {
+		return value.NilVal(), fmt.Errorf("Least common multiple of %d and %d is too large to be exact.", a, b)
+	}
+
+	return value.NumberVal(float64(lcm)), nil
+}
+
+// Returns the absolute values of both integer arguments.
+func integerArguments(args []value.Value) (uint64, uint64, error) {
+	a, err := integerArgument(args[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	b, err := integerArgument(args[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if a < 0 {
+		a = -a
+	}
+
+	if b < 0 {
+		b = -b
+	}
+
+	return uint64(a), uint64(b), nil
+}
+
+func gcd(a uint64, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
@@ -0,0 +1,267 @@
+package vm
+
+import (
+	"github.com/adamjedlicka/go-blu/src/value"
+	"sort"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := map[string]value.Value{
+		`return format("{} + {} = {}", 1, 2, 1 + 2)`:  value.StringVal("1 + 2 = 3"),
+		`return format("{}, {}!", "Hello", "world")`:  value.StringVal("Hello, world!"),
+		`return format("{{}} is {}", nil)`:            value.StringVal("{} is nil"),
+		`return format("{{{}}}", true)`:               value.StringVal("{true}"),
+		`return format("no placeholders")`:            value.StringVal("no placeholders"),
+		`fn f() {}` + "\n" + `return format("{}", f)`: value.StringVal("<fn f>"),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	tests := map[string]string{
+		`format("{} {}", 1)`:  "Not enough arguments for format template.",
+		`format("{}", 1, 2)`:  "Too many arguments for format template.",
+		`format("{name}", 1)`: "Named placeholders are not supported.",
+		`format("{", 1)`:      "Unclosed '{' in format template.",
+		`format("}")`:         "Unmatched '}' in format template.",
+		`format(1)`:           "Format template must be a string, got number.",
+		`format()`:            "Expected format template.",
+	}
+
+	for source, expected := range tests {
+		vm := NewVM()
+		err := runtimeError(t, &vm, source)
+
+		if err.Message != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, source, err.Message)
+		}
+	}
+}
+
+func TestTypeof(t *testing.T) {
+	tests := map[string]value.Value{
+		"return typeof(nil)":            value.StringVal("nil"),
+		"return typeof(nil) == \"nil\"": value.TrueVal(),
+		"return nil == nil":             value.TrueVal(),
+		"return typeof(1)":              value.StringVal("number"),
+		"return typeof(\"a\")":          value.StringVal("string"),
+		"return typeof(true)":           value.StringVal("boolean"),
+		"return typeof(typeof)":         value.StringVal("native"),
+		"fn f() {}\nreturn typeof(f)":   value.StringVal("function"),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestArityAndName(t *testing.T) {
+	tests := map[string]value.Value{
+		"fn add(a, b) {\nreturn a + b\n}\nreturn arity(add)": value.NumberVal(2),
+		"fn f(a, b = 1, c = 2) {}\nreturn arity(f)":          value.NumberVal(3),
+		"return arity(fn() {})":                              value.NumberVal(0),
+		"return arity(typeof)":                               value.NumberVal(1),
+		"return arity(format)":                               value.NumberVal(-1),
+		"fn add(a, b) {\nreturn a + b\n}\nreturn name(add)":  value.StringVal("add"),
+		"fn f() {}\nvar g = f\nreturn name(g)":               value.StringVal("f"),
+		"return name(fn() {})":                               value.StringVal("<fn@1:13>"),
+		"return name(typeof)":                                value.StringVal("typeof"),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestArityAndNameErrors(t *testing.T) {
+	tests := map[string]string{
+		"arity(1)":    "Expected a function, got number.",
+		"name(\"f\")": "Expected a function, got string.",
+		"arity(nil)":  "Expected a function, got nil.",
+	}
+
+	for source, expected := range tests {
+		vm := NewVM()
+		err := runtimeError(t, &vm, source)
+
+		if err.Message != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, source, err.Message)
+		}
+	}
+}
+
+func TestBool(t *testing.T) {
+	tests := map[string]value.Value{
+		"nil":           value.FalseVal(),
+		"false":         value.FalseVal(),
+		"true":          value.TrueVal(),
+		"0":             value.TrueVal(),
+		"-1":            value.TrueVal(),
+		"0 / 0":         value.TrueVal(),
+		"\"\"":          value.TrueVal(),
+		"\"false\"":     value.TrueVal(),
+		"typeof":        value.TrueVal(),
+		"fn() {}":       value.TrueVal(),
+		"{ var a = 1 }": value.FalseVal(),
+	}
+
+	for operand, expected := range tests {
+		source := "return bool(" + operand + ")"
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+
+		// Conditions branch the same way
+		source = "var a = " + operand + "\nif a { return true }\nreturn false"
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+
+		source = "var a = " + operand + "\nreturn !a == !bool(a)"
+		if result := run(t, source); result != value.TrueVal() {
+			t.Errorf("Expected true for '%s', got %v", source, result)
+		}
+	}
+}
+
+func TestDoc(t *testing.T) {
+	vm := NewVM()
+	vm.DefineDocumentedNative("clamp", 3, "Limits the value to the range.", func(args []value.Value) (value.Value, error) {
+		return args[0], nil
+	})
+	vm.DefineNative("undocumented", -1, func(args []value.Value) (value.Value, error) {
+		return value.NilVal(), nil
+	})
+
+	tests := map[string]value.Value{
+		"return doc(clamp)":                    value.StringVal("clamp(3): Limits the value to the range."),
+		"return doc(undocumented)":             value.StringVal("undocumented(...)"),
+		"return doc(typeof)":                   value.StringVal("typeof(1): Returns the name of the type of the argument."),
+		"fn add(a, b = 1) {}\nreturn doc(add)": value.StringVal("add(2)"),
+	}
+
+	for source, expected := range tests {
+		if result, err := vm.Exec(source); err != nil || result != expected {
+			t.Errorf("Expected %v for '%s', got %v (%v)", expected, source, result, err)
+		}
+	}
+
+	if err := runtimeError(t, &vm, "doc(1)"); err.Message != "Expected a function, got number." {
+		t.Errorf("Expected error for non-function, got '%s'", err.Message)
+	}
+
+	// Natives stay registered even when their global is reassigned
+	if _, err := vm.Exec("var clamp = nil"); err != nil {
+		t.Fatal(err)
+	}
+
+	natives := vm.Natives()
+
+	names := make([]string, 0, len(natives))
+	for _, native := range natives {
+		names = append(names, native.Name())
+	}
+
+	clamp := sort.SearchStrings(names, "clamp")
+	if len(names) == 0 || names[0] != "arity" || !sort.StringsAreSorted(names) || clamp == len(names) || names[clamp] != "clamp" {
+		t.Errorf("Expected natives sorted by name, got %v", names)
+	}
+}
+
+func TestAssertEqPassesForEqualValues(t *testing.T) {
+	tests := []string{
+		"assertEq(1 + 2, 3)",
+		"assertEq(\"a\" * 2, \"aa\")",
+		"assertEq(nil, nil)",
+		"assertEq(typeof, typeof)",
+		"assertEq({ a: 1, b: { c: \"x\" } }, { b: { c: \"x\" }, a: 1 })",
+	}
+
+	for _, source := range tests {
+		if result, err := Exec(source + "\nreturn 1"); err != nil || result != value.NumberVal(1) {
+			t.Errorf("Expected '%s' to pass, got %v", source, err)
+		}
+	}
+}
+
+func TestAssertEqErrors(t *testing.T) {
+	tests := map[string]string{
+		"assertEq(1, 2)":               "Expected 2 but got 1.",
+		"assertEq(\"1\", 1)":           "Expected 1 but got \"1\".",
+		"assertEq({ a: 1 }, 1)":        "Expected 1 but got {a: 1}.",
+		"assertEq({ a: 1 }, { b: 1 })": "Expected {b: 1} but got {a: 1}.",
+		"assertEq({ a: 1, b: { c: \"x\", d: 1 } }, { a: 1, b: { c: \"y\", d: 1 } })": "Expected {a: 1, b: {c: \"y\", d: 1}} " +
+			"but got {a: 1, b: {c: \"x\", d: 1}}. Field .b.c differs: expected \"y\" but got \"x\".",
+	}
+
+	for source, expected := range tests {
+		vm := NewVM()
+		err := runtimeError(t, &vm, source)
+
+		if err.Message != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, source, err.Message)
+		}
+	}
+}
+
+func TestIntegerNatives(t *testing.T) {
+	tests := map[string]value.Value{
+		"return bitCount(7)":                   value.NumberVal(3),
+		"return bitCount(0)":                   value.NumberVal(0),
+		"return leadingZeros(1)":               value.NumberVal(63),
+		"return trailingZeros(8)":              value.NumberVal(3),
+		"return trailingZeros(0)":              value.NumberVal(64),
+		"return gcd(12, 8)":                    value.NumberVal(4),
+		"return gcd(-12, 18)":                  value.NumberVal(6),
+		"return gcd(0, 5)":                     value.NumberVal(5),
+		"return lcm(4, 6)":                     value.NumberVal(12),
+		"return lcm(0, 6)":                     value.NumberVal(0),
+		"return gcd(12, 8) * lcm(12, 8)":       value.NumberVal(96),
+		"return bitCount(9007199254740991)":    value.NumberVal(53),
+		"return gcd(-9007199254740991, 69431)": value.NumberVal(69431),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestIntegerNativesErrors(t *testing.T) {
+	tests := map[string]string{
+		"bitCount(1.5)":               "Expected an integer, got 1.5.",
+		"leadingZeros(0.5)":           "Expected an integer, got 0.5.",
+		"trailingZeros(2.25)":         "Expected an integer, got 2.25.",
+		"gcd(12, 8.5)":                "Expected an integer, got 8.5.",
+		"lcm(0.1, 4)":                 "Expected an integer, got 0.1.",
+		"bitCount(0 / 0)":             "Expected an integer, got NaN.",
+		"bitCount(-1)":                "Expected a non-negative integer, got -1.",
+		"leadingZeros(-8)":            "Expected a non-negative integer, got -8.",
+		"trailingZeros(-8)":           "Expected a non-negative integer, got -8.",
+		"gcd(\"a\", 1)":               "Expected an integer, got string.",
+		"bitCount(9007199254740992)":  "Expected an integer from -9007199254740991 to 9007199254740991, got 9007199254740992.",
+		"gcd(-9007199254740992, 2)":   "Expected an integer from -9007199254740991 to 9007199254740991, got -9007199254740992.",
+		"lcm(4, 10000000000000000)":   "Expected an integer from -9007199254740991 to 9007199254740991, got 10000000000000000.",
+		"lcm(9007199254740991, 1024)": "Least common multiple of 9007199254740991 and 1024 is too large to be exact.",
+	}
+
+	for source, expected := range tests {
+		vm := NewVM()
+		err := runtimeError(t, &vm, source)
+
+		if err.Message != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, source, err.Message)
+		}
+	}
+}
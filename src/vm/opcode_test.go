@@ -0,0 +1,417 @@
+package vm
+
+import (
+	"github.com/adamjedlicka/go-blu/src/compiler"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"math"
+	"testing"
+)
+
+// Opcodes the virtual machine does not implement yet.
+var unimplementedOpCodes = map[compiler.OpCode]bool{
+	compiler.GetSubscript: true,
+	compiler.SetSubscript: true,
+}
+
+func number(n float64) value.Value {
+	return value.NumberVal(n)
+}
+
+func str(s string) value.Value {
+	return value.StringVal(s)
+}
+
+// Returns a function taking no arguments built by the given function.
+func function(build func(b *compiler.ChunkBuilder), upvalues ...compiler.Upvalue) value.Value {
+	b := compiler.NewChunkBuilder("f")
+	build(b)
+
+	return compiler.FunctionVal(b.Function(0, upvalues...))
+}
+
+func runChunk(t *testing.T, name string, chunk *compiler.Chunk) value.Value {
+	t.Helper()
+
+	if err := chunk.Validate(); err != nil {
+		t.Fatalf("Invalid chunk for %s: %s", name, err)
+	}
+
+	vm := NewVM()
+	result, err := vm.Interpret(chunk)
+	if err != nil {
+		t.Fatalf("Failed to run chunk for %s: %s", name, err)
+	}
+
+	if vm.stackLen != 0 {
+		t.Errorf("Expected empty stack after running chunk for %s, got %d values", name, vm.stackLen)
+	}
+
+	return result
+}
+
+var opCodeTests = []struct {
+	op       compiler.OpCode
+	name     string
+	build    func(b *compiler.ChunkBuilder)
+	expected value.Value
+}{
+	{compiler.Constant, "constant", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.False, "false", func(b *compiler.ChunkBuilder) {
+		b.Emit(compiler.False).Emit(compiler.Return)
+	}, value.FalseVal()},
+	{compiler.True, "true", func(b *compiler.ChunkBuilder) {
+		b.Emit(compiler.True).Emit(compiler.Return)
+	}, value.TrueVal()},
+	{compiler.Nil, "nil", func(b *compiler.ChunkBuilder) {
+		b.Emit(compiler.Nil).Emit(compiler.Return)
+	}, value.NilVal()},
+
+	{compiler.Pop, "pop", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, number(2))
+		b.Emit(compiler.Pop).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.Dup, "dup", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(3)).Emit(compiler.Dup).Emit(compiler.Multiply).Emit(compiler.Return)
+	}, number(9)},
+	{compiler.Nop, "nop", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).Emit(compiler.Nop).Emit(compiler.Return)
+	}, number(1)},
+
+	{compiler.GetLocal, "get local", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, number(2))
+		b.Emit(compiler.GetLocal, 0).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.SetLocal, "set local", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, number(2))
+		b.Emit(compiler.SetLocal, 0).Emit(compiler.Pop).Emit(compiler.GetLocal, 0).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.DefineGlobal, "define global", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.DefineGlobal, str("a"))
+		b.EmitConstant(compiler.GetGlobal, str("a")).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.GetGlobal, "get native", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.GetGlobal, str("typeof")).EmitConstant(compiler.Constant, number(1))
+		b.Emit(compiler.Call, 1).Emit(compiler.Return)
+	}, str("number")},
+	{compiler.SetGlobal, "set global", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.DefineGlobal, str("a"))
+		b.EmitConstant(compiler.Constant, number(2)).EmitConstant(compiler.SetGlobal, str("a")).Emit(compiler.Pop)
+		b.EmitConstant(compiler.GetGlobal, str("a")).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.GetUpvalue, "get upvalue", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1))
+		b.EmitConstant(compiler.Closure, function(func(f *compiler.ChunkBuilder) {
+			f.Emit(compiler.GetUpvalue, 0).Emit(compiler.Return)
+		}, compiler.NewUpvalue(0, true)))
+		b.Emit(compiler.Call, 0).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.SetUpvalue, "set upvalue", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1))
+		b.EmitConstant(compiler.Closure, function(func(f *compiler.ChunkBuilder) {
+			f.EmitConstant(compiler.Constant, number(2)).Emit(compiler.SetUpvalue, 0).Emit(compiler.Return)
+		}, compiler.NewUpvalue(0, true)))
+		b.Emit(compiler.Call, 0).Emit(compiler.Pop).Emit(compiler.GetLocal, 0).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.CloseUpvalues, "close upvalues", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1))
+		b.EmitConstant(compiler.Closure, function(func(f *compiler.ChunkBuilder) {
+			f.Emit(compiler.GetUpvalue, 0).Emit(compiler.Return)
+		}, compiler.NewUpvalue(0, true)))
+		// The closed upvalue no longer follows the stack slot
+		b.Emit(compiler.CloseUpvalues, 0)
+		b.EmitConstant(compiler.Constant, number(2)).Emit(compiler.SetLocal, 0).Emit(compiler.Pop)
+		b.Emit(compiler.GetLocal, 1).Emit(compiler.Call, 0).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.GetProperty, "get property", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, number(1)).Emit(compiler.Record, 1)
+		b.EmitConstant(compiler.GetProperty, str("a")).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.SetProperty, "set property", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, number(1)).Emit(compiler.Record, 1)
+		b.Emit(compiler.Dup).EmitConstant(compiler.Constant, number(2)).EmitConstant(compiler.SetProperty, str("a"))
+		b.Emit(compiler.Pop).EmitConstant(compiler.GetProperty, str("a")).Emit(compiler.Return)
+	}, number(2)},
+
+	{compiler.Equal, "equal", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, str("a"))
+		b.Emit(compiler.Equal).Emit(compiler.Return)
+	}, value.TrueVal()},
+	{compiler.Greater, "greater", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(2)).EmitConstant(compiler.Constant, number(1))
+		b.Emit(compiler.Greater).Emit(compiler.Return)
+	}, value.TrueVal()},
+	{compiler.GreaterEqual, "greater equal", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, number(1))
+		b.Emit(compiler.GreaterEqual).Emit(compiler.Return)
+	}, value.TrueVal()},
+	{compiler.Less, "less", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(2)).EmitConstant(compiler.Constant, number(1))
+		b.Emit(compiler.Less).Emit(compiler.Return)
+	}, value.FalseVal()},
+	{compiler.LessEqual, "less equal", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, number(1))
+		b.Emit(compiler.LessEqual).Emit(compiler.Return)
+	}, value.TrueVal()},
+	{compiler.NotEqual, "not equal", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, str("1"))
+		b.Emit(compiler.NotEqual).Emit(compiler.Return)
+	}, value.TrueVal()},
+	{compiler.EqualConstant, "equal constant", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.EqualConstant, number(2))
+		b.Emit(compiler.Return)
+	}, value.FalseVal()},
+	{compiler.GreaterConstant, "greater constant", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(2)).EmitConstant(compiler.GreaterConstant, number(1))
+		b.Emit(compiler.Return)
+	}, value.TrueVal()},
+	{compiler.LessConstant, "less constant", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(2)).EmitConstant(compiler.LessConstant, number(1))
+		b.Emit(compiler.Return)
+	}, value.FalseVal()},
+	{compiler.AddLocals, "add locals", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, str("b"))
+		b.Emit(compiler.AddLocals, 1, 0).Emit(compiler.Return)
+	}, str("ba")},
+	{compiler.SubtractLocals, "subtract locals", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(5)).EmitConstant(compiler.Constant, number(3))
+		b.Emit(compiler.SubtractLocals, 0, 1).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.LessLocals, "less locals", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(5)).EmitConstant(compiler.Constant, number(3))
+		b.Emit(compiler.LessLocals, 1, 0).Emit(compiler.Return)
+	}, value.TrueVal()},
+
+	{compiler.Not, "not", func(b *compiler.ChunkBuilder) {
+		b.Emit(compiler.Nil).Emit(compiler.Not).Emit(compiler.Return)
+	}, value.TrueVal()},
+	{compiler.Negate, "negate", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(2)).Emit(compiler.Negate).Emit(compiler.Return)
+	}, number(-2)},
+
+	{compiler.Add, "add", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1.5)).EmitConstant(compiler.Constant, number(-2))
+		b.Emit(compiler.Add).Emit(compiler.Return)
+	}, number(-0.5)},
+	{compiler.Add, "add strings", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, str("b"))
+		b.Emit(compiler.Add).Emit(compiler.Return)
+	}, str("ab")},
+	{compiler.Divide, "divide", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, number(4))
+		b.Emit(compiler.Divide).Emit(compiler.Return)
+	}, number(0.25)},
+	{compiler.Divide, "divide by zero", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(-1)).EmitConstant(compiler.Constant, number(0))
+		b.Emit(compiler.Divide).Emit(compiler.Return)
+	}, number(math.Inf(-1))},
+	{compiler.Exponentiate, "exponentiate", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(2)).EmitConstant(compiler.Constant, number(-1))
+		b.Emit(compiler.Exponentiate).Emit(compiler.Return)
+	}, number(0.5)},
+	{compiler.Multiply, "multiply", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(-3)).EmitConstant(compiler.Constant, number(4))
+		b.Emit(compiler.Multiply).Emit(compiler.Return)
+	}, number(-12)},
+	{compiler.Multiply, "repeat string", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("ab")).EmitConstant(compiler.Constant, number(0))
+		b.Emit(compiler.Multiply).Emit(compiler.Return)
+	}, str("")},
+	{compiler.Reminder, "reminder", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(-7)).EmitConstant(compiler.Constant, number(3))
+		b.Emit(compiler.Reminder).Emit(compiler.Return)
+	}, number(-1)},
+	{compiler.Subtract, "subtract", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, number(3))
+		b.Emit(compiler.Subtract).Emit(compiler.Return)
+	}, number(-2)},
+
+	{compiler.Jump, "jump", func(b *compiler.ChunkBuilder) {
+		jump := b.EmitJump(compiler.Jump)
+		b.EmitConstant(compiler.Constant, number(1)).Emit(compiler.Return)
+		b.PatchJump(jump)
+		b.EmitConstant(compiler.Constant, number(2)).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.JumpIfFalsy, "jump if falsy", func(b *compiler.ChunkBuilder) {
+		b.Emit(compiler.False)
+		jump := b.EmitJump(compiler.JumpIfFalsy)
+		b.Emit(compiler.Pop).EmitConstant(compiler.Constant, number(1)).Emit(compiler.Return)
+		b.PatchJump(jump)
+		b.Emit(compiler.Pop).EmitConstant(compiler.Constant, number(2)).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.JumpIfFalsy, "no jump if truthy", func(b *compiler.ChunkBuilder) {
+		b.Emit(compiler.True)
+		jump := b.EmitJump(compiler.JumpIfFalsy)
+		b.Emit(compiler.Pop).EmitConstant(compiler.Constant, number(1)).Emit(compiler.Return)
+		b.PatchJump(jump)
+		b.Emit(compiler.Pop).EmitConstant(compiler.Constant, number(2)).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.JumpIfTruthy, "jump if truthy", func(b *compiler.ChunkBuilder) {
+		b.Emit(compiler.True)
+		jump := b.EmitJump(compiler.JumpIfTruthy)
+		b.Emit(compiler.Pop).EmitConstant(compiler.Constant, number(1)).Emit(compiler.Return)
+		b.PatchJump(jump)
+		b.Emit(compiler.Pop).EmitConstant(compiler.Constant, number(2)).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.JumpIfTruthy, "jump keeps the condition", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("a"))
+		jump := b.EmitJump(compiler.JumpIfTruthy)
+		b.PatchJump(jump)
+		b.Emit(compiler.Return)
+	}, str("a")},
+	{compiler.Loop, "loop", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(0))
+		start := b.Offset()
+		b.Emit(compiler.GetLocal, 0).EmitConstant(compiler.LessConstant, number(3))
+		exit := b.EmitJump(compiler.JumpIfFalsy)
+		b.Emit(compiler.Pop).Emit(compiler.GetLocal, 0).EmitConstant(compiler.Constant, number(1)).Emit(compiler.Add)
+		b.Emit(compiler.SetLocal, 0).Emit(compiler.Pop).EmitLoop(start)
+		b.PatchJump(exit)
+		b.Emit(compiler.Pop).Emit(compiler.GetLocal, 0).Emit(compiler.Return)
+	}, number(3)},
+
+	{compiler.Call, "call", func(b *compiler.ChunkBuilder) {
+		f := compiler.NewChunkBuilder("f")
+		f.Emit(compiler.GetLocal, 1).Emit(compiler.GetLocal, 2).Emit(compiler.Subtract).Emit(compiler.Return)
+
+		b.EmitConstant(compiler.Closure, compiler.FunctionVal(f.Function(2)))
+		b.EmitConstant(compiler.Constant, number(5)).EmitConstant(compiler.Constant, number(3))
+		b.Emit(compiler.Call, 2).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.Closure, "closure", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Closure, function(func(f *compiler.ChunkBuilder) {
+			f.EmitConstant(compiler.Constant, number(1)).Emit(compiler.Return)
+		}))
+		b.Emit(compiler.Call, 0).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.Closure, "closure of upvalue", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1))
+		b.EmitConstant(compiler.Closure, function(func(f *compiler.ChunkBuilder) {
+			f.EmitConstant(compiler.Closure, function(func(g *compiler.ChunkBuilder) {
+				g.Emit(compiler.GetUpvalue, 0).Emit(compiler.Return)
+			}, compiler.NewUpvalue(0, false)))
+			f.Emit(compiler.Call, 0).Emit(compiler.Return)
+		}, compiler.NewUpvalue(0, true)))
+		b.Emit(compiler.Call, 0).Emit(compiler.Return)
+	}, number(1)},
+	{compiler.Record, "record", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, number(1))
+		b.EmitConstant(compiler.Constant, str("b")).EmitConstant(compiler.Constant, number(2))
+		b.Emit(compiler.Record, 2).EmitConstant(compiler.GetProperty, str("b")).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.MergeRecords, "merge records", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, number(1)).Emit(compiler.Record, 1)
+		b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, number(2)).Emit(compiler.Record, 1)
+		b.Emit(compiler.MergeRecords).EmitConstant(compiler.GetProperty, str("a")).Emit(compiler.Return)
+	}, number(2)},
+	{compiler.CheckType, "check type", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.CheckType, str("number"))
+		b.Emit(compiler.Return)
+	}, number(1)},
+	{compiler.ReturnNil, "return nil", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).Emit(compiler.ReturnNil)
+	}, value.NilVal()},
+	{compiler.Return, "return", func(b *compiler.ChunkBuilder) {
+		b.EmitConstant(compiler.Constant, number(1)).EmitConstant(compiler.Constant, number(2))
+		b.Emit(compiler.Return)
+	}, number(2)},
+}
+
+func TestOpCodes(t *testing.T) {
+	for _, test := range opCodeTests {
+		b := compiler.NewChunkBuilder(test.name)
+		test.build(b)
+
+		if result := runChunk(t, test.name, b.Chunk()); result != test.expected {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.name, result)
+		}
+	}
+}
+
+func TestEveryOpCodeIsTested(t *testing.T) {
+	tested := make(map[compiler.OpCode]bool)
+	for _, test := range opCodeTests {
+		tested[test.op] = true
+	}
+
+	for op := compiler.Constant; op <= compiler.Return; op++ {
+		if !tested[op] && !unimplementedOpCodes[op] {
+			t.Errorf("Expected a test for %s", op)
+		}
+	}
+}
+
+func TestOpCodeRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   func(b *compiler.ChunkBuilder)
+		message string
+	}{
+		{"get global", func(b *compiler.ChunkBuilder) {
+			b.EmitConstant(compiler.GetGlobal, str("a")).Emit(compiler.Return)
+		}, "Undefined global variable 'a'"},
+		{"set global", func(b *compiler.ChunkBuilder) {
+			b.Emit(compiler.Nil).EmitConstant(compiler.SetGlobal, str("a")).Emit(compiler.Return)
+		}, "Undefined global variable 'a'"},
+		{"add", func(b *compiler.ChunkBuilder) {
+			b.EmitConstant(compiler.Constant, number(1)).Emit(compiler.Nil).Emit(compiler.Add).Emit(compiler.Return)
+		}, "Both operands must be numbers."},
+		{"add locals", func(b *compiler.ChunkBuilder) {
+			b.EmitConstant(compiler.Constant, number(1)).Emit(compiler.Nil).Emit(compiler.AddLocals, 0, 1).Emit(compiler.Return)
+		}, "Both operands must be numbers."},
+		{"multiply", func(b *compiler.ChunkBuilder) {
+			b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, number(-1))
+			b.Emit(compiler.Multiply).Emit(compiler.Return)
+		}, "Repeat count cannot be negative."},
+		{"call", func(b *compiler.ChunkBuilder) {
+			b.Emit(compiler.Nil).Emit(compiler.Call, 0).Emit(compiler.Return)
+		}, "Can only call functions and natives, got nil."},
+		{"call arity", func(b *compiler.ChunkBuilder) {
+			b.EmitConstant(compiler.Closure, function(func(f *compiler.ChunkBuilder) {
+				f.Emit(compiler.Nil).Emit(compiler.Return)
+			}))
+			b.Emit(compiler.Nil).Emit(compiler.Call, 1).Emit(compiler.Return)
+		}, "Expected 0 arguments but got 1."},
+		{"get property", func(b *compiler.ChunkBuilder) {
+			b.Emit(compiler.Nil).EmitConstant(compiler.GetProperty, str("a")).Emit(compiler.Return)
+		}, "Only records have fields, got nil."},
+		{"set property", func(b *compiler.ChunkBuilder) {
+			b.EmitConstant(compiler.Constant, str("a")).EmitConstant(compiler.Constant, number(1)).Emit(compiler.Record, 1)
+			b.Emit(compiler.Nil).EmitConstant(compiler.SetProperty, str("b")).Emit(compiler.Return)
+		}, "Undefined field 'b'."},
+		{"record", func(b *compiler.ChunkBuilder) {
+			b.Emit(compiler.Nil).Emit(compiler.Nil).Emit(compiler.Record, 1).Emit(compiler.Return)
+		}, "Field names must be strings, got nil."},
+		{"merge records", func(b *compiler.ChunkBuilder) {
+			b.Emit(compiler.Record, 0).Emit(compiler.True).Emit(compiler.MergeRecords).Emit(compiler.Return)
+		}, "Can only spread records, got boolean."},
+		{"check type", func(b *compiler.ChunkBuilder) {
+			b.Emit(compiler.Nil).EmitConstant(compiler.CheckType, str("number")).Emit(compiler.Return)
+		}, "Expected type number but got nil."},
+		{"pop", func(b *compiler.ChunkBuilder) {
+			b.Emit(compiler.Nil).Emit(compiler.Pop).Emit(compiler.Pop).Emit(compiler.Nil).Emit(compiler.Return)
+		}, "Stack underflow at offset 2."},
+		{"return", func(b *compiler.ChunkBuilder) {
+			b.Emit(compiler.Nil).Emit(compiler.Pop).Emit(compiler.Return)
+		}, "Stack underflow at offset 2."},
+	}
+
+	for _, test := range tests {
+		b := compiler.NewChunkBuilder(test.name)
+		test.build(b)
+
+		vm := NewVM()
+		_, err := vm.Interpret(b.Chunk())
+
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Errorf("Expected runtime error for %s, got %v", test.name, err)
+			continue
+		}
+
+		if runtimeErr.Message != test.message {
+			t.Errorf("Expected '%s' for %s, got '%s'", test.message, test.name, runtimeErr.Message)
+		}
+	}
+}
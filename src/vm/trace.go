@@ -0,0 +1,147 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/adamjedlicka/go-blu/src/compiler"
+	"github.com/adamjedlicka/go-blu/src/value"
+)
+
+// Trace is a record of every instruction a chunk executed, which can be replayed to check that executing the chunk
+// again behaves the same. A step of the trace is the offset of the instruction in its chunk and the change of the
+// stack size caused by the previous instruction, both stored as varints.
+type Trace struct {
+	// The chunk the trace was recorded for.
+	chunk *compiler.Chunk
+	steps []byte
+	count int
+}
+
+func NewTrace() *Trace {
+	return &Trace{
+		chunk: nil,
+		steps: make([]byte, 0),
+		count: 0,
+	}
+}
+
+// Returns the number of executed instructions.
+func (t *Trace) Len() int {
+	return t.count
+}
+
+// Error returned when executing a chunk again does not follow its recorded trace.
+type ReplayError struct {
+	// Index of the first step which differs from the trace.
+	Step    int
+	Message string
+}
+
+func (e *ReplayError) Error() string {
+	return e.Message
+}
+
+// State of the trace being recorded or replayed by Interpret.
+type tracer struct {
+	trace     *Trace
+	replaying bool
+
+	// Index of the next step and its position in the encoded steps.
+	step     int
+	position int
+	// Stack size at the previous step.
+	stackLen int
+}
+
+// Records the instructions executed by the following calls of Interpret into the trace, replacing what it held
+// before. A nil trace stops recording.
+func (vm *VM) RecordTrace(trace *Trace) {
+	if trace == nil {
+		vm.tracer = nil
+		return
+	}
+
+	vm.tracer = &tracer{trace: trace}
+}
+
+// Executes the chunk of the trace again and checks that every instruction matches the recorded one. Globals the
+// chunk uses must be defined the same way as when the trace was recorded.
+func (vm *VM) Replay(trace *Trace) (value.Value, error) {
+	recording := vm.tracer
+	defer func() { vm.tracer = recording }()
+
+	replay := &tracer{trace: trace, replaying: true}
+	vm.tracer = replay
+
+	result, err := vm.Interpret(trace.chunk)
+	if err != nil {
+		return result, err
+	}
+
+	if replay.step != trace.count {
+		return value.NilVal(), &ReplayError{
+			Step:    replay.step,
+			Message: fmt.Sprintf("Execution ended after %d of %d steps of the trace.", replay.step, trace.count),
+		}
+	}
+
+	return result, nil
+}
+
+// Prepares the tracer for interpreting the chunk from its start.
+func (t *tracer) begin(chunk *compiler.Chunk) {
+	t.step = 0
+	t.position = 0
+	t.stackLen = 0
+
+	if !t.replaying {
+		t.trace.chunk = chunk
+		t.trace.steps = t.trace.steps[:0]
+		t.trace.count = 0
+	}
+}
+
+// Records the instruction about to execute, or checks it against the trace being replayed.
+func (vm *VM) traceStep() error {
+	t := vm.tracer
+
+	offset := vm.frame.ip
+	delta := vm.stackLen - t.stackLen
+	t.stackLen = vm.stackLen
+
+	if !t.replaying {
+		var buffer [2 * binary.MaxVarintLen64]byte
+
+		n := binary.PutUvarint(buffer[:], uint64(offset))
+		n += binary.PutVarint(buffer[n:], int64(delta))
+
+		t.trace.steps = append(t.trace.steps, buffer[:n]...)
+		t.trace.count++
+
+		return nil
+	}
+
+	if t.step == t.trace.count {
+		return &ReplayError{
+			Step:    t.step,
+			Message: fmt.Sprintf("Execution continued past the %d steps of the trace.", t.trace.count),
+		}
+	}
+
+	expectedOffset, n := binary.Uvarint(t.trace.steps[t.position:])
+	t.position += n
+	expectedDelta, n := binary.Varint(t.trace.steps[t.position:])
+	t.position += n
+
+	if int(expectedOffset) != offset || int(expectedDelta) != delta {
+		return &ReplayError{
+			Step: t.step,
+			Message: fmt.Sprintf("Execution diverged from the trace at step %d: expected offset %d and stack change %d, "+
+				"got offset %d and stack change %d.", t.step, expectedOffset, expectedDelta, offset, delta),
+		}
+	}
+
+	t.step++
+
+	return nil
+}
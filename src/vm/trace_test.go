@@ -0,0 +1,68 @@
+package vm
+
+import (
+	"github.com/adamjedlicka/go-blu/src/value"
+	"testing"
+)
+
+func TestReplayFollowsRecordedTrace(t *testing.T) {
+	source := "fn square(x) {\nreturn x * x\n}\nvar sum = 0\nfor var i = 0; i < 5; i = i + 1 {\nsum = sum + square(i) % 7\n}\nreturn sum - 1"
+
+	trace := NewTrace()
+
+	recorder := NewVM()
+	recorder.RecordTrace(trace)
+
+	expected, err := recorder.Interpret(compile(source))
+	if err != nil {
+		t.Fatalf("Failed to run '%s': %s", source, err)
+	}
+
+	if trace.Len() == 0 {
+		t.Fatalf("Expected recorded steps, got none")
+	}
+
+	vm := NewVM()
+
+	result, err := vm.Replay(trace)
+	if err != nil {
+		t.Fatalf("Expected replay to follow the trace, got %s", err)
+	}
+
+	if result != expected || result != value.NumberVal(8) {
+		t.Errorf("Expected %v from replay, got %v", expected, result)
+	}
+}
+
+func TestReplayReportsDivergence(t *testing.T) {
+	source := "var a = 1\nif n > 1 {\na = 2\n}\nreturn a"
+
+	trace := NewTrace()
+
+	recorder := NewVM()
+	if _, err := recorder.Exec("var n = 1"); err != nil {
+		t.Fatalf("Failed to define n: %s", err)
+	}
+
+	recorder.RecordTrace(trace)
+	if _, err := recorder.Interpret(compile(source)); err != nil {
+		t.Fatalf("Failed to run '%s': %s", source, err)
+	}
+
+	vm := NewVM()
+	if _, err := vm.Exec("var n = 2"); err != nil {
+		t.Fatalf("Failed to define n: %s", err)
+	}
+
+	_, err := vm.Replay(trace)
+
+	replayErr, ok := err.(*ReplayError)
+	if !ok {
+		t.Fatalf("Expected the replay to diverge, got %v", err)
+	}
+
+	// The condition is evaluated by the first five instructions
+	if replayErr.Step != 5 {
+		t.Errorf("Expected divergence at step 5, got %s", replayErr)
+	}
+}
@@ -5,63 +5,249 @@ import (
 	"github.com/adamjedlicka/go-blu/src/compiler"
 	"github.com/adamjedlicka/go-blu/src/parser"
 	"github.com/adamjedlicka/go-blu/src/value"
+	"io"
 	"math"
-	"os"
+	"sort"
+	"strings"
 )
 
-const StackMax = 256
+const FramesMax = 64
+const StackMax = FramesMax * 256
 
-type VM struct {
-	chunk *compiler.Chunk
+// Length in bytes of the longest string repeating a string can create.
+const MaxRepeatLength = 1 << 30
+
+type CallFrame struct {
+	// The called closure, nil for the frame of the script itself.
+	closure *Closure
+	chunk   *compiler.Chunk
 
 	ip int
 
-	stack    [StackMax]value.Value
+	// Index of the first stack slot belonging to the frame.
+	slots int
+}
+
+type VM struct {
+	frames     [FramesMax]CallFrame
+	frameCount int
+	// The frame currently being executed.
+	frame *CallFrame
+
+	stack    []value.Value
 	stackLen int
+	// Upvalues still pointing into the stack, starting with the one closest to the top.
+	openUpvalues *Upvalue
 
 	globals map[value.String]value.Value
+	// Every defined native by its name, even if a script has assigned something else to its global since.
+	natives map[string]*value.Native
+
+	// Options used to compile sources passed to Exec.
+	options compiler.CompilerOptions
+	// Interner shared by the sources passed to Exec, nil if each of them keeps its own strings.
+	interner *value.Interner
+
+	budget MemoryBudget
+
+	lineHook LineHook
+	// Line and frame the line hook was last called for.
+	hookLine  int
+	hookFrame *CallFrame
+
+	// Trace being recorded or replayed, nil if there is none.
+	tracer *tracer
 }
 
 func NewVM() VM {
-	return VM{
-		chunk: nil,
+	vm := VM{
+		frameCount: 0,
+		frame:      nil,
 
-		stack: [StackMax]value.Value{},
-		ip:    0,
+		stack: make([]value.Value, StackMax),
 
 		globals: make(map[value.String]value.Value),
+		natives: make(map[string]*value.Native),
+
+		budget: unlimitedBudget{},
 	}
+
+	vm.defineNatives()
+
+	return vm
 }
 
-func Exec(source string) value.Value {
+func Exec(source string) (value.Value, error) {
 	vm := NewVM()
 
 	return vm.Exec(source)
 }
 
-func (vm *VM) Exec(source string) value.Value {
-	p := parser.NewParser([]rune(source))
-	c := compiler.NewCompiler("script", p)
+func (vm *VM) Exec(source string) (value.Value, error) {
+	p := parser.NewParser(parser.Runes(source))
+	c := compiler.NewCompilerWithOptions("script", p, vm.options)
+	c.SetInterner(vm.interner)
 	chunk := c.Compile()
 	if chunk == nil {
-		return value.NilVal()
+		return value.NilVal(), &CompileError{Errors: c.Errors()}
+	}
+
+	return vm.Interpret(chunk)
+}
+
+// Runs the source as a program, which prints the value it returns to out unless it is nil.
+func RunProgram(source string, out io.Writer) error {
+	vm := NewVM()
+
+	return vm.RunProgram(source, out)
+}
+
+func (vm *VM) RunProgram(source string, out io.Writer) error {
+	result, err := vm.Exec(source)
+	if err != nil {
+		return err
+	}
+
+	if value.IsNil(result) {
+		return nil
+	}
+
+	_, err = fmt.Fprintln(out, result)
+
+	return err
+}
+
+// Evaluates a single expression with the variables of the environment defined as globals, for using the language to
+// compute filters or fields.
+func EvalWith(expr string, env map[string]value.Value) (value.Value, error) {
+	vm := NewVM()
+
+	return vm.EvalWith(expr, env)
+}
+
+// Defines the variables of the environment as globals of the VM, which stay defined after the expression is
+// evaluated. Referring to any other variable than a global of the VM is a compile error.
+func (vm *VM) EvalWith(expr string, env map[string]value.Value) (value.Value, error) {
+	for name, val := range env {
+		vm.globals[value.String(name)] = val
+	}
+
+	c := compiler.NewCompilerWithOptions("expression", parser.NewParser(parser.Runes(expr)), vm.options)
+	c.SetInterner(vm.interner)
+	chunk := c.CompileExpression(vm.globalNames()...)
+	if chunk == nil {
+		return value.NilVal(), &CompileError{Errors: c.Errors()}
 	}
 
 	return vm.Interpret(chunk)
 }
 
-func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
-	vm.chunk = chunk
-	vm.ip = 0
+// Reports the problems of the source like compiler.Check, treating the natives as defined.
+func Check(source string) []compiler.Diagnostic {
+	vm := NewVM()
 
+	return vm.Check(source)
+}
+
+// Reports the problems of the source like compiler.Check, treating every global of the VM as defined.
+func (vm *VM) Check(source string) []compiler.Diagnostic {
+	return compiler.Check(source, vm.globalNames()...)
+}
+
+// Returns the names of all globals defined in the VM, natives included.
+func (vm *VM) globalNames() []string {
+	names := make([]string, 0, len(vm.globals))
+	for name := range vm.globals {
+		names = append(names, string(name))
+	}
+
+	return names
+}
+
+func (vm *VM) SetCompilerOptions(options compiler.CompilerOptions) {
+	vm.options = options
+}
+
+// Makes string constants of all sources passed to Exec share their storage.
+func (vm *VM) SetInterner(interner *value.Interner) {
+	vm.interner = interner
+}
+
+func (vm *VM) SetMemoryBudget(budget MemoryBudget) {
+	vm.budget = budget
+}
+
+// Makes the Go function available to scripts as a global variable of the given name.
+// Arity is the number of arguments the function expects, or -1 if it accepts any number of them.
+func (vm *VM) DefineNative(name string, arity int, fn value.NativeFn) {
+	vm.DefineDocumentedNative(name, arity, "", fn)
+}
+
+// Defines a native together with a description of what it does, which the doc native returns.
+func (vm *VM) DefineDocumentedNative(name string, arity int, doc string, fn value.NativeFn) {
+	native := value.NewDocumentedNative(name, arity, doc, fn)
+
+	vm.natives[name] = native
+	vm.globals[value.String(name)] = value.NativeVal(native)
+}
+
+// Returns all defined natives sorted by their names.
+func (vm *VM) Natives() []*value.Native {
+	natives := make([]*value.Native, 0, len(vm.natives))
+	for _, native := range vm.natives {
+		natives = append(natives, native)
+	}
+
+	sort.Slice(natives, func(i, j int) bool {
+		return natives[i].Name() < natives[j].Name()
+	})
+
+	return natives
+}
+
+// Returns the value of the global variable and whether it is defined.
+func (vm *VM) Global(name string) (value.Value, bool) {
+	val, ok := vm.globals[value.String(name)]
+
+	return val, ok
+}
+
+func (vm *VM) Interpret(chunk *compiler.Chunk) (value.Value, error) {
 	vm.stackLen = 0
+	vm.openUpvalues = nil
+
+	vm.frames[0] = CallFrame{
+		closure: nil,
+		chunk:   chunk,
+		ip:      0,
+		slots:   0,
+	}
+	vm.frameCount = 1
+	vm.frame = &vm.frames[0]
+
+	vm.hookLine = -1
+	vm.hookFrame = nil
+
+	if vm.tracer != nil {
+		vm.tracer.begin(chunk)
+	}
 
 	for true {
+		if vm.lineHook != nil {
+			vm.traceLine()
+		}
+
+		if vm.tracer != nil {
+			if err := vm.traceStep(); err != nil {
+				return value.NilVal(), err
+			}
+		}
+
 		switch compiler.OpCode(vm.readByte()) {
 
 		case compiler.Constant:
 			offset := vm.readShort()
-			constant := vm.chunk.Constants()[offset]
+			constant := vm.frame.chunk.Constants()[offset]
 
 			vm.Push(constant)
 
@@ -75,17 +261,26 @@ func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
 			vm.Push(value.NilVal())
 
 		case compiler.Pop:
+			if vm.stackLen == 0 {
+				return value.NilVal(), vm.stackUnderflow()
+			}
+
 			vm.Pop()
 
+		case compiler.Dup:
+			vm.Push(vm.Peek(0))
+
+		case compiler.Nop:
+
 		case compiler.GetLocal:
 			slot := vm.readShort()
 
-			vm.Push(vm.stack[slot])
+			vm.Push(vm.stack[vm.frame.slots+int(slot)])
 
 		case compiler.SetLocal:
 			slot := vm.readShort()
 
-			vm.stack[slot] = vm.Peek(0)
+			vm.stack[vm.frame.slots+int(slot)] = vm.Peek(0)
 
 		case compiler.DefineGlobal:
 			name := vm.readString()
@@ -98,8 +293,7 @@ func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
 			if val, ok := vm.globals[name]; ok {
 				vm.Push(val)
 			} else {
-				vm.runtimeError("Undefined global variable '%s'", name.ToString())
-				return value.NilVal()
+				return value.NilVal(), vm.runtimeError("Undefined global variable '%s'", name.ToString())
 			}
 
 		case compiler.SetGlobal:
@@ -108,21 +302,56 @@ func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
 			if _, ok := vm.globals[name]; ok {
 				vm.globals[name] = vm.Peek(0)
 			} else {
-				vm.runtimeError("Undefined global variable '%s'", name.ToString())
-				return value.NilVal()
+				return value.NilVal(), vm.runtimeError("Undefined global variable '%s'", name.ToString())
 			}
 
 		case compiler.GetUpvalue:
-			panic("unimplemented")
+			slot := vm.readShort()
+
+			vm.Push(*vm.frame.closure.upvalues[slot].location)
 
 		case compiler.SetUpvalue:
-			panic("unimplemented")
+			slot := vm.readShort()
+
+			*vm.frame.closure.upvalues[slot].location = vm.Peek(0)
+
+		case compiler.CloseUpvalues:
+			slot := vm.readShort()
+
+			vm.closeUpvalues(vm.frame.slots + int(slot))
 
 		case compiler.GetProperty:
-			panic("unimplemented")
+			name := vm.readString()
+
+			record, ok := asRecord(vm.Peek(0))
+			if !ok {
+				return value.NilVal(), vm.runtimeError("Only records have fields, got %s.", value.TypeName(vm.Peek(0)))
+			}
+
+			field, ok := record.Get(name)
+			if !ok {
+				return value.NilVal(), vm.runtimeError("Undefined field '%s'.", name.ToString())
+			}
+
+			vm.Pop()
+			vm.Push(field)
 
 		case compiler.SetProperty:
-			panic("unimplemented")
+			name := vm.readString()
+
+			record, ok := asRecord(vm.Peek(1))
+			if !ok {
+				return value.NilVal(), vm.runtimeError("Only records have fields, got %s.", value.TypeName(vm.Peek(1)))
+			}
+
+			if !record.Set(name, vm.Peek(0)) {
+				return value.NilVal(), vm.runtimeError("Undefined field '%s'.", name.ToString())
+			}
+
+			// Assignment evaluates to the assigned value
+			field := vm.Pop()
+			vm.Pop()
+			vm.Push(field)
 
 		case compiler.GetSubscript:
 			panic("unimplemented")
@@ -131,10 +360,10 @@ func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
 			panic("unimplemented")
 
 		case compiler.Equal:
-			left := vm.Pop()
 			right := vm.Pop()
+			left := vm.Pop()
 
-			vm.Push(value.BooleanVal(left == right))
+			vm.Push(value.BooleanVal(value.Equals(left, right)))
 
 		case compiler.Greater:
 			right := value.AsNumber(vm.Pop())
@@ -164,7 +393,25 @@ func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
 			right := vm.Pop()
 			left := vm.Pop()
 
-			vm.Push(value.BooleanVal(left != right))
+			vm.Push(value.BooleanVal(!value.Equals(left, right)))
+
+		case compiler.EqualConstant:
+			right := vm.readConstant()
+			left := vm.Pop()
+
+			vm.Push(value.BooleanVal(value.Equals(left, right)))
+
+		case compiler.GreaterConstant:
+			right := value.AsNumber(vm.readConstant())
+			left := value.AsNumber(vm.Pop())
+
+			vm.Push(value.BooleanVal(left > right))
+
+		case compiler.LessConstant:
+			right := value.AsNumber(vm.readConstant())
+			left := value.AsNumber(vm.Pop())
+
+			vm.Push(value.BooleanVal(left < right))
 
 		case compiler.Not:
 			vm.Push(value.BooleanVal(!value.IsTruthy(vm.Pop())))
@@ -172,20 +419,32 @@ func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
 		case compiler.Negate:
 			vm.Push(value.NumberVal(-value.AsNumber(vm.Pop())))
 
+		case compiler.AddLocals:
+			left := vm.stack[vm.frame.slots+int(vm.readShort())]
+			right := vm.stack[vm.frame.slots+int(vm.readShort())]
+
+			if err := vm.add(left, right); err != nil {
+				return value.NilVal(), err
+			}
+
+		case compiler.SubtractLocals:
+			left := value.AsNumber(vm.stack[vm.frame.slots+int(vm.readShort())])
+			right := value.AsNumber(vm.stack[vm.frame.slots+int(vm.readShort())])
+
+			vm.Push(value.NumberVal(left - right))
+
+		case compiler.LessLocals:
+			left := value.AsNumber(vm.stack[vm.frame.slots+int(vm.readShort())])
+			right := value.AsNumber(vm.stack[vm.frame.slots+int(vm.readShort())])
+
+			vm.Push(value.BooleanVal(left < right))
+
 		case compiler.Add:
 			right := vm.Pop()
 			left := vm.Pop()
 
-			if value.IsNumber(left) && value.IsNumber(right) {
-				vm.Push(value.NumberVal(value.AsNumber(left) + value.AsNumber(right)))
-			} else if value.IsObject(left) && value.IsObject(right) {
-				left := value.AsObject(left).(value.String)
-				right := value.AsObject(right).(value.String)
-
-				vm.Push(value.StringVal(string(left + right)))
-			} else {
-				vm.runtimeError("Both operands must be numbers.")
-				return value.NilVal()
+			if err := vm.add(left, right); err != nil {
+				return value.NilVal(), err
 			}
 
 		case compiler.Divide:
@@ -201,10 +460,21 @@ func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
 			vm.Push(value.NumberVal(math.Pow(left, right)))
 
 		case compiler.Multiply:
-			right := value.AsNumber(vm.Pop())
-			left := value.AsNumber(vm.Pop())
+			right := vm.Pop()
+			left := vm.Pop()
 
-			vm.Push(value.NumberVal(left * right))
+			if value.IsNumber(left) && value.IsNumber(right) {
+				vm.Push(value.NumberVal(value.AsNumber(left) * value.AsNumber(right)))
+			} else if str, ok := asString(left); ok && value.IsNumber(right) {
+				repeated, err := vm.repeat(str, value.AsNumber(right))
+				if err != nil {
+					return value.NilVal(), err
+				}
+
+				vm.Push(repeated)
+			} else {
+				return value.NilVal(), vm.runtimeError("Operands must be numbers, or a string and a count.")
+			}
 
 		case compiler.Reminder:
 			right := value.AsNumber(vm.Pop())
@@ -221,36 +491,313 @@ func (vm *VM) Interpret(chunk *compiler.Chunk) value.Value {
 		case compiler.Jump:
 			offset := vm.readShort()
 
-			vm.ip += int(offset)
+			vm.frame.ip += int(offset)
 
 		case compiler.JumpIfFalsy:
 			offset := vm.readShort()
 
 			if !value.IsTruthy(vm.Peek(0)) {
-				vm.ip += int(offset)
+				vm.frame.ip += int(offset)
 			}
 
 		case compiler.JumpIfTruthy:
 			offset := vm.readShort()
 
 			if value.IsTruthy(vm.Peek(0)) {
-				vm.ip += int(offset)
+				vm.frame.ip += int(offset)
 			}
 
 		case compiler.Loop:
 			offset := vm.readShort()
 
-			vm.ip -= int(offset)
+			vm.frame.ip -= int(offset)
+
+		case compiler.Call:
+			argCount := int(vm.readByte())
+
+			if err := vm.callValue(vm.Peek(argCount), argCount); err != nil {
+				return value.NilVal(), err
+			}
+
+		case compiler.CheckType:
+			expected := vm.readString()
+
+			if actual := value.TypeName(vm.Peek(0)); actual != string(expected) {
+				return value.NilVal(), vm.runtimeError("Expected type %s but got %s.", expected, actual)
+			}
+
+		case compiler.Closure:
+			function := value.AsObject(vm.readConstant()).(*compiler.Function)
+
+			if err := vm.charge(closureSize(len(function.Upvalues()))); err != nil {
+				return value.NilVal(), err
+			}
+
+			closure := NewClosure(function)
+
+			for i, upvalue := range function.Upvalues() {
+				if upvalue.IsLocal() {
+					closure.upvalues[i] = vm.captureUpvalue(vm.frame.slots + int(upvalue.Index()))
+				} else {
+					closure.upvalues[i] = vm.frame.closure.upvalues[upvalue.Index()]
+				}
+			}
+
+			vm.Push(ClosureVal(closure))
+
+		case compiler.Record:
+			fieldCount := int(vm.readByte())
+
+			if err := vm.charge(recordSize(fieldCount)); err != nil {
+				return value.NilVal(), err
+			}
+
+			names := make([]value.String, fieldCount)
+			values := make([]value.Value, fieldCount)
+
+			// Names and values of the fields alternate on the stack
+			first := vm.stackLen - fieldCount*2
+			for i := 0; i < fieldCount; i++ {
+				name, ok := asString(vm.stack[first+i*2])
+				if !ok {
+					return value.NilVal(), vm.runtimeError("Field names must be strings, got %s.", value.TypeName(vm.stack[first+i*2]))
+				}
+
+				names[i] = name
+				values[i] = vm.stack[first+i*2+1]
+			}
+
+			vm.stackLen = first
+
+			vm.Push(value.RecordVal(value.NewRecord(names, values)))
+
+		case compiler.MergeRecords:
+			base, ok := asRecord(vm.Peek(1))
+			if !ok {
+				return value.NilVal(), vm.runtimeError("Can only spread records, got %s.", value.TypeName(vm.Peek(1)))
+			}
+
+			spread, ok := asRecord(vm.Peek(0))
+			if !ok {
+				return value.NilVal(), vm.runtimeError("Can only spread records, got %s.", value.TypeName(vm.Peek(0)))
+			}
+
+			merged := base.Merge(spread)
+
+			if err := vm.charge(recordSize(len(merged.Fields()))); err != nil {
+				return value.NilVal(), err
+			}
+
+			vm.stackLen -= 2
+
+			vm.Push(value.RecordVal(merged))
+
+		case compiler.ReturnNil:
+			vm.Push(value.NilVal())
+			fallthrough
 
 		case compiler.Return:
-			return vm.Pop()
+			if vm.stackLen == 0 {
+				return value.NilVal(), vm.stackUnderflow()
+			}
+
+			result := vm.Pop()
+
+			// Discard the locals, arguments and the called function
+			vm.closeUpvalues(vm.frame.slots)
+			vm.stackLen = vm.frame.slots
+			vm.frameCount--
+
+			if vm.frameCount == 0 {
+				return result, nil
+			}
+
+			vm.frame = &vm.frames[vm.frameCount-1]
+
+			vm.Push(result)
 
 		default:
 			panic("unreachable")
 		}
 	}
 
-	return value.NilVal()
+	return value.NilVal(), nil
+}
+
+func (vm *VM) callValue(callee value.Value, argCount int) error {
+	if value.IsObject(callee) {
+		switch callee := value.AsObject(callee).(type) {
+		case *Closure:
+			return vm.call(callee, argCount)
+		case *value.Native:
+			return vm.callNative(callee, argCount)
+		}
+	}
+
+	return vm.runtimeError("Can only call functions and natives, got %s.", value.TypeName(callee))
+}
+
+func (vm *VM) call(closure *Closure, argCount int) error {
+	function := closure.function
+
+	if argCount < function.MinArity() || argCount > function.Arity() {
+		if function.MinArity() == function.Arity() {
+			return vm.runtimeError("Expected %d arguments but got %d.", function.Arity(), argCount)
+		}
+
+		return vm.runtimeError("Expected %d to %d arguments but got %d.", function.MinArity(), function.Arity(), argCount)
+	}
+
+	if vm.frameCount == FramesMax {
+		return vm.runtimeError("Stack overflow.")
+	}
+
+	// Reserve slots for omitted arguments, the function evaluates their default values
+	for i := argCount; i < function.Arity(); i++ {
+		vm.Push(value.NilVal())
+	}
+
+	vm.frame = &vm.frames[vm.frameCount]
+	vm.frameCount++
+
+	vm.frame.closure = closure
+	vm.frame.chunk = function.Chunk()
+	vm.frame.ip = function.Entry(argCount)
+	vm.frame.slots = vm.stackLen - function.Arity() - 1
+
+	return nil
+}
+
+func (vm *VM) callNative(native *value.Native, argCount int) error {
+	if native.Arity() != -1 && native.Arity() != argCount {
+		return vm.runtimeError("Expected %d arguments but got %d.", native.Arity(), argCount)
+	}
+
+	result, err := native.Call(vm.stack[vm.stackLen-argCount : vm.stackLen])
+	if err != nil {
+		// The error is reported at the call site
+		runtimeErr := vm.runtimeError("%s", err.Error())
+		runtimeErr.Err = err
+
+		return runtimeErr
+	}
+
+	// Strings are the only heap values natives create
+	if str, ok := asString(result); ok {
+		if err := vm.charge(len(str)); err != nil {
+			return err
+		}
+	}
+
+	// Pop the arguments and the callee
+	vm.stackLen -= argCount + 1
+
+	vm.Push(result)
+
+	return nil
+}
+
+// Pushes the sum of the numbers or the concatenation of the strings.
+func (vm *VM) add(left value.Value, right value.Value) error {
+	if value.IsNumber(left) && value.IsNumber(right) {
+		vm.Push(value.NumberVal(value.AsNumber(left) + value.AsNumber(right)))
+	} else if leftString, ok := asString(left); ok {
+		rightString, ok := asString(right)
+		if !ok {
+			return vm.runtimeError("Can only add a string to a string, got %s.", value.TypeName(right))
+		}
+
+		if err := vm.charge(len(leftString) + len(rightString)); err != nil {
+			return err
+		}
+
+		vm.Push(value.StringVal(string(leftString + rightString)))
+	} else if _, ok := asString(right); ok {
+		return vm.runtimeError("Can only add a string to a string, got %s.", value.TypeName(left))
+	} else {
+		return vm.runtimeError("Both operands must be numbers.")
+	}
+
+	return nil
+}
+
+// Repeats the string count times. Count has to be a non-negative integer, zero gives an empty string.
+func (vm *VM) repeat(str value.String, count float64) (value.Value, error) {
+	if count != math.Trunc(count) || math.IsInf(count, 0) {
+		return value.NilVal(), vm.runtimeError("Repeat count must be an integer.")
+	}
+
+	if count < 0 {
+		return value.NilVal(), vm.runtimeError("Repeat count cannot be negative.")
+	}
+
+	// Checking the count first keeps the length from overflowing
+	if count > MaxRepeatLength {
+		return value.NilVal(), vm.runtimeError("Repeat count cannot be larger than %d.", MaxRepeatLength)
+	}
+
+	if len(str)*int(count) > MaxRepeatLength {
+		return value.NilVal(), vm.runtimeError("Repeated string would be longer than %d bytes.", MaxRepeatLength)
+	}
+
+	if err := vm.charge(len(str) * int(count)); err != nil {
+		return value.NilVal(), err
+	}
+
+	return value.StringVal(strings.Repeat(string(str), int(count))), nil
+}
+
+// Charges the memory budget for a new heap value.
+func (vm *VM) charge(size int) error {
+	if err := vm.budget.Charge(size); err != nil {
+		runtimeErr := vm.runtimeError("Out of memory: %s", err.Error())
+		runtimeErr.Err = err
+
+		return runtimeErr
+	}
+
+	return nil
+}
+
+// Returns the upvalue capturing the stack slot, reusing the open one if the slot is already captured.
+func (vm *VM) captureUpvalue(slot int) *Upvalue {
+	var previous *Upvalue
+	upvalue := vm.openUpvalues
+
+	for upvalue != nil && upvalue.slot > slot {
+		previous = upvalue
+		upvalue = upvalue.next
+	}
+
+	if upvalue != nil && upvalue.slot == slot {
+		return upvalue
+	}
+
+	created := &Upvalue{
+		location: &vm.stack[slot],
+		slot:     slot,
+		next:     upvalue,
+	}
+
+	if previous == nil {
+		vm.openUpvalues = created
+	} else {
+		previous.next = created
+	}
+
+	return created
+}
+
+// Closes all open upvalues capturing the given stack slot or any slot above it.
+func (vm *VM) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.slot >= last {
+		upvalue := vm.openUpvalues
+
+		upvalue.closed = *upvalue.location
+		upvalue.location = &upvalue.closed
+
+		vm.openUpvalues = upvalue.next
+	}
 }
 
 func (vm *VM) Push(val value.Value) {
@@ -269,35 +816,71 @@ func (vm *VM) Peek(distance int) value.Value {
 	return vm.stack[vm.stackLen-1-distance]
 }
 
+// Reports an instruction of a malformed chunk popping a value off the empty stack.
+func (vm *VM) stackUnderflow() *RuntimeError {
+	return vm.runtimeError("Stack underflow at offset %d.", vm.frame.ip-1)
+}
+
 func (vm *VM) readByte() uint8 {
-	vm.ip++
+	vm.frame.ip++
 
-	return vm.chunk.Code()[vm.ip-1]
+	return vm.frame.chunk.Code()[vm.frame.ip-1]
 }
 
 func (vm *VM) readShort() uint16 {
-	short1 := uint16(vm.chunk.Code()[vm.ip])
-	short2 := uint16(vm.chunk.Code()[vm.ip+1])
+	short1 := uint16(vm.frame.chunk.Code()[vm.frame.ip])
+	short2 := uint16(vm.frame.chunk.Code()[vm.frame.ip+1])
 
-	vm.ip += 2
+	vm.frame.ip += 2
 
 	return (short1 << 8) | short2
 }
 
 func (vm *VM) readConstant() value.Value {
-	return vm.chunk.Constants()[vm.readShort()]
+	return vm.frame.chunk.Constants()[vm.readShort()]
+}
+
+func asString(val value.Value) (value.String, bool) {
+	if !value.IsObject(val) {
+		return "", false
+	}
+
+	str, ok := value.AsObject(val).(value.String)
+
+	return str, ok
+}
+
+func asRecord(val value.Value) (*value.Record, bool) {
+	if !value.IsObject(val) {
+		return nil, false
+	}
+
+	record, ok := value.AsObject(val).(*value.Record)
+
+	return record, ok
 }
 
 func (vm *VM) readString() value.String {
 	return value.AsObject(vm.readConstant()).(value.String)
 }
 
-func (vm *VM) runtimeError(message string, a ...interface{}) {
-	_, _ = fmt.Fprintf(os.Stderr, message, a...)
-	_, _ = fmt.Fprintf(os.Stderr, "\n")
+func (vm *VM) runtimeError(message string, a ...interface{}) *RuntimeError {
+	backtrace := make([]TraceFrame, 0, vm.frameCount)
+
+	for i := vm.frameCount - 1; i >= 0; i-- {
+		frame := &vm.frames[i]
 
-	line := vm.chunk.Lines()[vm.ip-1]
-	name := vm.chunk.Name()
+		backtrace = append(backtrace, TraceFrame{
+			Name:       frame.chunk.Name(),
+			Line:       frame.chunk.Lines()[frame.ip-1],
+			InFunction: frame.closure != nil,
+		})
+	}
 
-	_, _ = fmt.Fprintf(os.Stderr, "[line %d] in %s\n", line, name)
+	return &RuntimeError{
+		Message:   fmt.Sprintf(message, a...),
+		Line:      backtrace[0].Line,
+		Chunk:     backtrace[0].Name,
+		Backtrace: backtrace,
+	}
 }
@@ -0,0 +1,1195 @@
+package vm
+
+import (
+	"errors"
+	"github.com/adamjedlicka/go-blu/src/compiler"
+	"github.com/adamjedlicka/go-blu/src/parser"
+	"github.com/adamjedlicka/go-blu/src/value"
+	"math"
+	"strings"
+	"testing"
+)
+
+func compile(source string) *compiler.Chunk {
+	c := compiler.NewCompiler("test", parser.NewParser([]rune(source)))
+
+	return c.Compile()
+}
+
+func TestReassembledChunkRunsTheSame(t *testing.T) {
+	chunk := compile("var a = 1\nvar b = 0\nfn triple(n) {\nreturn n * 3\n}\nwhile a < 100 { a = triple(a)\nb = b + 1 }\nreturn a + b")
+
+	reassembled, err := compiler.AssembleText(chunk.Disassemble())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := NewVM()
+	expected, _ := vm.Interpret(chunk)
+
+	vm = NewVM()
+	actual, _ := vm.Interpret(reassembled)
+
+	if expected != value.NumberVal(248) || expected != actual {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func run(t *testing.T, source string) value.Value {
+	t.Helper()
+
+	chunk := compile(source)
+	if chunk == nil {
+		t.Fatalf("Failed to compile '%s'", source)
+	}
+
+	vm := NewVM()
+	result, err := vm.Interpret(chunk)
+	if err != nil {
+		t.Fatalf("Failed to run '%s': %s", source, err)
+	}
+
+	if vm.stackLen != 0 {
+		t.Errorf("Expected empty stack after running '%s', got %d values", source, vm.stackLen)
+	}
+
+	return result
+}
+
+func TestPassInBlock(t *testing.T) {
+	result := run(t, "var a = 1\n{\npass\n}\nreturn a")
+
+	if result != value.NumberVal(1) {
+		t.Errorf("Expected 1, got %v", result)
+	}
+}
+
+func TestPassInIfBranch(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"var a = 1\nif true { pass } else { a = 2 }\nreturn a", value.NumberVal(1)},
+		{"var a = 1\nif false { pass } else { a = 2 }\nreturn a", value.NumberVal(2)},
+		{"var a = 1\nif false { a = 2 } else { pass }\nreturn a", value.NumberVal(1)},
+		{"var a = 1\nif true: pass\nreturn a", value.NumberVal(1)},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestPassAsWhileBody(t *testing.T) {
+	result := run(t, "var a = 0\nwhile (a = a + 1) < 5 { pass }\nreturn a")
+
+	if result != value.NumberVal(5) {
+		t.Errorf("Expected 5, got %v", result)
+	}
+}
+
+func TestNonExpressionLastStatementYieldsNil(t *testing.T) {
+	for _, source := range []string{"if true { 1 }", "if false { 1 }", "while false { pass }", "var a = 1\nvar b = 2\nvar c = 3"} {
+		if result := run(t, source); result != value.NilVal() {
+			t.Errorf("Expected nil for '%s', got %v", source, result)
+		}
+	}
+}
+
+func TestShadowedLocalDoesNotLeak(t *testing.T) {
+	result := run(t, "var r = 0\n{\nvar a = 1\n{\nvar a = 2\nr = a\n}\nr = r * 10 + a\n}\nreturn r")
+
+	if result != value.NumberVal(21) {
+		t.Errorf("Expected 21, got %v", result)
+	}
+}
+
+func TestIfExpression(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"var x = if true { 1 } else { 2 }\nreturn x", value.NumberVal(1)},
+		{"var x = if false { 1 } else { 2 }\nreturn x", value.NumberVal(2)},
+		{"var x = if false { 1 }\nreturn x", value.NilVal()},
+		{"var a = 2\nvar x = if a == 1 { 10 } else if a == 2 { 20 } else { 30 }\nreturn x", value.NumberVal(20)},
+		{"var x = if true: 1 else: 2\nreturn x", value.NumberVal(1)},
+		{"return 1 + if false { 1 } else { 2 } * 3", value.NumberVal(7)},
+		{"var x = if true { if false { 1 } else { 2 } } else { 3 }\nreturn x", value.NumberVal(2)},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestBlockExpression(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"var x = { 1 }\nreturn x", value.NumberVal(1)},
+		{"var x = { var a = 1; a + 2 }\nreturn x", value.NumberVal(3)},
+		{"var x = { var a = 1 }\nreturn x", value.NilVal()},
+		{"var x = {}\nreturn x", value.NilVal()},
+		{"return 10 + { var a = 1\nvar b = 2\na + b }", value.NumberVal(13)},
+		{"var r = 0\n{\nvar y = 5\nvar x = { var a = 1\na + y }\nr = x + y\n}\nreturn r", value.NumberVal(11)},
+		{"var x = { var a = 1\n{ var b = 2\na + b } * 2 }\nreturn x", value.NumberVal(6)},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestRunProgramPrintsResult(t *testing.T) {
+	tests := map[string]string{
+		"return 1 + 2":         "3\n",
+		"return \"a\" + \"b\"": "ab\n",
+		"return { a: 1 }":      "{a: 1}\n",
+		"var a = 1":            "",
+		"return nil":           "",
+	}
+
+	for source, expected := range tests {
+		var out strings.Builder
+
+		if err := RunProgram(source, &out); err != nil {
+			t.Fatalf("Failed to run '%s': %s", source, err)
+		}
+
+		if out.String() != expected {
+			t.Errorf("Expected %q for '%s', got %q", expected, source, out.String())
+		}
+	}
+}
+
+func TestRunProgramReturnsErrors(t *testing.T) {
+	var out strings.Builder
+
+	if _, ok := RunProgram("return 1 +", &out).(*CompileError); !ok || out.Len() != 0 {
+		t.Errorf("Expected a compile error and no output, got %q", out.String())
+	}
+
+	if _, ok := RunProgram("var a = 1\nreturn a.b", &out).(*RuntimeError); !ok || out.Len() != 0 {
+		t.Errorf("Expected a runtime error and no output, got %q", out.String())
+	}
+}
+
+func TestEvalWith(t *testing.T) {
+	env := map[string]value.Value{
+		"a": value.NumberVal(1),
+		"b": value.NumberVal(3),
+	}
+
+	tests := map[string]value.Value{
+		"a + b * 2":           value.NumberVal(7),
+		"\na == 1\n":          value.TrueVal(),
+		"if a < b: a else: b": value.NumberVal(1),
+		"gcd(b * 4, 8)":       value.NumberVal(4),
+	}
+
+	for source, expected := range tests {
+		result, err := EvalWith(source, env)
+		if err != nil {
+			t.Fatalf("Failed to evaluate '%s': %s", source, err)
+		}
+
+		if !value.Equals(result, expected) {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestEvalWithErrors(t *testing.T) {
+	env := map[string]value.Value{
+		"a": value.NumberVal(1),
+	}
+
+	tests := map[string]string{
+		"a + c":       "[line 1] Error at 'c': Undefined variable 'c'.",
+		"var x = a":   "[line 1] Error at 'var': Expect expression.",
+		"a\nreturn a": "[line 2] Error at 'return': Expect end of expression.",
+	}
+
+	for source, expected := range tests {
+		_, err := EvalWith(source, env)
+
+		if compileErr, ok := err.(*CompileError); !ok || compileErr.Error() != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, err)
+		}
+	}
+}
+
+func TestCheckKnowsNatives(t *testing.T) {
+	if diagnostics := Check("var t = typeof(1)\nreturn format(\"{}\", t)"); len(diagnostics) != 0 {
+		t.Errorf("Expected no diagnostics, got %v", diagnostics)
+	}
+
+	diagnostics := Check("return typeof(x)")
+	if len(diagnostics) != 1 || diagnostics[0].Message != "Undefined variable 'x'." {
+		t.Errorf("Expected undefined variable 'x', got %v", diagnostics)
+	}
+}
+
+func TestBlockExpressionLeavesOnlyItsResult(t *testing.T) {
+	source := "fn f() {\nvar x = { var a = 1; var b = 2; a; a + b }\nvar y = x\nreturn y\n}\nreturn f()"
+
+	slots := -1
+
+	vm := NewVM()
+	vm.SetLineHook(func(line int, frame Frame) {
+		if line == 4 {
+			slots = frame.SlotCount()
+		}
+	})
+
+	result, err := vm.Interpret(compile(source))
+	if err != nil {
+		t.Fatalf("Failed to run '%s': %s", source, err)
+	}
+
+	if result != value.NumberVal(3) {
+		t.Errorf("Expected 3, got %v", result)
+	}
+
+	// Only the function, x and y are left, the locals of the block and the value of 'a' are gone
+	if slots != 3 {
+		t.Errorf("Expected 3 slots after the block, got %d", slots)
+	}
+}
+
+func TestEnumMembersAreSequential(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"enum Color { Red, Green, Blue }\nreturn Color.Red", value.NumberVal(0)},
+		{"enum Color { Red, Green, Blue }\nreturn Color.Green", value.NumberVal(1)},
+		{"enum Color {\nRed,\nGreen,\nBlue,\n}\nreturn Color.Blue", value.NumberVal(2)},
+		{"enum Color { Red, Green, Blue }\nreturn Color.Red == Color.Blue", value.FalseVal()},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestEnumExplicitValues(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"enum Level { Low = 1, Mid, High = 10 }\nreturn Level.Low", value.NumberVal(1)},
+		{"enum Level { Low = 1, Mid, High = 10 }\nreturn Level.Mid", value.NumberVal(2)},
+		{"enum Level { Low = 1, Mid, High = 10 }\nreturn Level.High", value.NumberVal(10)},
+		{"enum Level { Low = -1, Mid }\nreturn Level.Mid", value.NumberVal(0)},
+		{"enum Level { Low = -1, Mid }\nreturn Level.Low", value.NumberVal(-1)},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestLocalsShadowEnums(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"enum E { A }\nfn f() {\nvar E = 5\nreturn E\n}\nreturn f()", value.NumberVal(5)},
+		{"enum E { A }\nfn f() {\nvar E = 5\nfn g() { return E }\nreturn g()\n}\nreturn f()", value.NumberVal(5)},
+		{"enum E { A }\nfn f() {\nvar E = 5\nfn g() { return E }\nreturn g()\n}\nreturn f() + E.A", value.NumberVal(5)},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func runtimeError(t *testing.T, vm *VM, source string) *RuntimeError {
+	t.Helper()
+
+	chunk := compile(source)
+	if chunk == nil {
+		t.Fatalf("Failed to compile '%s'", source)
+	}
+
+	_, err := vm.Interpret(chunk)
+	if err == nil {
+		t.Fatalf("Expected runtime error for '%s'", source)
+	}
+
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("Expected runtime error for '%s', got %v", source, err)
+	}
+
+	return runtimeErr
+}
+
+func TestCallNative(t *testing.T) {
+	vm := NewVM()
+	vm.DefineNative("add", 2, func(args []value.Value) (value.Value, error) {
+		return value.NumberVal(value.AsNumber(args[0]) + value.AsNumber(args[1])), nil
+	})
+
+	result, err := vm.Interpret(compile("var a = 1\nreturn add(a, 2) + add(3, 4)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != value.NumberVal(10) {
+		t.Errorf("Expected 10, got %v", result)
+	}
+
+	if vm.stackLen != 0 {
+		t.Errorf("Expected empty stack, got %d values", vm.stackLen)
+	}
+}
+
+func TestCallNativeWithWrongArity(t *testing.T) {
+	vm := NewVM()
+	vm.DefineNative("one", 1, func(args []value.Value) (value.Value, error) {
+		return args[0], nil
+	})
+
+	err := runtimeError(t, &vm, "one(1, 2)")
+
+	if err.Message != "Expected 1 arguments but got 2." {
+		t.Errorf("Unexpected message '%s'", err.Message)
+	}
+}
+
+func TestCallNonCallable(t *testing.T) {
+	tests := []struct {
+		source  string
+		message string
+		line    int
+	}{
+		{"5()", "Can only call functions and natives, got number.", 1},
+		{"\n\"x\"()", "Can only call functions and natives, got string.", 2},
+		{"var a = nil\n\n\na(1, 2)", "Can only call functions and natives, got nil.", 4},
+		{"true()", "Can only call functions and natives, got boolean.", 1},
+	}
+
+	for _, test := range tests {
+		vm := NewVM()
+		err := runtimeError(t, &vm, test.source)
+
+		if err.Message != test.message {
+			t.Errorf("Expected message '%s', got '%s'", test.message, err.Message)
+		}
+
+		if err.Line != test.line {
+			t.Errorf("Expected error on line %d for '%s', got %d", test.line, test.source, err.Line)
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"fn add(a, b) { return a + b }\nreturn add(1, 2)", value.NumberVal(3)},
+		{"fn nothing() { 1 }\nreturn nothing()", value.NilVal()},
+		{"fn early(a) {\nif a { return 1 }\nreturn 2\n}\nreturn early(false)", value.NumberVal(2)},
+		{"fn fib(n) {\nif n < 2 { return n }\nreturn fib(n - 1) + fib(n - 2)\n}\nreturn fib(10)", value.NumberVal(55)},
+		{"fn f(a) {\nvar b = a * 2\n{ var c = b + 1\nb = c }\nreturn b\n}\nreturn f(2) + f(3)", value.NumberVal(12)},
+		{"var g = 10\nfn f() { g = g + 1 }\nf()\nf()\nreturn g", value.NumberVal(12)},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestDefaultParameterValues(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"fn greet(name, greeting = \"Hello\") { return greeting + \", \" + name }\nreturn greet(\"Bob\")", value.StringVal("Hello, Bob")},
+		{"fn greet(name, greeting = \"Hello\") { return greeting + \", \" + name }\nreturn greet(\"Bob\", \"Hi\")", value.StringVal("Hi, Bob")},
+		{"fn f(a, b = a * 2, c = a + b) { return a + b + c }\nreturn f(1)", value.NumberVal(6)},
+		{"fn f(a, b = a * 2, c = a + b) { return a + b + c }\nreturn f(1, 5)", value.NumberVal(12)},
+		{"fn f(a, b = a * 2, c = a + b) { return a + b + c }\nreturn f(1, 5, 1)", value.NumberVal(7)},
+		{"fn f(a = 1) { var b = 2\nreturn a + b }\nreturn f() + f(10)", value.NumberVal(15)},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestAddInvalidOperands(t *testing.T) {
+	tests := []struct {
+		source  string
+		message string
+	}{
+		{"var r = { a: 1 }\nr + r", "Both operands must be numbers."},
+		{"var r = { a: 1 }\nr + \"x\"", "Can only add a string to a string, got record."},
+		{"var r = { a: 1 }\n\"x\" + r", "Can only add a string to a string, got record."},
+		// Locals are added by AddLocals
+		{"{\nvar r = { a: 1 }\nvar s = \"x\"\nr + s\n}", "Can only add a string to a string, got record."},
+		{"{\nvar r = { a: 1 }\nr + r\n}", "Both operands must be numbers."},
+		{"typeof + \"x\"", "Can only add a string to a string, got native."},
+		{"\"x\" + typeof", "Can only add a string to a string, got native."},
+		{"typeof + typeof", "Both operands must be numbers."},
+	}
+
+	for _, test := range tests {
+		vm := NewVM()
+		err := runtimeError(t, &vm, test.source)
+
+		if err.Message != test.message {
+			t.Errorf("Expected message '%s' for '%s', got '%s'", test.message, test.source, err.Message)
+		}
+	}
+}
+
+func TestCallFunctionWithWrongArity(t *testing.T) {
+	tests := []struct {
+		source  string
+		message string
+	}{
+		{"fn f(a, b) {}\nf(1)", "Expected 2 arguments but got 1."},
+		{"fn f(a, b = 1) {}\nf(1, 2, 3)", "Expected 1 to 2 arguments but got 3."},
+		{"fn f(a, b = 1) {}\nf()", "Expected 1 to 2 arguments but got 0."},
+	}
+
+	for _, test := range tests {
+		vm := NewVM()
+		err := runtimeError(t, &vm, test.source)
+
+		if err.Message != test.message {
+			t.Errorf("Expected message '%s', got '%s'", test.message, err.Message)
+		}
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	vm := NewVM()
+	err := runtimeError(t, &vm, "fn f() { return f() }\nf()")
+
+	if err.Message != "Stack overflow." {
+		t.Errorf("Expected stack overflow, got '%s'", err.Message)
+	}
+}
+
+func TestTrailingCommas(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"fn f(a, b) { return a - b }\nreturn f(3, 1,)", value.NumberVal(2)},
+		{"fn f(a, b,) { return a - b }\nreturn f(3, 1)", value.NumberVal(2)},
+		{"fn f(\na,\nb = 1,\n) { return a - b }\nreturn f(\n3,\n)", value.NumberVal(2)},
+		{"fn f(a, b) { return a - b }\nreturn f(\n3,\n1\n)", value.NumberVal(2)},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestComparisonsWithNaN(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected value.Value
+	}{
+		{"var nan = 0 / 0\nreturn nan < 1", value.FalseVal()},
+		{"var nan = 0 / 0\nreturn nan <= 1", value.FalseVal()},
+		{"var nan = 0 / 0\nreturn nan > 1", value.FalseVal()},
+		{"var nan = 0 / 0\nreturn nan >= 1", value.FalseVal()},
+		{"var nan = 0 / 0\nreturn 1 <= nan", value.FalseVal()},
+		{"var nan = 0 / 0\nreturn 1 >= nan", value.FalseVal()},
+		{"var nan = 0 / 0\nreturn nan <= nan", value.FalseVal()},
+		{"var nan = 0 / 0\nreturn !(nan > 1)", value.TrueVal()},
+		{"var nan = 0 / 0\nreturn nan == nan", value.FalseVal()},
+		{"var nan = 0 / 0\nreturn nan != nan", value.TrueVal()},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result != test.expected {
+			t.Errorf("Expected %v for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestFractionalNumbers(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{"return 1.5 + 1", "2.5"},
+		{"return 1 / 4", "0.25"},
+		{"return -0.5 * 3", "-1.5"},
+		{"return 0 / 0", "NaN"},
+	}
+
+	for _, test := range tests {
+		if result := run(t, test.source); result.String() != test.expected {
+			t.Errorf("Expected %s for '%s', got %v", test.expected, test.source, result)
+		}
+	}
+}
+
+func TestTypeAnnotationsAreIgnoredInLooseMode(t *testing.T) {
+	tests := map[string]value.Value{
+		"var a: number = 1\nreturn a":                                         value.NumberVal(1),
+		"var a: number = \"str\"\nreturn a":                                   value.StringVal("str"),
+		"fn f(a: string, b: number = 2): boolean {\nreturn a\n}\nreturn f(1)": value.NumberVal(1),
+		"var a: any = nil\na = true\nreturn a":                                value.TrueVal(),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestTypeAnnotationsAreCheckedInStrictMode(t *testing.T) {
+	tests := map[string]string{
+		"var a: number = \"str\"":                      "Expected type number but got string.",
+		"var a: string = \"str\"\na = 1":               "Expected type string but got number.",
+		"{\nvar a: boolean = true\na = nil\n}":         "Expected type boolean but got nil.",
+		"fn f(a: string) {\n}\nf(1)":                   "Expected type string but got number.",
+		"fn f(a: number = nil) {\n}\nf()":              "Expected type number but got nil.",
+		"fn f(): number {\nreturn \"str\"\n}\nf()":     "Expected type number but got string.",
+		"fn f(): number {\n}\nf()":                     "Expected type number but got nil.",
+		"fn f(): number {\nreturn\n}\nf()":             "Expected type number but got nil.",
+		"fn f(a: function) {\n}\nf(f)\nvar a: nil = 1": "Expected type nil but got number.",
+	}
+
+	for source, expected := range tests {
+		vm := NewVM()
+		vm.SetCompilerOptions(compiler.CompilerOptions{Strict: true})
+
+		_, err := vm.Exec(source)
+
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Errorf("Expected runtime error for '%s', got %v", source, err)
+		} else if runtimeErr.Message != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, source, runtimeErr.Message)
+		}
+	}
+
+	vm := NewVM()
+	vm.SetCompilerOptions(compiler.CompilerOptions{Strict: true})
+
+	source := "fn f(a: string, b: any): number {\nreturn 1\n}\nvar a: number = f(\"a\", nil)\nreturn a"
+	if result, err := vm.Exec(source); err != nil || result != value.NumberVal(1) {
+		t.Errorf("Expected 1 for '%s', got %v (%v)", source, result, err)
+	}
+}
+
+func TestGlobalRedeclaration(t *testing.T) {
+	source := "var a = 1\nfn f() {\nreturn a\n}\nvar a = 2\nreturn f()"
+
+	vm := NewVM()
+	_, err := vm.Exec(source)
+
+	compileErr, ok := err.(*CompileError)
+	if !ok || len(compileErr.Errors) != 1 || compileErr.Errors[0] != "[line 5] Error at 'a': Already a global variable with this name." {
+		t.Errorf("Expected redeclaration error for '%s', got %v", source, err)
+	}
+
+	vm.SetCompilerOptions(compiler.CompilerOptions{AllowGlobalRedeclaration: true})
+	if result, err := vm.Exec(source); err != nil || result != value.NumberVal(2) {
+		t.Errorf("Expected 2 for '%s', got %v (%v)", source, result, err)
+	}
+}
+
+func TestStrictDirective(t *testing.T) {
+	vm := NewVM()
+
+	_, err := vm.Exec("//go-blue:strict\nvar a: number = \"str\"")
+	if runtimeErr, ok := err.(*RuntimeError); !ok || runtimeErr.Message != "Expected type number but got string." {
+		t.Errorf("Expected type error, got %v", err)
+	}
+
+	if result := run(t, "// go-blue:strict\nvar a: number = \"str\"\nreturn a"); result != value.StringVal("str") {
+		t.Errorf("Expected 'str', got %v", result)
+	}
+}
+
+func TestExpressionsContinueAfterOperatorAtEndOfLine(t *testing.T) {
+	tests := map[string]value.Value{
+		"return 1 +\n2":           value.NumberVal(3),
+		"return 2 *\n\n3 -\n1":    value.NumberVal(5),
+		"return 1 <\n2":           value.TrueVal(),
+		"return (\n1 +\n2\n) * 2": value.NumberVal(6),
+		"fn f(a, b) {\nreturn a - b\n}\nreturn f(\n3,\n1\n)": value.NumberVal(2),
+		"var a = 1 +\n2\nvar b = a *\n2\nreturn b":           value.NumberVal(6),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	tests := map[string]value.Value{
+		// Reading and writing a local of the enclosing function, the change is visible after the call
+		"fn outer() {\nvar a = 1\nfn inner() {\na = a + 1\nreturn a\n}\ninner()\nreturn a + inner()\n}\nreturn outer()": value.NumberVal(5),
+		// Captured variable outlives the function which declared it
+		"fn counter() {\nvar count = 0\nfn next() {\ncount = count + 1\nreturn count\n}\nreturn next\n}\nvar c = counter()\nc()\nc()\nreturn c()": value.NumberVal(3),
+		// Variable of the function two levels up is captured through the middle one
+		"fn a() {\nvar x = \"x\"\nfn b() {\nfn c() {\nreturn x\n}\nreturn c\n}\nreturn b()()\n}\nreturn a()": value.StringVal("x"),
+		// Closures created by the same call share the variable
+		"var get = nil\nvar set = nil\nfn make() {\nvar v = 1\nfn g() {\nreturn v\n}\nfn s(n) {\nv = n\n}\nget = g\nset = s\n}\nmake()\nset(7)\nreturn get()": value.NumberVal(7),
+		// Local of a block is closed when the block ends
+		"var f = nil\n{\nvar a = 1\nfn g() {\nreturn a\n}\nf = g\n}\n{\nvar b = 2\n}\nreturn f()": value.NumberVal(1),
+		// Every iteration of a loop gets its own variable
+		"var f = nil\nvar i = 0\nwhile i < 3 {\nvar j = i\nfn g() {\nreturn j\n}\nif i == 0: f = g\ni = i + 1\n}\nreturn f()": value.NumberVal(0),
+		// Block expression keeps its result even if a local of the block is captured
+		"var f = nil\nvar r = {\nvar a = 1\nfn g() {\nreturn a\n}\nf = g\n5\n}\nreturn r + f()": value.NumberVal(6),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestNativeErrorIsReportedAtCallSite(t *testing.T) {
+	errNegative := errors.New("Cannot take square root of a negative number.")
+
+	vm := NewVM()
+	vm.DefineNative("sqrt", 1, func(args []value.Value) (value.Value, error) {
+		if value.AsNumber(args[0]) < 0 {
+			return value.NilVal(), errNegative
+		}
+
+		return value.NumberVal(math.Sqrt(value.AsNumber(args[0]))), nil
+	})
+
+	err := runtimeError(t, &vm, "fn f(n) {\nreturn sqrt(n)\n}\nf(4)\n\nf(-1)")
+
+	if err.Message != errNegative.Error() {
+		t.Errorf("Expected message '%s', got '%s'", errNegative, err.Message)
+	}
+
+	if err.Line != 2 || err.Chunk != "f" {
+		t.Errorf("Expected error on line 2 in f, got line %d in %s", err.Line, err.Chunk)
+	}
+
+	if !errors.Is(err, errNegative) {
+		t.Errorf("Expected error to wrap the native error, got %v", err.Err)
+	}
+}
+
+func TestTopLevelFunctionsAreHoisted(t *testing.T) {
+	tests := map[string]value.Value{
+		"return isEven(10)\nfn isEven(n) {\nif n == 0 { return true }\nreturn isOdd(n - 1)\n}\nfn isOdd(n) {\nif n == 0 { return false }\nreturn isEven(n - 1)\n}":           value.TrueVal(),
+		"fn isEven(n) {\nif n == 0 { return true }\nreturn isOdd(n - 1)\n}\nvar a = isEven(7)\nfn isOdd(n) {\nif n == 0 { return false }\nreturn isEven(n - 1)\n}\nreturn a": value.FalseVal(),
+		// Functions in blocks are not hoisted, but can refer to globals defined later
+		"var r = nil\n{\nfn f() {\nreturn g()\n}\nr = f\n}\nfn g() {\nreturn 1\n}\nreturn r()": value.NumberVal(1),
+		// A declaration ends the script like any other, so it does not evaluate to the expression before it
+		"1 + 2\nfn f() { return 1 }": value.NilVal(),
+		"1 + 2\nvar x = 1":           value.NilVal(),
+		"fn f() { return 1 }\nf()":   value.NumberVal(1),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestBacktrace(t *testing.T) {
+	vm := NewVM()
+	err := runtimeError(t, &vm, "fn a() {\nreturn nil()\n}\nfn b() {\nreturn a()\n}\nvar c = fn() {\n\nreturn b()\n}\nc()")
+
+	expected := []TraceFrame{
+		{Name: "a", Line: 2, InFunction: true},
+		{Name: "b", Line: 5, InFunction: true},
+		{Name: "<fn@7:9>", Line: 9, InFunction: true},
+		{Name: "test", Line: 11, InFunction: false},
+	}
+
+	if len(err.Backtrace) != len(expected) {
+		t.Fatalf("Expected backtrace %v, got %v", expected, err.Backtrace)
+	}
+
+	for i := range expected {
+		if err.Backtrace[i] != expected[i] {
+			t.Errorf("Expected backtrace %v, got %v", expected, err.Backtrace)
+		}
+	}
+
+	message := "Can only call functions and natives, got nil.\n" +
+		"    in function a (line 2)\n" +
+		"    in function b (line 5)\n" +
+		"    in function <fn@7:9> (line 9)\n" +
+		"    in test (line 11)"
+
+	if err.Error() != message {
+		t.Errorf("Expected error '%s', got '%s'", message, err.Error())
+	}
+}
+
+func TestAnonymousFunctions(t *testing.T) {
+	tests := map[string]value.Value{
+		"var f = fn(a, b) {\nreturn a * b\n}\nreturn f(2, 3)":                       value.NumberVal(6),
+		"fn apply(f, a) {\nreturn f(a)\n}\nreturn apply(fn(a) { return a + 1 }, 1)": value.NumberVal(2),
+		"fn adder(n) {\nreturn fn(a) {\nreturn a + n\n}\n}\nreturn adder(2)(3)":     value.NumberVal(5),
+		"return format(\"{}\", fn() {})":                                            value.StringVal("<fn@1:21>"),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestReturnFromNestedScopes(t *testing.T) {
+	tests := map[string]value.Value{
+		"fn f(n) {\nvar a = 1\n{\nvar b = 2\nvar i = 0\nwhile true {\nvar c = i * 10\nif i == n {\nreturn a + b + c\n}\ni = i + 1\n}\n}\n}\nvar x = 100\nreturn x + f(3) + x": value.NumberVal(233),
+		"fn f() {\nvar a = 1\nfn g() {\nreturn a\n}\n{\nvar b = 2\nwhile true { return g }\n}\n}\nvar h = f()\nvar d = 5\nreturn h() + d":                                     value.NumberVal(6),
+		"var a = 1\n{\nvar b = 2\nwhile true {\nvar c = 3\nreturn a + b + c\n}\n}":                                                                                            value.NumberVal(6),
+		"fn f() {\nreturn 1 + {\nvar a = 2\nif true { return a }\n3\n}\n}\nvar g = 10\nreturn g + f()":                                                                        value.NumberVal(12),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestStringRepetition(t *testing.T) {
+	tests := map[string]value.Value{
+		"return \"ab\" * 3":                   value.StringVal("ababab"),
+		"return \"ab\" * 1":                   value.StringVal("ab"),
+		"return \"ab\" * 0":                   value.StringVal(""),
+		"var n = 2\nreturn \"-\" * n + \"|\"": value.StringVal("--|"),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+
+	failures := map[string]string{
+		"\"ab\" * -1":    "Repeat count cannot be negative.",
+		"\"ab\" * 1.5":   "Repeat count must be an integer.",
+		"\"ab\" * 1e19":  "Repeat count cannot be larger than 1073741824.",
+		"\"ab\" * 1e18":  "Repeat count cannot be larger than 1073741824.",
+		"\"ab\" * 6e8":   "Repeated string would be longer than 1073741824 bytes.",
+		"\"ab\" * \"b\"": "Operands must be numbers, or a string and a count.",
+		"2 * \"ab\"":     "Operands must be numbers, or a string and a count.",
+	}
+
+	for source, expected := range failures {
+		vm := NewVM()
+
+		if err := runtimeError(t, &vm, source); err.Message != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, source, err.Message)
+		}
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	tests := map[string]value.Value{
+		"return 1e10":                        value.NumberVal(1e10),
+		"return 1.5e-3":                      value.NumberVal(1.5e-3),
+		"return 2E3":                         value.NumberVal(2000),
+		"return 0x1F":                        value.NumberVal(31),
+		"return 0x1p-2":                      value.NumberVal(0.25),
+		"return 0x1.8p1":                     value.NumberVal(3),
+		"return 1e2 + 1":                     value.NumberVal(101),
+		"enum E { A = 0x10, B }\nreturn E.B": value.NumberVal(17),
+		"enum E { A = -0x1p-2 }\nreturn E.A": value.NumberVal(-0.25),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestBreakAndContinue(t *testing.T) {
+	tests := map[string]value.Value{
+		// Labeled break exits both loops and the code after them runs once
+		"var runs = 0\nvar i = 0\nouter: while i < 10 {\nvar a = i\nvar j = 0\nwhile j < 10 {\nvar b = j\nif a + b == 5 { break outer }\nj = j + 1\n}\ni = i + 1\n}\nruns = runs + 1\nreturn runs * 100 + i": value.NumberVal(100),
+		"var i = 0\nwhile true {\ni = i + 1\nif i == 3: break\n}\nreturn i": value.NumberVal(3),
+		// Unlabeled continue skips the rest of the innermost loop
+		"var i = 0\nvar sum = 0\nwhile i < 5 {\ni = i + 1\nvar odd = i % 2\nif odd == 1 { continue }\nsum = sum + i\n}\nreturn sum": value.NumberVal(6),
+		// Labeled continue goes to the next iteration of the outer loop
+		"var count = 0\nvar i = 0\nrows: while i < 3 {\ni = i + 1\nvar j = 0\nwhile true {\nj = j + 1\ncount = count + 1\nif j == 2 { continue rows }\n}\n}\nreturn count": value.NumberVal(6),
+		// Captured locals of the loop are closed by break
+		"var f = nil\nwhile true {\nvar a = 7\nfn g() {\nreturn a\n}\nf = g\nbreak\n}\nvar b = 1\nreturn f() + b":               value.NumberVal(8),
+		"fn f() {\nvar i = 0\nloop: while true {\n{\nvar x = i\ni = i + 1\nif x > 2: break loop\n}\n}\nreturn i\n}\nreturn f()": value.NumberVal(4),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestForLoop(t *testing.T) {
+	tests := map[string]value.Value{
+		"var sum = 0\nfor var i = 0; i < 5; i = i + 1 {\nsum = sum + i\n}\nreturn sum": value.NumberVal(10),
+		// Continue runs the increment, so the loop terminates and sums the odd numbers only
+		"var sum = 0\nfor var i = 0; i < 10; i = i + 1 {\nif i % 2 == 0: continue\nsum = sum + i\n}\nreturn sum":                                               value.NumberVal(25),
+		"var sum = 0\nouter: for var i = 0; i < 3; i = i + 1 {\nfor var j = 0; j < 3; j = j + 1 {\nif j == 1: continue outer\nsum = sum + 1\n}\n}\nreturn sum": value.NumberVal(3),
+		// Every clause is optional
+		"var i = 0\nfor ; ; {\ni = i + 1\nif i == 4: break\n}\nreturn i":                                  value.NumberVal(4),
+		"var i = 0\nfor i = 5; i < 7; i = i + 1: pass\nreturn i":                                          value.NumberVal(7),
+		"var i = 10\nfor var i = 0; i < 3; i = i + 1 { var a = i }\nreturn i":                             value.NumberVal(10),
+		"var f = nil\nfor var i = 0; i < 3; i = i + 1 {\nvar a = i\nf = fn() { return a }\n}\nreturn f()": value.NumberVal(2),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestDoWhileLoop(t *testing.T) {
+	tests := map[string]value.Value{
+		// The body runs once even though the condition is false from the start
+		"var runs = 0\ndo {\nruns = runs + 1\n} while false\nreturn runs":              value.NumberVal(1),
+		"var runs = 0\nvar a = 10\ndo {\nruns = runs + 1\n} while a < 5\nreturn runs":  value.NumberVal(1),
+		"var i = 0\ndo {\ni = i + 1\n} while i < 5\nreturn i":                          value.NumberVal(5),
+		"var i = 0\ndo { i = i + 1\nif i == 3: break } while true\nreturn i":           value.NumberVal(3),
+		"var i = 0\nvar a = 1 + 2\ndo { var b = a\ni = i + b } while i < 10; return i": value.NumberVal(12),
+		// Continue jumps to the condition, so the loop still terminates
+		"var i = 0\nvar sum = 0\ndo {\ni = i + 1\nif i % 2 == 0: continue\nsum = sum + i\n} while i < 5\nreturn sum":                            value.NumberVal(9),
+		"var sum = 0\nouter: do {\nfor var j = 0; j < 3; j = j + 1 {\nif j == 1: continue outer\nsum = sum + 1\n}\n} while sum < 3\nreturn sum": value.NumberVal(3),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestEvaluationOrderIsLeftToRight(t *testing.T) {
+	tests := map[string][]float64{
+		"order(1) + order(2)":                                      {1, 2},
+		"order(1) * order(2) - order(3) / order(4)":                {1, 2, 3, 4},
+		"order(1) - (order(2) - order(3))":                         {1, 2, 3},
+		"order(1) ^ order(2) ^ order(3)":                           {1, 2, 3},
+		"order(1) < order(2) == order(3) > order(4)":               {1, 2, 3, 4},
+		"fn f(a, b, c) {}\nf(order(1), order(2), order(3))":        {1, 2, 3},
+		"fn f(a) {\nreturn fn(b) {}\n}\nf(order(1))(order(2))":     {1, 2},
+		"fn f() {\norder(1)\nreturn fn(a) {}\n}\nf()(order(2))":    {1, 2},
+		"var a = 0\na = order(1) + order(2)\norder(a)":             {1, 2, 3},
+		"format(\"{}{}\", order(1), format(\"{}\", order(2)))":     {1, 2},
+		"order(1) + {\norder(2)\n} + (if order(3) == 3: order(4))": {1, 2, 3, 4},
+	}
+
+	for source, expected := range tests {
+		recorded := make([]float64, 0)
+
+		vm := NewVM()
+		vm.DefineNative("order", 1, func(args []value.Value) (value.Value, error) {
+			recorded = append(recorded, value.AsNumber(args[0]))
+
+			return args[0], nil
+		})
+
+		if _, err := vm.Exec(source); err != nil {
+			t.Fatalf("Failed to run '%s': %s", source, err)
+		}
+
+		if len(recorded) != len(expected) {
+			t.Errorf("Expected order %v for '%s', got %v", expected, source, recorded)
+			continue
+		}
+
+		for i := range expected {
+			if recorded[i] != expected[i] {
+				t.Errorf("Expected order %v for '%s', got %v", expected, source, recorded)
+				break
+			}
+		}
+	}
+}
+
+func TestComparisonsWithConstants(t *testing.T) {
+	tests := map[string]value.Value{
+		"var a = 1\nreturn a == 1":                    value.TrueVal(),
+		"var a = \"x\"\nreturn a == \"x\"":            value.TrueVal(),
+		"var a = 1\nreturn a == \"1\"":                value.FalseVal(),
+		"var a = 5\nreturn a < 10":                    value.TrueVal(),
+		"var a = 10\nreturn a < 10":                   value.FalseVal(),
+		"var a = 11\nreturn a > 10":                   value.TrueVal(),
+		"var a = true\nreturn (if a: 1 else: 2) == 2": value.FalseVal(),
+		"var a = true\nreturn 1 == (if a: 1 else: 2)": value.TrueVal(),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestDiscardStatement(t *testing.T) {
+	tests := map[string]value.Value{
+		"_ = 1":                         value.NilVal(),
+		"var a = 1\n_ = a + 1":          value.NilVal(),
+		"var a = 1\n_ = {\na = 2\n}\na": value.NumberVal(2),
+		"{\nvar a = 1\n_ = a\n}":        value.NilVal(),
+		"{\nvar a = 1\n}":               value.NilVal(),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestIfStatementAsLastStatement(t *testing.T) {
+	tests := map[string]value.Value{
+		"var a = true\nif a { a = 1 } else { a = 2 }":     value.NilVal(),
+		"var a = false\nif a { a = 1 } else { a = 2 }\na": value.NumberVal(2),
+		"var a = true\nif a: a = 1":                       value.NilVal(),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestLiteralConditions(t *testing.T) {
+	tests := map[string]value.Value{
+		"var a = 1\nif true { a = 2 } else { a = 3 }\nreturn a":                         value.NumberVal(2),
+		"var a = 1\nif false { a = 2 } else if true { a = 3 } else { a = 4 }\nreturn a": value.NumberVal(3),
+		"var a = 1\nif false: a = 2\nreturn a":                                          value.NumberVal(1),
+		"var a = 0\nwhile true {\na = a + 1\nif a == 3: break\n}\nreturn a":             value.NumberVal(3),
+		"var a = 0\nwhile false { a = 1 }\nreturn a":                                    value.NumberVal(0),
+		"fn f() {\nwhile true {\nvar a = 1\nreturn a\n}\n}\nreturn f()":                 value.NumberVal(1),
+		// A taken branch is not the result of the script, like any other if statement
+		"if true { 5 }": value.NilVal(),
+		// Jumps out of the discarded branches are not patched into the code following them
+		"var i = 0\nwhile i < 3 {\ni = i + 1\nif false { break }\nvar q = 1\n}\nreturn i":       value.NumberVal(3),
+		"var i = 0\nwhile i < 3 {\ni = i + 1\nif true { pass } else { break }\n}\nreturn i":     value.NumberVal(3),
+		"var i = 0\ndo {\ni = i + 1\nif false { continue }\nvar q = 1\n} while i < 3\nreturn i": value.NumberVal(3),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestTreeShakenProgramRuns(t *testing.T) {
+	source := "fn unused() {\nreturn typeof(1)\n}\nfn square(a) {\nreturn a * a\n}\nvar base = 3\nreturn square(base) + 1"
+
+	chunk := compile(source)
+	chunk.TreeShake()
+
+	if stats := chunk.Stats(); stats.OpCodes[compiler.Closure] != 1 {
+		t.Errorf("Expected one function to be left, got %d", stats.OpCodes[compiler.Closure])
+	}
+
+	vm := NewVM()
+	result, err := vm.Interpret(chunk)
+	if err != nil {
+		t.Fatalf("Failed to run '%s': %s", source, err)
+	}
+
+	if result != value.NumberVal(10) {
+		t.Errorf("Expected 10 for '%s', got %v", source, result)
+	}
+}
+
+func TestReturnWithoutValueYieldsNil(t *testing.T) {
+	tests := map[string]value.Value{
+		"fn f() {\nreturn\n}\nreturn f()":                          value.NilVal(),
+		"fn f() {}\nreturn f()":                                    value.NilVal(),
+		"fn f(a) {\nif a { return }\nreturn 2\n}\nreturn f(true)":  value.NilVal(),
+		"fn f(a) {\nif a { return }\nreturn 2\n}\nreturn f(false)": value.NumberVal(2),
+		"fn f() {\nreturn 3\n}\nreturn f()":                        value.NumberVal(3),
+		"var a = 1":                                                value.NilVal(),
+		"var a = 1\na + 1":                                         value.NumberVal(2),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestReturnEndsScript(t *testing.T) {
+	tests := map[string]value.Value{
+		"return 1\nreturn 2":                                    value.NumberVal(1),
+		"var a = 1\n{\nreturn a\n}\na = 2\nreturn a":            value.NumberVal(1),
+		"var a = 1\n{\n{\nvar b = 2\nreturn a + b\n}\n}":        value.NumberVal(3),
+		"var a = 1 + {\nreturn 5\n}\nreturn a":                  value.NumberVal(5),
+		"if true {\nreturn\n}\nreturn 1":                        value.NilVal(),
+		"fn f() {\nreturn 1\n}\n{\nreturn f() + 1\n}\nreturn 0": value.NumberVal(2),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+
+	// Nothing after the return runs
+	vm := NewVM()
+	if _, err := vm.Exec("var a = 1\n{\nreturn\n}\na = 2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if result, _ := vm.Exec("return a"); result != value.NumberVal(1) {
+		t.Errorf("Expected a to stay 1, got %v", result)
+	}
+}
+
+func TestBuiltinConstants(t *testing.T) {
+	tests := map[string]value.Value{
+		"return PI":                               value.NumberVal(math.Pi),
+		"return Inf":                              value.NumberVal(math.Inf(1)),
+		"return -Inf":                             value.NumberVal(math.Inf(-1)),
+		"return Inf == 1 / 0":                     value.TrueVal(),
+		"return NaN == NaN":                       value.FalseVal(),
+		"return NaN != NaN":                       value.TrueVal(),
+		"return 2 * PI":                           value.NumberVal(2 * math.Pi),
+		"fn f() {\nreturn PI\n}\nreturn f()":      value.NumberVal(math.Pi),
+		"{\nvar PI = 3\nreturn PI\n}":             value.NumberVal(3),
+		"fn f(Inf) {\nreturn Inf\n}\nreturn f(1)": value.NumberVal(1),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+
+	if result := run(t, "return NaN"); !value.IsNumber(result) || !math.IsNaN(value.AsNumber(result)) {
+		t.Errorf("Expected NaN for 'return NaN', got %v", result)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	tests := map[string]value.Value{
+		"var r = { name: \"x\", age: 3 }\nreturn r.name":                             value.StringVal("x"),
+		"var r = { name: \"x\", age: 3 }\nreturn r.age + 1":                          value.NumberVal(4),
+		"var r = {\nname: \"x\",\nage: 3,\n}\nreturn r.age":                          value.NumberVal(3),
+		"var r = { a: { b: 2 } }\nreturn r.a.b":                                      value.NumberVal(2),
+		"var r = { a: 1 }\nr.a = r.a + 1\nreturn r.a":                                value.NumberVal(2),
+		"var r = { a: 1 }\nreturn r.a = 5":                                           value.NumberVal(5),
+		"fn f() {\nvar a = 1\nreturn { a: a, b: { var c = 2\nc } }\n}\nreturn f().b": value.NumberVal(2),
+		"return typeof({ a: 1 })":                                                    value.StringVal("record"),
+		"var r = { a: 1 }\nreturn r == r":                                            value.TrueVal(),
+		"return { a: 1 } == { a: 1 }":                                                value.FalseVal(),
+		// A label followed by a loop still starts a block
+		"var a = {\nouter: while true { break outer }\n2\n}\nreturn a": value.NumberVal(2),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+
+	if result := run(t, "return { name: \"x\", age: 3 }"); result.String() != "{name: x, age: 3}" {
+		t.Errorf("Expected {name: x, age: 3}, got %v", result)
+	}
+}
+
+func TestFunctionEquality(t *testing.T) {
+	tests := map[string]value.Value{
+		"fn f() {}\nreturn f == f":                                      value.TrueVal(),
+		"fn f() {}\nfn g() {}\nreturn f == g":                           value.FalseVal(),
+		"fn make() {\nreturn fn() {}\n}\nreturn make() == make()":       value.FalseVal(),
+		"fn make() {\nreturn fn() {}\n}\nvar f = make()\nreturn f == f": value.TrueVal(),
+		"return typeof == typeof":                                       value.TrueVal(),
+		"return typeof != arity":                                        value.TrueVal(),
+		"fn f() {}\nreturn f == \"f\"":                                  value.FalseVal(),
+		"var r = { inc: fn(x) { return x + 1 } }\nreturn r.inc(1)":      value.NumberVal(2),
+		"fn f() {}\nvar r = { g: f }\nreturn r.g == f":                  value.TrueVal(),
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+}
+
+func TestRecordSpread(t *testing.T) {
+	tests := map[string]string{
+		"var base = { a: 1, b: 2 }\nreturn { ...base, b: 3 }":                   "{a: 1, b: 3}",
+		"var base = { a: 1 }\nreturn { ...base, c: 3 }":                         "{a: 1, c: 3}",
+		"var base = { a: 1 }\nreturn { b: 0, a: 0, ...base }":                   "{b: 0, a: 1}",
+		"var x = { a: 1, b: 1 }\nvar y = { b: 2, c: 2 }\nreturn { ...x, ...y }": "{a: 1, b: 2, c: 2}",
+		"var x = { a: 1, b: 1 }\nvar y = { b: 2, c: 2 }\nreturn { ...y, ...x }": "{b: 1, c: 2, a: 1}",
+		"var x = { a: 1 }\nreturn {\n...x,\nb: 2,\n...{ a: 3 },\n}":             "{a: 3, b: 2}",
+		"fn f(r) {\nvar b = 2\nreturn { ...r, b: b }\n}\nreturn f({ a: 1 })":    "{a: 1, b: 2}",
+	}
+
+	for source, expected := range tests {
+		if result := run(t, source); result.String() != expected {
+			t.Errorf("Expected %v for '%s', got %v", expected, source, result)
+		}
+	}
+
+	// The spread record is copied, not shared
+	if result := run(t, "var base = { a: 1 }\nvar copy = { ...base }\ncopy.a = 2\nreturn base.a"); result != value.NumberVal(1) {
+		t.Errorf("Expected 1, got %v", result)
+	}
+}
+
+func TestUndefinedRecordFields(t *testing.T) {
+	tests := map[string]string{
+		"var r = { a: 1 }\nreturn r.b": "Undefined field 'b'.",
+		"var r = { a: 1 }\nr.b = 2":    "Undefined field 'b'.",
+		"var a = 1\nreturn a.b":        "Only records have fields, got number.",
+		"var r = \"s\"\nr.length = 2":  "Only records have fields, got string.",
+		"return { a: 1, ...nil }":      "Can only spread records, got nil.",
+	}
+
+	for source, expected := range tests {
+		_, err := Exec(source)
+
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok || runtimeErr.Message != expected {
+			t.Errorf("Expected '%s' for '%s', got %v", expected, source, err)
+		}
+	}
+}